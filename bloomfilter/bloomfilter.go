@@ -1,6 +1,8 @@
 package bloomfilter
 
 import (
+	"encoding/binary"
+	"fmt"
 	"main/interfaces"
 	"math"
 )
@@ -16,6 +18,13 @@ type BloomFilterImplementation interface {
 	Contains(key interfaces.Comparable) (bool, error)
 }
 
+// DoubleHasher is implemented by keys whose Hash is h1 + i*h2 for the
+// i-th hash. The filter then derives the positions from h1 and h2
+// without allocating.
+type DoubleHasher interface {
+	DoubleHash() (h1, h2 uint32)
+}
+
 func NewBloomFilter(expectedItems uint32, falsePositiveRate float64) *BloomFilter {
 	if falsePositiveRate <= 0.0 || falsePositiveRate >= 1.0 {
 		panic("falsePositiveRate must be between 0 and 1 (exclusive)")
@@ -34,6 +43,14 @@ func NewBloomFilter(expectedItems uint32, falsePositiveRate float64) *BloomFilte
 }
 
 func (b *BloomFilter) Insert(key interfaces.Comparable) error {
+	if dh, ok := key.(DoubleHasher); ok {
+		h1, h2 := dh.DoubleHash()
+		for i := range b.numHashes {
+			position := (h1 + i*h2) % b.size
+			b.buckets[position/64] |= 1 << (position % 64)
+		}
+		return nil
+	}
 	hashs, err := key.Hash(b.numHashes)
 	if err != nil {
 		return err
@@ -51,6 +68,16 @@ func (b *BloomFilter) Insert(key interfaces.Comparable) error {
 }
 
 func (b *BloomFilter) Contains(key interfaces.Comparable) (bool, error) {
+	if dh, ok := key.(DoubleHasher); ok {
+		h1, h2 := dh.DoubleHash()
+		for i := range b.numHashes {
+			position := (h1 + i*h2) % b.size
+			if b.buckets[position/64]&(1<<(position%64)) == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
 	hashs, err := key.Hash(b.numHashes)
 	if err != nil {
 		return false, err
@@ -68,3 +95,43 @@ func (b *BloomFilter) Contains(key interfaces.Comparable) (bool, error) {
 
 	return true, nil
 }
+
+/*
+ * Binary Format:
+ * [4 bytes] - Size in bits (uint32)
+ * [4 bytes] - Number of hashes (uint32)
+ * For each bucket:
+ *   [8 bytes] - Bucket bits (uint64)
+ */
+func (b *BloomFilter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 8+8*len(b.buckets))
+	binary.BigEndian.PutUint32(data[0:4], b.size)
+	binary.BigEndian.PutUint32(data[4:8], b.numHashes)
+	for i, bucket := range b.buckets {
+		binary.BigEndian.PutUint64(data[8+8*i:], bucket)
+	}
+	return data, nil
+}
+
+func (b *BloomFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return fmt.Errorf("bloom filter data too short: %d bytes", len(data))
+	}
+	size := binary.BigEndian.Uint32(data[0:4])
+	numHashes := binary.BigEndian.Uint32(data[4:8])
+
+	numBuckets := (int(size) + 63) / 64
+	if size == 0 || len(data) != 8+8*numBuckets {
+		return fmt.Errorf("bloom filter of %d bits doesn't fit in %d bytes", size, len(data))
+	}
+
+	buckets := make([]uint64, numBuckets)
+	for i := range buckets {
+		buckets[i] = binary.BigEndian.Uint64(data[8+8*i:])
+	}
+
+	b.size = size
+	b.numHashes = numHashes
+	b.buckets = buckets
+	return nil
+}
@@ -1,9 +1,12 @@
 package bloomfilter_test
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"hash/fnv"
 	"main/bloomfilter"
+	"main/interfaces"
 	"main/keys"
 	"testing"
 )
@@ -76,3 +79,80 @@ func TestProbability(t *testing.T) {
 	t.Logf("False positive rate: %.2f%% (%d out of %d items)",
 		falsePositiveRate, falsePositives, len(nonInserted))
 }
+
+func TestMarshalRoundTrip(t *testing.T) {
+	bf := bloomfilter.NewBloomFilter(500, 0.01)
+	for i := uint32(0); i < 500; i += 3 {
+		if err := bf.Insert(keys.NewIntKey(i)); err != nil {
+			t.Fatalf("insert failed: %v", err)
+		}
+	}
+
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+
+	restored := new(bloomfilter.BloomFilter)
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+
+	for i := uint32(0); i < 500; i++ {
+		want, _ := bf.Contains(keys.NewIntKey(i))
+		got, _ := restored.Contains(keys.NewIntKey(i))
+		if want != got {
+			t.Errorf("Restored filter disagrees on %d: expected %v, got %v", i, want, got)
+		}
+	}
+
+	if err := restored.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Errorf("Expected truncated data to be rejected")
+	}
+}
+
+// hashOnly hides DoubleHash, the filter has to go through Hash.
+type hashOnly struct {
+	interfaces.Comparable
+}
+
+func TestDoubleHash(t *testing.T) {
+	// filters written before DoubleHash existed must still match.
+	reference := func(data []byte) (uint32, uint32) {
+		h1, h2 := fnv.New32a(), fnv.New32()
+		h1.Write(data)
+		h2.Write(data)
+		return h1.Sum32(), h2.Sum32()
+	}
+	var le [4]byte
+	binary.LittleEndian.PutUint32(le[:], 1234)
+	checks := []struct {
+		key  interfaces.Comparable
+		data []byte
+	}{
+		{keys.NewIntKey(1234), le[:]},
+		{keys.NewStringKey("hello"), []byte("hello")},
+		{keys.NewBytesKey([]byte{0, 0xff, 7}), []byte{0, 0xff, 7}},
+	}
+	for _, c := range checks {
+		h1, h2 := reference(c.data)
+		got, _ := c.key.Hash(3)
+		if got[0] != h1 || got[1] != h1+h2 || got[2] != h1+2*h2 {
+			t.Errorf("Expected the FNV hashes of %v, got %v", c.key.GetValue(), got)
+		}
+	}
+
+	fast, slow := bloomfilter.NewBloomFilter(200, 0.01), bloomfilter.NewBloomFilter(200, 0.01)
+	for i := range uint32(200) {
+		fast.Insert(keys.NewIntKey(i))
+		slow.Insert(hashOnly{keys.NewIntKey(i)})
+	}
+	fastData, _ := fast.MarshalBinary()
+	slowData, _ := slow.MarshalBinary()
+	if !bytes.Equal(fastData, slowData) {
+		t.Errorf("Expected DoubleHash and Hash to set the same bits")
+	}
+	if allocs := testing.AllocsPerRun(100, func() { fast.Contains(keys.NewIntKey(7)) }); allocs > 1 {
+		t.Errorf("Expected Contains to allocate at most the key, got %v allocations", allocs)
+	}
+}
@@ -0,0 +1,352 @@
+package cache
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ * Cache keeps parts of SSTables in memory under a byte budget: blocks,
+ * keyed by the ID of their table and their offset in the file, or rows,
+ * keyed by the ID of their table and the user key. Table IDs are never
+ * reused, so entries of a table that is gone are never served for
+ * another one, they just age out.
+ *
+ * The cache is split into shards by key hash, each with its own lock and
+ * an equal part of the capacity, and the eviction policy runs per shard.
+ * Pinned entries count against the capacity but are never evicted, only
+ * Erase drops them. Tables pin their index and filter blocks.
+ */
+
+type Key struct {
+	ID     uint64
+	Offset uint64
+	// the encoded user key of a row, empty for blocks.
+	Row string
+}
+
+type Policy int
+
+const (
+	// LRU evicts the entry that was used the longest time ago.
+	LRU Policy = iota
+	// Clock sweeps a hand over the entries and evicts the first one
+	// that wasn't used since the last sweep. Hits only set a flag, no
+	// list gets reordered.
+	Clock
+)
+
+func (p Policy) String() string {
+	switch p {
+	case LRU:
+		return "lru"
+	case Clock:
+		return "clock"
+	}
+	return "unknown"
+}
+
+type Stats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Inserts   uint64 `json:"inserts"`
+	Evictions uint64 `json:"evictions"`
+	// bytes taken by all entries, including the pinned ones.
+	Usage       int64 `json:"usage"`
+	PinnedUsage int64 `json:"pinned_usage"`
+	Capacity    int64 `json:"capacity"`
+}
+
+// shards get at least this much of the capacity, small caches use fewer
+// of them so a block still fits in one.
+const (
+	minShardCapacity = 256 << 10
+	maxShards        = 16
+)
+
+type Cache struct {
+	shards   []*shard
+	seed     maphash.Seed
+	capacity int64
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	inserts   atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// New returns a cache of capacity bytes, split into as many shards as
+// the capacity allows.
+func New(capacity int64, policy Policy) *Cache {
+	n := 1
+	for n < maxShards && capacity/int64(n*2) >= minShardCapacity {
+		n *= 2
+	}
+
+	c := &Cache{seed: maphash.MakeSeed(), capacity: capacity}
+	for range n {
+		c.shards = append(c.shards, newShard(capacity/int64(n), policy))
+	}
+	return c
+}
+
+func (c *Cache) shard(key Key) *shard {
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[0:8], key.ID)
+	binary.LittleEndian.PutUint64(buf[8:16], key.Offset)
+	h.Write(buf[:])
+	h.WriteString(key.Row)
+	return c.shards[h.Sum64()%uint64(len(c.shards))]
+}
+
+// Get returns the value cached for key and marks it as used.
+func (c *Cache) Get(key Key) (any, bool) {
+	value, ok := c.shard(key).get(key)
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return value, ok
+}
+
+// Insert caches value under key, charge is the number of bytes it
+// takes. Entries are evicted until it fits in its shard, a value larger
+// than the whole shard isn't cached at all.
+func (c *Cache) Insert(key Key, value any, charge int64) {
+	c.inserts.Add(1)
+	c.evictions.Add(c.shard(key).insert(key, value, charge, false))
+}
+
+// InsertPinned caches value under key until it is erased.
+func (c *Cache) InsertPinned(key Key, value any, charge int64) {
+	c.inserts.Add(1)
+	c.evictions.Add(c.shard(key).insert(key, value, charge, true))
+}
+
+// GetPinned returns the value pinned under key. Pinned entries are
+// read on every lookup of their table, they stay out of the hit and
+// miss counts so these keep describing the blocks that can be evicted.
+func (c *Cache) GetPinned(key Key) (any, bool) {
+	return c.shard(key).getPinned(key)
+}
+
+func (c *Cache) Erase(key Key) {
+	c.shard(key).erase(key)
+}
+
+func (c *Cache) Stats() Stats {
+	stats := Stats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Inserts:   c.inserts.Load(),
+		Evictions: c.evictions.Load(),
+		Capacity:  c.capacity,
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Usage += s.usage
+		stats.PinnedUsage += s.pinned
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+type entry struct {
+	key    Key
+	value  any
+	charge int64
+	pinned bool
+	// links of the eviction policy, pinned entries aren't linked.
+	prev, next *entry
+	referenced bool
+}
+
+// evictor orders the unpinned entries of a shard, the shard lock is
+// held on every call.
+type evictor interface {
+	add(e *entry)
+	touch(e *entry)
+	remove(e *entry)
+	// victim returns the entry to evict next, nil if there is none.
+	victim() *entry
+}
+
+type shard struct {
+	mu       sync.Mutex
+	capacity int64
+	usage    int64
+	pinned   int64
+	entries  map[Key]*entry
+	evictor  evictor
+}
+
+func newShard(capacity int64, policy Policy) *shard {
+	s := &shard{capacity: capacity, entries: make(map[Key]*entry)}
+	if policy == Clock {
+		s.evictor = &clock{}
+	} else {
+		s.evictor = newLRU()
+	}
+	return s
+}
+
+func (s *shard) get(key Key) (any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !e.pinned {
+		s.evictor.touch(e)
+	}
+	return e.value, true
+}
+
+func (s *shard) getPinned(key Key) (any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || !e.pinned {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// insert returns the number of entries it evicted.
+func (s *shard) insert(key Key, value any, charge int64, pinned bool) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.entries[key]; ok {
+		s.remove(old)
+	}
+	if !pinned && charge > s.capacity {
+		return 0
+	}
+
+	// room is made first, so the new entry is never its own victim.
+	var evicted uint64
+	for s.usage+charge > s.capacity {
+		victim := s.evictor.victim()
+		if victim == nil {
+			break
+		}
+		s.remove(victim)
+		evicted++
+	}
+	if !pinned && s.usage+charge > s.capacity {
+		// pinned entries take up the rest.
+		return evicted
+	}
+
+	e := &entry{key: key, value: value, charge: charge, pinned: pinned}
+	s.entries[key] = e
+	s.usage += charge
+	if pinned {
+		s.pinned += charge
+	} else {
+		s.evictor.add(e)
+	}
+	return evicted
+}
+
+func (s *shard) erase(key Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok {
+		s.remove(e)
+	}
+}
+
+func (s *shard) remove(e *entry) {
+	delete(s.entries, e.key)
+	s.usage -= e.charge
+	if e.pinned {
+		s.pinned -= e.charge
+	} else {
+		s.evictor.remove(e)
+	}
+}
+
+// lru keeps the entries in a circular list, most recently used first.
+type lru struct {
+	head entry
+}
+
+func newLRU() *lru {
+	l := &lru{}
+	l.head.prev, l.head.next = &l.head, &l.head
+	return l
+}
+
+func (l *lru) add(e *entry) {
+	e.prev, e.next = &l.head, l.head.next
+	e.prev.next, e.next.prev = e, e
+}
+
+func (l *lru) touch(e *entry) {
+	l.remove(e)
+	l.add(e)
+}
+
+func (l *lru) remove(e *entry) {
+	e.prev.next, e.next.prev = e.next, e.prev
+	e.prev, e.next = nil, nil
+}
+
+func (l *lru) victim() *entry {
+	if l.head.prev == &l.head {
+		return nil
+	}
+	return l.head.prev
+}
+
+// clock keeps the entries in a ring. New entries go right behind the
+// hand, so it gets to them last.
+type clock struct {
+	hand *entry
+}
+
+func (c *clock) add(e *entry) {
+	if c.hand == nil {
+		e.prev, e.next = e, e
+		c.hand = e
+		return
+	}
+	e.prev, e.next = c.hand.prev, c.hand
+	e.prev.next, e.next.prev = e, e
+}
+
+func (c *clock) touch(e *entry) {
+	e.referenced = true
+}
+
+func (c *clock) remove(e *entry) {
+	if e.next == e {
+		c.hand = nil
+	} else {
+		if c.hand == e {
+			c.hand = e.next
+		}
+		e.prev.next, e.next.prev = e.next, e.prev
+	}
+	e.prev, e.next = nil, nil
+}
+
+// victim clears the referenced flag of every entry it passes, so it
+// finds one within a single sweep.
+func (c *clock) victim() *entry {
+	if c.hand == nil {
+		return nil
+	}
+	for c.hand.referenced {
+		c.hand.referenced = false
+		c.hand = c.hand.next
+	}
+	return c.hand
+}
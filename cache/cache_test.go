@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func key(offset uint64) Key {
+	return Key{ID: 1, Offset: offset}
+}
+
+func cached(c *Cache, offsets ...uint64) []uint64 {
+	var found []uint64
+	for _, offset := range offsets {
+		if _, ok := c.shard(key(offset)).entries[key(offset)]; ok {
+			found = append(found, offset)
+		}
+	}
+	return found
+}
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	c := New(300, LRU)
+	for i := range uint64(3) {
+		c.Insert(key(i), i, 100)
+	}
+	// 0 becomes the most recently used, 1 the least.
+	if _, ok := c.Get(key(0)); !ok {
+		t.Fatalf("Expected key 0 to be cached")
+	}
+	c.Insert(key(3), 3, 100)
+
+	if got := cached(c, 0, 1, 2, 3); len(got) != 3 || got[0] != 0 || got[1] != 2 {
+		t.Errorf("Expected 1 to be evicted, cached %v", got)
+	}
+	if stats := c.Stats(); stats.Evictions != 1 || stats.Usage != 300 {
+		t.Errorf("Expected one eviction and a full cache, got %+v", stats)
+	}
+}
+
+func TestClockGivesSecondChance(t *testing.T) {
+	c := New(300, Clock)
+	for i := range uint64(3) {
+		c.Insert(key(i), i, 100)
+	}
+	// the hand starts at 0, which was used and gets passed over.
+	c.Get(key(0))
+	c.Insert(key(3), 3, 100)
+	if got := cached(c, 0, 1, 2, 3); len(got) != 3 || got[0] != 0 || got[1] != 2 {
+		t.Errorf("Expected 1 to be evicted, cached %v", got)
+	}
+
+	// every entry was used, a full sweep clears them and evicts the
+	// one the hand started at.
+	for _, offset := range []uint64{0, 2, 3} {
+		c.Get(key(offset))
+	}
+	c.Insert(key(4), 4, 100)
+	if got := cached(c, 0, 2, 3, 4); len(got) != 3 || got[0] != 0 || got[1] != 3 {
+		t.Errorf("Expected 2 to be evicted, cached %v", got)
+	}
+}
+
+func TestPinnedEntriesAreNotEvicted(t *testing.T) {
+	for _, policy := range []Policy{LRU, Clock} {
+		t.Run(policy.String(), func(t *testing.T) {
+			c := New(300, policy)
+			c.InsertPinned(key(0), "index", 200)
+			for i := range uint64(5) {
+				c.Insert(key(10+i), i, 100)
+			}
+			if _, ok := c.Get(key(0)); !ok {
+				t.Errorf("Expected the pinned entry to stay")
+			}
+			if value, ok := c.GetPinned(key(0)); !ok || value != "index" {
+				t.Errorf("Expected GetPinned to return the pinned entry, got %v", value)
+			}
+			if _, ok := c.GetPinned(key(14)); ok {
+				t.Errorf("Expected GetPinned to skip unpinned entries")
+			}
+			if got := cached(c, 10, 11, 12, 13, 14); len(got) != 1 || got[0] != 14 {
+				t.Errorf("Expected room for the last entry only, cached %v", got)
+			}
+
+			// too large for what is left, so nothing else can stay.
+			c.InsertPinned(key(1), "filter", 200)
+			if stats := c.Stats(); stats.PinnedUsage != 400 || stats.Usage != 400 {
+				t.Errorf("Expected only pinned entries to remain, got %+v", stats)
+			}
+
+			c.Erase(key(0))
+			c.Erase(key(1))
+			if stats := c.Stats(); stats.Usage != 0 || stats.PinnedUsage != 0 {
+				t.Errorf("Expected an empty cache after Erase, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestOversizedValueIsNotCached(t *testing.T) {
+	c := New(100, LRU)
+	c.Insert(key(0), 0, 50)
+	c.Insert(key(1), 1, 101)
+	if _, ok := c.Get(key(1)); ok {
+		t.Errorf("Expected a value larger than the cache to be skipped")
+	}
+	if _, ok := c.Get(key(0)); !ok {
+		t.Errorf("Expected the oversized insert to leave other entries alone")
+	}
+	if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Expected one hit and one miss, got %+v", stats)
+	}
+}
+
+func TestShards(t *testing.T) {
+	if n := len(New(64<<10, LRU).shards); n != 1 {
+		t.Errorf("Expected a small cache to use a single shard, got %d", n)
+	}
+	if n := len(New(1<<20, LRU).shards); n != 4 {
+		t.Errorf("Expected 4 shards of 256 KiB, got %d", n)
+	}
+	if n := len(New(1<<30, LRU).shards); n != maxShards {
+		t.Errorf("Expected %d shards, got %d", maxShards, n)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	for _, policy := range []Policy{LRU, Clock} {
+		t.Run(policy.String(), func(t *testing.T) {
+			c := New(1<<20, policy)
+			var wg sync.WaitGroup
+			for range 4 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range 5000 {
+						k := Key{ID: uint64(rand.Intn(4)), Offset: uint64(rand.Intn(200))}
+						if value, ok := c.Get(k); ok {
+							if value.(Key) != k {
+								t.Errorf("Expected %v, got %v", k, value)
+								return
+							}
+							continue
+						}
+						c.Insert(k, k, 4096)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if stats := c.Stats(); stats.Usage > stats.Capacity {
+				t.Errorf("Expected usage within capacity, got %+v", stats)
+			}
+		})
+	}
+}
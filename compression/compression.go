@@ -0,0 +1,172 @@
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+ * Compressors turn a block into its stored form and back. Every codec
+ * has a one byte ID that gets written in front of each compressed block,
+ * so a reader finds the codec of a block without knowing which one the
+ * writer was configured with.
+ */
+
+type Compressor interface {
+	// ID is stored in the block header, it must never change once
+	// blocks have been written with it.
+	ID() byte
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+const (
+	NoneID  byte = 0
+	FlateID byte = 1
+	ZlibID  byte = 2
+	GzipID  byte = 3
+)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[byte]Compressor{}
+)
+
+func init() {
+	Register(None{})
+	Register(Flate{Level: flate.DefaultCompression})
+	Register(Zlib{Level: zlib.DefaultCompression})
+	Register(Gzip{Level: gzip.DefaultCompression})
+}
+
+// Register makes a codec available to readers, replacing any codec
+// registered with the same ID.
+func Register(c Compressor) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[c.ID()] = c
+}
+
+// Lookup returns the codec registered for id.
+func Lookup(id byte) (Compressor, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	c, ok := registry[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression codec %d", id)
+	}
+	return c, nil
+}
+
+// ByName returns the registered codec called name.
+func ByName(name string) (Compressor, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for _, c := range registry {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown compression codec %q", name)
+}
+
+// None stores blocks as they are.
+type None struct{}
+
+func (None) ID() byte     { return NoneID }
+func (None) Name() string { return "none" }
+
+func (None) Compress(src []byte) ([]byte, error) { return src, nil }
+
+func (None) Decompress(src []byte) ([]byte, error) { return src, nil }
+
+// Flate is raw DEFLATE, the smallest framing of the three stdlib codecs.
+type Flate struct {
+	Level int
+}
+
+func (Flate) ID() byte     { return FlateID }
+func (Flate) Name() string { return "flate" }
+
+func (f Flate) Compress(src []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, f.Level)
+	if err != nil {
+		return nil, err
+	}
+	return finish(buf, w, src)
+}
+
+func (Flate) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Zlib is DEFLATE with a small header and an adler32 trailer.
+type Zlib struct {
+	Level int
+}
+
+func (Zlib) ID() byte     { return ZlibID }
+func (Zlib) Name() string { return "zlib" }
+
+func (z Zlib) Compress(src []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := zlib.NewWriterLevel(buf, z.Level)
+	if err != nil {
+		return nil, err
+	}
+	return finish(buf, w, src)
+}
+
+func (Zlib) Decompress(src []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Gzip is DEFLATE with the gzip header and a crc32 trailer.
+type Gzip struct {
+	Level int
+}
+
+func (Gzip) ID() byte     { return GzipID }
+func (Gzip) Name() string { return "gzip" }
+
+func (g Gzip) Compress(src []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := gzip.NewWriterLevel(buf, g.Level)
+	if err != nil {
+		return nil, err
+	}
+	return finish(buf, w, src)
+}
+
+func (Gzip) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func finish(buf *bytes.Buffer, w io.WriteCloser, src []byte) ([]byte, error) {
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
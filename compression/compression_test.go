@@ -0,0 +1,46 @@
+package compression
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	src := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 100))
+
+	for _, id := range []byte{NoneID, FlateID, ZlibID, GzipID} {
+		c, err := Lookup(id)
+		if err != nil {
+			t.Fatalf("Lookup(%d) failed: %v", id, err)
+		}
+
+		compressed, err := c.Compress(src)
+		if err != nil {
+			t.Fatalf("%s: Compress failed: %v", c.Name(), err)
+		}
+		if id != NoneID && len(compressed) >= len(src) {
+			t.Errorf("%s: expected repetitive input to shrink, got %d bytes from %d", c.Name(), len(compressed), len(src))
+		}
+
+		got, err := c.Decompress(compressed)
+		if err != nil {
+			t.Fatalf("%s: Decompress failed: %v", c.Name(), err)
+		}
+		if !bytes.Equal(got, src) {
+			t.Errorf("%s: round trip changed the data", c.Name())
+		}
+	}
+}
+
+func TestLookupUnknownCodec(t *testing.T) {
+	if _, err := Lookup(0xee); err == nil {
+		t.Errorf("Expected an error for an unregistered codec")
+	}
+	if _, err := ByName("snappy"); err == nil {
+		t.Errorf("Expected an error for an unregistered codec name")
+	}
+	if c, err := ByName("zlib"); err != nil || c.ID() != ZlibID {
+		t.Errorf("Expected ByName to find zlib, got %v, %v", c, err)
+	}
+}
@@ -6,8 +6,8 @@ type Comparable interface {
 	// -1 if smaller
 	Compare(t Comparable) int8
 	GetValue() any
-	// first byte is numbering for different supported keys which i will document later
-	// for now i will only support uint32 which will be 0x00 in hex.
+	// first byte is the key type, the registered ones are listed in
+	// keys/registry.go.
 	ToBytes() ([]byte, error)
 	Hash(numHashes uint32)([]uint32, error)
 }
@@ -0,0 +1,74 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"main/interfaces"
+)
+
+// BytesKey is an arbitrary binary key, ordered like bytes.Compare.
+type BytesKey struct {
+	value []byte
+}
+
+// NewBytesKey wraps b, which must not be changed afterwards.
+func NewBytesKey(b []byte) *BytesKey {
+	return &BytesKey{value: b}
+}
+
+func (k *BytesKey) Compare(other interfaces.Comparable) int8 {
+	otherKey, ok := other.(*BytesKey)
+	if !ok {
+		return CompareTypes(k, other)
+	}
+	return int8(bytes.Compare(k.value, otherKey.value))
+}
+
+func (k *BytesKey) KeyType() uint8 {
+	return BytesKeyType
+}
+
+func (k *BytesKey) GetValue() any {
+	return k.value
+}
+
+func (k *BytesKey) SortBytes() []byte {
+	return k.value
+}
+
+// Bytes returns the key without copying it.
+func (k *BytesKey) Bytes() []byte {
+	return k.value
+}
+
+func (k *BytesKey) ToBytes() ([]byte, error) {
+	// 0x02 for bytes key type, then 4 bytes for length, then the key
+	buf := make([]byte, 5+len(k.value))
+	buf[0] = BytesKeyType
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(k.value)))
+	copy(buf[5:], k.value)
+	return buf, nil
+}
+
+func BytesKeyFromBytes(buf io.Reader) (interfaces.Comparable, error) {
+	var lenBytes [4]byte
+	if _, err := io.ReadFull(buf, lenBytes[:]); err != nil {
+		return nil, fmt.Errorf("error parsing bytes key length: %w", err)
+	}
+	value := make([]byte, binary.BigEndian.Uint32(lenBytes[:]))
+	if _, err := io.ReadFull(buf, value); err != nil {
+		return nil, fmt.Errorf("error parsing bytes key: %w", err)
+	}
+	return NewBytesKey(value), nil
+}
+
+func (k *BytesKey) Hash(numHashes uint32) ([]uint32, error) {
+	h1, h2 := k.DoubleHash()
+	return hashes(h1, h2, numHashes), nil
+}
+
+func (k *BytesKey) DoubleHash() (uint32, uint32) {
+	return fnv32a(k.value), fnv32(k.value)
+}
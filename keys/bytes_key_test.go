@@ -0,0 +1,103 @@
+package keys
+
+import (
+	"bytes"
+	"hash/fnv"
+	"main/interfaces"
+	"testing"
+)
+
+func TestBytesKeyRoundTrip(t *testing.T) {
+	for _, value := range [][]byte{nil, {0}, []byte("key"), bytes.Repeat([]byte{0xff}, 300)} {
+		encoded, err := NewBytesKey(value).ToBytes()
+		if err != nil {
+			t.Fatalf("ToBytes failed: %v", err)
+		}
+		if encoded[0] != BytesKeyType {
+			t.Errorf("Expected type byte %d, got %d", BytesKeyType, encoded[0])
+		}
+		key, err := ParseKey(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("ParseKey failed: %v", err)
+		}
+		if got, ok := key.(*BytesKey); !ok || !bytes.Equal(got.Bytes(), value) {
+			t.Errorf("Expected %q back, got %#v", value, key)
+		}
+	}
+
+	// a length running past the end.
+	if _, err := ParseKey(bytes.NewReader([]byte{BytesKeyType, 0, 0, 0, 9, 'a'})); err == nil {
+		t.Errorf("Expected a truncated key to fail")
+	}
+}
+
+func TestBytesKeyOrder(t *testing.T) {
+	values := [][]byte{nil, {0}, {0, 0}, {0, 1}, []byte("a"), []byte("a\x00"), []byte("b"), {0xff}}
+	for i, a := range values {
+		for j, b := range values {
+			want := int8(bytes.Compare(a, b))
+			if got := NewBytesKey(a).Compare(NewBytesKey(b)); got != want {
+				t.Errorf("Expected %q vs %q to be %d, got %d", a, b, want, got)
+			}
+			if got := Compare(NewBytesKey(a), NewBytesKey(b)); got != want {
+				t.Errorf("Expected Compare(%q, %q) to be %d, got %d", a, b, want, got)
+			}
+			if (i < j) != (want < 0) {
+				t.Errorf("Expected %q and %q in the order of the list", a, b)
+			}
+		}
+	}
+
+	a, b := NewBytesKey([]byte("a")), NewBytesKey([]byte("b"))
+	if allocs := testing.AllocsPerRun(100, func() { Compare(a, b) }); allocs != 0 {
+		t.Errorf("Expected comparing byte keys not to allocate, got %v allocations", allocs)
+	}
+}
+
+func TestSortBytes(t *testing.T) {
+	sorted := [][]Sortable{
+		{NewIntKey(0), NewIntKey(1), NewIntKey(255), NewIntKey(256), NewIntKey(1 << 31)},
+		{NewStringKey(""), NewStringKey("a"), NewStringKey("a\x00"), NewStringKey("ab"), NewStringKey("b")},
+		{NewBytesKey([]byte{0}), NewBytesKey([]byte{0, 0}), NewBytesKey([]byte("a")), NewBytesKey([]byte{0xff})},
+	}
+	for _, list := range sorted {
+		for i, a := range list {
+			for j, b := range list {
+				want := Compare(a.(interfaces.Comparable), b.(interfaces.Comparable))
+				if got := int8(bytes.Compare(a.SortBytes(), b.SortBytes())); got != want || (i < j) != (want < 0) {
+					t.Errorf("Expected the sort bytes of %v and %v to compare as %d, got %d", a, b, want, got)
+				}
+			}
+		}
+	}
+
+	key := NewStringKey("key")
+	if allocs := testing.AllocsPerRun(100, func() { key.SortBytes() }); allocs != 0 {
+		t.Errorf("Expected SortBytes not to allocate, got %v allocations", allocs)
+	}
+}
+
+func TestDoubleHash(t *testing.T) {
+	value := []byte("some key")
+	h1, h2 := NewBytesKey(value).DoubleHash()
+
+	a, b := fnv.New32a(), fnv.New32()
+	a.Write(value)
+	b.Write(value)
+	if h1 != a.Sum32() || h2 != b.Sum32() {
+		t.Errorf("Expected the FNV-1a and FNV-1 hashes %d and %d, got %d and %d", a.Sum32(), b.Sum32(), h1, h2)
+	}
+
+	got, _ := NewBytesKey(value).Hash(4)
+	for i, h := range got {
+		if want := h1 + uint32(i)*h2; h != want {
+			t.Errorf("Expected hash %d to be %d, got %d", i, want, h)
+		}
+	}
+
+	// string keys hash their content the same way.
+	s1, s2 := NewStringKey("some key").DoubleHash()
+	if s1 != h1 || s2 != h2 {
+		t.Errorf("Expected string and byte keys of equal content to hash alike, got %d, %d and %d, %d", s1, s2, h1, h2)
+	}
+}
@@ -0,0 +1,40 @@
+package keys
+
+/*
+ * Keys hash into a bloom filter by double hashing: hash i is
+ * h1 + i*h2, where h1 is the 32 bit FNV-1a and h2 the FNV-1 hash of the
+ * key. Both are computed inline rather than through hash/fnv, which
+ * allocates a hasher per call. DoubleHash hands out h1 and h2 so the
+ * filter can derive the rest without a slice.
+ */
+
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+func fnv32a[T string | []byte](data T) uint32 {
+	h := uint32(fnvOffset32)
+	for i := 0; i < len(data); i++ {
+		h ^= uint32(data[i])
+		h *= fnvPrime32
+	}
+	return h
+}
+
+func fnv32[T string | []byte](data T) uint32 {
+	h := uint32(fnvOffset32)
+	for i := 0; i < len(data); i++ {
+		h *= fnvPrime32
+		h ^= uint32(data[i])
+	}
+	return h
+}
+
+func hashes(h1, h2, numHashes uint32) []uint32 {
+	out := make([]uint32, numHashes)
+	for j := range numHashes {
+		out[j] = h1 + j*h2
+	}
+	return out
+}
@@ -1,26 +1,28 @@
 package keys
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
-	"hash/fnv"
 	"io"
 	"main/interfaces"
 )
 
 type IntKey struct {
 	value uint32
+	// value in big endian, see SortBytes.
+	sortBytes [4]byte
 }
 
 func NewIntKey(k uint32) *IntKey {
-	return &IntKey{value: k}
+	key := &IntKey{value: k}
+	binary.BigEndian.PutUint32(key.sortBytes[:], k)
+	return key
 }
 
 func (i *IntKey) Compare(other interfaces.Comparable) int8 {
 	otherKey, ok := other.(*IntKey)
 	if !ok {
-		panic("Cannot compare IntKey with a different type")
+		return CompareTypes(i, other)
 	}
 
 	if i.value < otherKey.value {
@@ -31,6 +33,14 @@ func (i *IntKey) Compare(other interfaces.Comparable) int8 {
 	return 0
 }
 
+func (i *IntKey) KeyType() uint8 {
+	return IntKeyType
+}
+
+func (i *IntKey) SortBytes() []byte {
+	return i.sortBytes[:]
+}
+
 func (i *IntKey) GetValue() any {
 	return i.value
 }
@@ -40,14 +50,10 @@ func (i *IntKey) ToBytes() ([]byte, error) {
 	 * this functions outputs 5 bytes, first bye is for key type
 	 * and other 4 for the key.
 	 */
-	buf := new(bytes.Buffer)
-	if err := binary.Write(buf, binary.BigEndian, uint8(0x00)); err != nil {
-		return nil, err
-	}
-	if err := binary.Write(buf, binary.BigEndian, i.value); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	buf := make([]byte, 5)
+	buf[0] = IntKeyType
+	binary.BigEndian.PutUint32(buf[1:], i.value)
+	return buf, nil
 }
 
 func IntKeyFromBytes(buf io.Reader) (interfaces.Comparable, error) {
@@ -58,49 +64,13 @@ func IntKeyFromBytes(buf io.Reader) (interfaces.Comparable, error) {
 	return NewIntKey(binary.BigEndian.Uint32(intBytes)), nil
 }
 
-func ParseKey(buf io.Reader) (interfaces.Comparable, error) {
-	typeByte := make([]byte, 1)
-	if n, err := buf.Read(typeByte); err != nil || n != 1 {
-		return nil, fmt.Errorf("error parsing key: %w", err)
-	}
-
-	switch typeByte[0] {
-	case uint8(0x00): // IntKey
-		key, err := IntKeyFromBytes(buf)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing key: %w", err)
-		}
-		return key, nil
-	case uint8(0x01): // StringKey
-		key, err := StringKeyFromBytes(buf)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing key: %w", err)
-		}
-		return key, nil
-	default:
-		return nil, fmt.Errorf("unknown type: %d", typeByte[0])
-	}
-}
-
 func (i *IntKey) Hash(numHashes uint32) ([]uint32, error) {
-	h1 := fnv.New32a()
-	buf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(buf, i.value)
-	if _, err := h1.Write(buf); err != nil {
-		return nil, err
-	}
-	hash1 := h1.Sum32()
-
-	h2 := fnv.New32()
-	if _, err := h2.Write(buf); err != nil {
-		return nil, err
-	}
-	hash2 := h2.Sum32()
-
-	hashes := make([]uint32, numHashes)
-	for j := uint32(0); j < numHashes; j++ {
-		hashes[j] = hash1 + j*hash2
-	}
+	h1, h2 := i.DoubleHash()
+	return hashes(h1, h2, numHashes), nil
+}
 
-	return hashes, nil
+func (i *IntKey) DoubleHash() (uint32, uint32) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], i.value)
+	return fnv32a(buf[:]), fnv32(buf[:])
 }
@@ -0,0 +1,222 @@
+package keys
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"main/interfaces"
+	"slices"
+	"strings"
+	"sync"
+)
+
+/*
+ * The first byte of every encoded key names its type, ParseKey looks
+ * the type up in the registry to decode the rest. IntKey (0x00),
+ * StringKey (0x01) and BytesKey (0x02) are registered from the start,
+ * applications add their own types with Register before opening a tree
+ * that holds them.
+ *
+ * Keys of different types sort by the rank of their types, types of
+ * equal rank by their type byte, so a tree can hold several types in a
+ * defined total order. Compare is the entry point for that; Compare
+ * methods handed a key of another type should return CompareTypes
+ * rather than panic.
+ *
+ * The order of the types is stored with the data: trees record
+ * TypeOrder and check it with CheckTypeOrder when they are opened, so
+ * changing the rank of a type that is already in use fails loudly
+ * instead of leaving keys out of order.
+ */
+
+const (
+	IntKeyType    uint8 = 0x00
+	StringKeyType uint8 = 0x01
+	BytesKeyType  uint8 = 0x02
+)
+
+var (
+	// ErrTypeRegistered is returned when registering a type byte twice.
+	ErrTypeRegistered = errors.New("key type is already registered")
+	// ErrUnknownType is returned when parsing a key of a type that
+	// isn't registered.
+	ErrUnknownType = errors.New("unknown key type")
+	// ErrTypeOrder is returned by CheckTypeOrder when the registered
+	// types sort differently than they used to.
+	ErrTypeOrder = errors.New("key types are ordered differently")
+)
+
+// Decoder reads a key of one type, the type byte has already been
+// read.
+type Decoder func(buf io.Reader) (interfaces.Comparable, error)
+
+// Typed is implemented by keys that know their type byte without
+// encoding themselves.
+type Typed interface {
+	KeyType() uint8
+}
+
+// Sortable is implemented by keys that sort among the keys of their
+// type like some bytes under bytes.Compare. Trees keep those bytes next
+// to the key and compare them instead of calling Compare.
+type Sortable interface {
+	Typed
+	// SortBytes returns the bytes without copying them, they must not
+	// be changed. Keys that have none return nil.
+	SortBytes() []byte
+}
+
+type keyType struct {
+	decode Decoder
+	rank   int
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[uint8]keyType{
+		IntKeyType:    {decode: IntKeyFromBytes, rank: 0},
+		StringKeyType: {decode: StringKeyFromBytes, rank: 1},
+		BytesKeyType:  {decode: BytesKeyFromBytes, rank: 2},
+	}
+)
+
+// Register adds a key type. Keys encode typeByte as their first byte,
+// decode parses what follows it and rank orders the type among the
+// others, lower ranks sort first.
+func Register(typeByte uint8, decode Decoder, rank int) error {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[typeByte]; ok {
+		return fmt.Errorf("error registering key type %d: %w", typeByte, ErrTypeRegistered)
+	}
+	registry[typeByte] = keyType{decode: decode, rank: rank}
+	return nil
+}
+
+func ParseKey(buf io.Reader) (interfaces.Comparable, error) {
+	typeByte := make([]byte, 1)
+	if n, err := buf.Read(typeByte); err != nil || n != 1 {
+		return nil, fmt.Errorf("error parsing key: %w", err)
+	}
+
+	registryMu.RLock()
+	kt, ok := registry[typeByte[0]]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("error parsing key: %w: %d", ErrUnknownType, typeByte[0])
+	}
+	key, err := kt.decode(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing key: %w", err)
+	}
+	return key, nil
+}
+
+// Compare orders any two keys, keys of the same type by their own
+// Compare method.
+func Compare(a, b interfaces.Comparable) int8 {
+	// the common case of one concrete type, without calling through the
+	// interface.
+	switch a := a.(type) {
+	case *BytesKey:
+		if b, ok := b.(*BytesKey); ok {
+			return int8(bytes.Compare(a.value, b.value))
+		}
+	case *IntKey:
+		if b, ok := b.(*IntKey); ok {
+			return int8(cmp.Compare(a.value, b.value))
+		}
+	case *StringKey:
+		if b, ok := b.(*StringKey); ok {
+			return int8(strings.Compare(a.value, b.value))
+		}
+	}
+	if typeOf(a) != typeOf(b) {
+		return CompareTypes(a, b)
+	}
+	return a.Compare(b)
+}
+
+// CompareTypes orders keys of different types. Keys of one type byte
+// but different implementations fall back to their encodings.
+func CompareTypes(a, b interfaces.Comparable) int8 {
+	ta, tb := typeOf(a), typeOf(b)
+	if ta == tb {
+		aBytes, _ := a.ToBytes()
+		bBytes, _ := b.ToBytes()
+		return int8(bytes.Compare(aBytes, bBytes))
+	}
+
+	registryMu.RLock()
+	ka, aok := registry[ta]
+	kb, bok := registry[tb]
+	registryMu.RUnlock()
+	// unregistered types sort after the registered ones.
+	switch {
+	case aok != bok && aok:
+		return -1
+	case aok != bok:
+		return 1
+	case ka.rank < kb.rank:
+		return -1
+	case ka.rank > kb.rank:
+		return 1
+	case ta < tb:
+		return -1
+	}
+	return 1
+}
+
+// TypeOrder returns the registered type bytes in the order their keys
+// sort.
+func TypeOrder() []uint8 {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	order := make([]uint8, 0, len(registry))
+	for typeByte := range registry {
+		order = append(order, typeByte)
+	}
+	slices.SortFunc(order, func(a, b uint8) int {
+		return cmp.Or(cmp.Compare(registry[a].rank, registry[b].rank), cmp.Compare(a, b))
+	})
+	return order
+}
+
+// CheckTypeOrder fails with ErrTypeOrder unless the registered types
+// still sort in order, which an earlier TypeOrder returned. Types that
+// aren't registered anymore are skipped, types registered since can go
+// anywhere.
+func CheckTypeOrder(order []uint8) error {
+	current := TypeOrder()
+	position := make(map[uint8]int, len(current))
+	for i, typeByte := range current {
+		position[typeByte] = i
+	}
+	last := -1
+	for _, typeByte := range order {
+		i, ok := position[typeByte]
+		if !ok {
+			continue
+		}
+		if i < last {
+			return fmt.Errorf("error checking key types: %w: %d used to sort before %d", ErrTypeOrder, current[last], typeByte)
+		}
+		last = i
+	}
+	return nil
+}
+
+// typeOf returns the type byte of key. Keys that can't be encoded
+// can't be stored either, they sort as the last type.
+func typeOf(key interfaces.Comparable) uint8 {
+	if typed, ok := key.(Typed); ok {
+		return typed.KeyType()
+	}
+	keyBytes, err := key.ToBytes()
+	if err != nil || len(keyBytes) == 0 {
+		return 0xff
+	}
+	return keyBytes[0]
+}
@@ -0,0 +1,112 @@
+package keys
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"io"
+	"main/interfaces"
+	"slices"
+	"testing"
+)
+
+// rankedKey is a key type of its own, ranked with StringKey.
+const rankedKeyType uint8 = 0x20
+
+type rankedKey struct {
+	value byte
+}
+
+func (k *rankedKey) Compare(other interfaces.Comparable) int8 {
+	o, ok := other.(*rankedKey)
+	if !ok {
+		return CompareTypes(k, other)
+	}
+	return int8(cmp.Compare(k.value, o.value))
+}
+
+func (k *rankedKey) GetValue() any {
+	return k.value
+}
+
+func (k *rankedKey) ToBytes() ([]byte, error) {
+	return []byte{rankedKeyType, k.value}, nil
+}
+
+func (k *rankedKey) Hash(numHashes uint32) ([]uint32, error) {
+	return hashes(uint32(k.value), 1, numHashes), nil
+}
+
+func rankedKeyFromBytes(buf io.Reader) (interfaces.Comparable, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(buf, b[:]); err != nil {
+		return nil, err
+	}
+	return &rankedKey{value: b[0]}, nil
+}
+
+func init() {
+	if err := Register(rankedKeyType, rankedKeyFromBytes, 1); err != nil {
+		panic(err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	if err := Register(IntKeyType, IntKeyFromBytes, 0); !errors.Is(err, ErrTypeRegistered) {
+		t.Errorf("Expected ErrTypeRegistered, got %v", err)
+	}
+	if _, err := ParseKey(bytes.NewReader([]byte{0x42, 0})); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("Expected ErrUnknownType, got %v", err)
+	}
+
+	encoded, _ := (&rankedKey{value: 7}).ToBytes()
+	key, err := ParseKey(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("ParseKey failed: %v", err)
+	}
+	if got, ok := key.(*rankedKey); !ok || got.value != 7 {
+		t.Errorf("Expected the registered decoder to parse the key, got %#v", key)
+	}
+}
+
+func TestCompareTypes(t *testing.T) {
+	// ints, then strings and the ranked keys, which tie on rank and go
+	// by type byte, then byte keys.
+	want := []interfaces.Comparable{
+		NewIntKey(0), NewIntKey(1 << 31),
+		NewStringKey(""), NewStringKey("z"),
+		&rankedKey{value: 0}, &rankedKey{value: 9},
+		NewBytesKey(nil), NewBytesKey([]byte{0xff}),
+	}
+	for i := range want {
+		for j := range want {
+			got := Compare(want[i], want[j])
+			if (i < j && got >= 0) || (i > j && got <= 0) || (i == j && got != 0) {
+				t.Errorf("Expected %v and %v to compare like %d and %d, got %d", want[i].GetValue(), want[j].GetValue(), i, j, got)
+			}
+			if own := want[i].Compare(want[j]); (own < 0) != (got < 0) || (own > 0) != (got > 0) {
+				t.Errorf("Expected Compare methods to agree with Compare for %v and %v, got %d and %d", want[i].GetValue(), want[j].GetValue(), own, got)
+			}
+		}
+	}
+}
+
+func TestTypeOrder(t *testing.T) {
+	order := TypeOrder()
+	if want := []uint8{IntKeyType, StringKeyType, rankedKeyType, BytesKeyType}; !slices.Equal(order, want) {
+		t.Fatalf("Expected types in order %v, got %v", want, order)
+	}
+	if err := CheckTypeOrder(order); err != nil {
+		t.Errorf("Expected the current order to pass, got %v", err)
+	}
+	// unknown types are skipped, a subset in order is fine.
+	if err := CheckTypeOrder([]uint8{IntKeyType, 0x42, BytesKeyType}); err != nil {
+		t.Errorf("Expected a subset of the order to pass, got %v", err)
+	}
+	if err := CheckTypeOrder(nil); err != nil {
+		t.Errorf("Expected no recorded order to pass, got %v", err)
+	}
+	if err := CheckTypeOrder([]uint8{BytesKeyType, IntKeyType}); !errors.Is(err, ErrTypeOrder) {
+		t.Errorf("Expected ErrTypeOrder, got %v", err)
+	}
+}
@@ -1,12 +1,11 @@
 package keys
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
-	"hash/fnv"
 	"io"
 	"main/interfaces"
+	"unsafe"
 )
 
 type StringKey struct {
@@ -20,7 +19,7 @@ func NewStringKey(s string) *StringKey {
 func (s *StringKey) Compare(other interfaces.Comparable) int8 {
 	otherKey, ok := other.(*StringKey)
 	if !ok {
-		panic("Cannot compare StringKey with a different type")
+		return CompareTypes(s, other)
 	}
 	if s.value < otherKey.value {
 		return -1
@@ -30,23 +29,27 @@ func (s *StringKey) Compare(other interfaces.Comparable) int8 {
 	return 0
 }
 
+func (s *StringKey) KeyType() uint8 {
+	return StringKeyType
+}
+
+// SortBytes returns the string itself, strings compare like their
+// bytes.
+func (s *StringKey) SortBytes() []byte {
+	return unsafe.Slice(unsafe.StringData(s.value), len(s.value))
+}
+
 func (s *StringKey) GetValue() any {
 	return s.value
 }
 
 func (s *StringKey) ToBytes() ([]byte, error) {
 	// 0x01 for string key type, then 4 bytes for length, then string bytes
-	buf := new(bytes.Buffer)
-	if err := binary.Write(buf, binary.BigEndian, uint8(0x01)); err != nil {
-		return nil, err
-	}
-	if err := binary.Write(buf, binary.BigEndian, uint32(len(s.value))); err != nil {
-		return nil, err
-	}
-	if _, err := buf.Write([]byte(s.value)); err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	buf := make([]byte, 5+len(s.value))
+	buf[0] = StringKeyType
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(s.value)))
+	copy(buf[5:], s.value)
+	return buf, nil
 }
 
 func StringKeyFromBytes(buf io.Reader) (interfaces.Comparable, error) {
@@ -65,21 +68,10 @@ func StringKeyFromBytes(buf io.Reader) (interfaces.Comparable, error) {
 }
 
 func (s *StringKey) Hash(numHashes uint32) ([]uint32, error) {
-	h1 := fnv.New32a()
-	if _, err := h1.Write([]byte(s.value)); err != nil {
-		return nil, err
-	}
-	hash1 := h1.Sum32()
-
-	h2 := fnv.New32()
-	if _, err := h2.Write([]byte(s.value)); err != nil {
-		return nil, err
-	}
-	hash2 := h2.Sum32()
+	h1, h2 := s.DoubleHash()
+	return hashes(h1, h2, numHashes), nil
+}
 
-	hashes := make([]uint32, numHashes)
-	for j := uint32(0); j < numHashes; j++ {
-		hashes[j] = hash1 + j*hash2
-	}
-	return hashes, nil
+func (s *StringKey) DoubleHash() (uint32, uint32) {
+	return fnv32a(s.value), fnv32(s.value)
 }
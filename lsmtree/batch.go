@@ -0,0 +1,203 @@
+package lsmtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"main/interfaces"
+	"main/keys"
+	"main/memtable"
+	"main/util"
+)
+
+/*
+ * WriteBatch collects puts, deletes, range deletions and merges that
+ * LSM.Write applies as a unit. A batch goes to the WAL as a single
+ * payload, so after a crash either all of it is replayed or none of it:
+ *   [1 byte]  - walBatchTag
+ *   [8 bytes] - Sequence number of the first operation (uint64), the
+ *               others follow it in order
+ *   [4 bytes] - Number of operations (uint32)
+ *   [N bytes] - One record per operation (see record.go)
+ *
+ * Range deletions carry the end key as the value.
+ */
+
+// walBatchTag marks batch payloads.
+const walBatchTag byte = 0xbb
+
+type batchOp struct {
+	key   interfaces.Comparable
+	kind  memtable.EntryKind
+	value []byte
+	// last key of a range deletion, written as the value.
+	end interfaces.Comparable
+}
+
+type WriteBatch struct {
+	ops []batchOp
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put queues key=val, val is copied so the caller may reuse it.
+func (b *WriteBatch) Put(key interfaces.Comparable, val []byte) {
+	b.ops = append(b.ops, batchOp{key: key, kind: memtable.KindValue, value: bytes.Clone(val)})
+}
+
+func (b *WriteBatch) Delete(key interfaces.Comparable) {
+	b.ops = append(b.ops, batchOp{key: key, kind: memtable.KindDeletion})
+}
+
+// Clear empties the batch so it can be reused.
+func (b *WriteBatch) Clear() {
+	b.ops = b.ops[:0]
+}
+
+func (b *WriteBatch) Count() int {
+	return len(b.ops)
+}
+
+func (b *WriteBatch) encode(seq uint64) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(walBatchTag)
+	if err := binary.Write(buf, binary.BigEndian, seq); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, uint32(len(b.ops))); err != nil {
+		return nil, err
+	}
+	for _, op := range b.ops {
+		value := op.value
+		if op.kind == memtable.KindRangeDeletion {
+			endBytes, err := op.end.ToBytes()
+			if err != nil {
+				return nil, fmt.Errorf("error serializing range end: %w", err)
+			}
+			value = endBytes
+		}
+		if err := writeRecord(buf, op.key, op.kind, value); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeWriteBatch(payload []byte) (*WriteBatch, uint64, error) {
+	rd := bytes.NewReader(payload)
+	tag, err := rd.ReadByte()
+	if err != nil || tag != walBatchTag {
+		return nil, 0, fmt.Errorf("error parsing batch: missing batch tag")
+	}
+	var seq uint64
+	if err := binary.Read(rd, binary.BigEndian, &seq); err != nil {
+		return nil, 0, fmt.Errorf("error parsing batch sequence number: %w", err)
+	}
+	count, err := util.ParseInt32(rd)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error parsing batch size: %w", err)
+	}
+
+	batch := &WriteBatch{ops: make([]batchOp, 0, count)}
+	for range count {
+		entry, err := readRecord(rd)
+		if err != nil {
+			return nil, 0, err
+		}
+		op := batchOp{key: entry.Key, kind: entry.Kind, value: entry.Value}
+		if op.kind == memtable.KindRangeDeletion {
+			if op.end, err = keys.ParseKey(bytes.NewReader(op.value)); err != nil {
+				return nil, 0, fmt.Errorf("error parsing range end: %w", err)
+			}
+			op.value = nil
+		}
+		batch.ops = append(batch.ops, op)
+	}
+	return batch, seq, nil
+}
+
+// Write applies every operation of batch atomically, readers and
+// flushes see either none or all of them. Each operation gets its own
+// sequence number, so later operations on the same key win over
+// earlier ones.
+func (l *LSM) Write(batch *WriteBatch) error {
+	if batch.Count() == 0 {
+		return nil
+	}
+	return l.writeChecked(batch, nil)
+}
+
+// writeChecked writes batch if check, called under the write lock,
+// passes. Nothing else gets written in between.
+func (l *LSM) writeChecked(batch *WriteBatch, check func() error) error {
+	l.mu.Lock()
+	err := l.write(batch, check)
+	manager := l.writeBuffer
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// other members may have to flush, their locks can't be taken while
+	// holding this one.
+	if manager != nil {
+		manager.maybeFlush()
+	}
+	return nil
+}
+
+// write logs and applies batch once check, if any, passes. The caller
+// must hold l.mu.
+func (l *LSM) write(batch *WriteBatch, check func() error) error {
+	if l.closed {
+		return ErrClosed
+	}
+	if l.mergeOperator == nil && batch.hasMerge() {
+		return ErrNoMergeOperator
+	}
+	if err := l.makeRoomForWrite(); err != nil {
+		return err
+	}
+	// a stalled write lets others in, what check looks at may have
+	// changed until here.
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	if batch.Count() == 0 {
+		return nil
+	}
+
+	payload, err := batch.encode(l.seq + 1)
+	if err != nil {
+		return err
+	}
+	if err := l.wal.Append(payload); err != nil {
+		return err
+	}
+
+	before := l.memtable.ApproximateMemoryUsage()
+	l.applyBatch(batch, l.seq+1)
+	if l.writeBuffer != nil {
+		l.writeBuffer.add(l.memtable.ApproximateMemoryUsage()-before, 0)
+	}
+	return nil
+}
+
+// applyBatch puts the operations of batch into the memtable, starting
+// at sequence number seq. The caller must hold l.mu.
+func (l *LSM) applyBatch(batch *WriteBatch, seq uint64) {
+	for i, op := range batch.ops {
+		key := newInternalKey(op.key, seq+uint64(i))
+		if op.kind == memtable.KindRangeDeletion {
+			l.memtable.AddRangeDeletion(key, op.end)
+			continue
+		}
+		l.memtable.Add(key, op.kind, op.value)
+	}
+	l.seq = max(l.seq, seq+uint64(len(batch.ops))-1)
+}
@@ -0,0 +1,131 @@
+package lsmtree
+
+import (
+	"main/keys"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 10, 2, 0.01, nil)
+	lsm.Put(keys.NewIntKey(100), []byte("old"))
+
+	batch := NewWriteBatch()
+	for i := range 25 {
+		batch.Put(keys.NewIntKey(uint32(i)), []byte("val_"+strconv.Itoa(i)))
+	}
+	batch.Delete(keys.NewIntKey(100))
+	batch.Put(keys.NewIntKey(5), []byte("overwritten"))
+	if batch.Count() != 27 {
+		t.Errorf("Expected 27 operations, got %d", batch.Count())
+	}
+	if err := lsm.Write(batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	for i := range 25 {
+		want := "val_" + strconv.Itoa(i)
+		if i == 5 {
+			want = "overwritten"
+		}
+		found, got, err := lsm.Get(keys.NewIntKey(uint32(i)))
+		if err != nil || !found || string(got) != want {
+			t.Errorf("Expected value '%s' for key '%d', got '%s'", want, i, string(got))
+		}
+	}
+	if found, got, _ := lsm.Get(keys.NewIntKey(100)); found && got != nil {
+		t.Errorf("Expected key 100 to be deleted by the batch")
+	}
+
+	batch.Clear()
+	if batch.Count() != 0 {
+		t.Errorf("Expected an empty batch after Clear, got %d", batch.Count())
+	}
+}
+
+func TestWriteBatchIsVisibleAtomically(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 50, 2, 0.01, nil)
+
+	// every batch writes the same generation to both keys, a reader
+	// iterating the tree must never see them differ.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		batch := NewWriteBatch()
+		for gen := range 200 {
+			batch.Clear()
+			batch.Put(keys.NewIntKey(1), []byte(strconv.Itoa(gen)))
+			batch.Put(keys.NewIntKey(2), []byte(strconv.Itoa(gen)))
+			for i := range 5 {
+				batch.Put(keys.NewIntKey(uint32(100+gen*5+i)), []byte("filler"))
+			}
+			if err := lsm.Write(batch); err != nil {
+				t.Errorf("Write failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	for range 200 {
+		entries, err := lsm.Scan(keys.NewIntKey(1), keys.NewIntKey(3))
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if len(entries) == 2 && string(entries[0].Value) != string(entries[1].Value) {
+			t.Fatalf("Saw a partial batch: %s != %s", entries[0].Value, entries[1].Value)
+		}
+	}
+	wg.Wait()
+}
+
+func TestTornBatchIsNotReplayed(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 100, 2, 0.01, nil)
+
+	first := NewWriteBatch()
+	first.Put(keys.NewIntKey(1), []byte("a"))
+	first.Put(keys.NewIntKey(2), []byte("b"))
+	if err := lsm.Write(first); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	info, err := os.Stat(lsm.wal.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := NewWriteBatch()
+	for i := range 10 {
+		second.Put(keys.NewIntKey(uint32(10+i)), []byte("torn"))
+	}
+	if err := lsm.Write(second); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	crash(lsm)
+
+	// cut the second batch in half, as if the process died mid-write.
+	full, err := os.Stat(lsm.wal.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cut := info.Size() + (full.Size()-info.Size())/2
+	if err := os.Truncate(lsm.wal.Path(), cut); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered := newTestLSM(t, 100, 2, 0.01, nil)
+	for i := uint32(1); i <= 2; i++ {
+		if found, _, _ := recovered.Get(keys.NewIntKey(i)); !found {
+			t.Errorf("Expected key %d of the complete batch to survive", i)
+		}
+	}
+	for i := range 10 {
+		if found, got, _ := recovered.Get(keys.NewIntKey(uint32(10 + i))); found && got != nil {
+			t.Errorf("Expected no key of the torn batch to survive, found %d", 10+i)
+		}
+	}
+}
@@ -0,0 +1,566 @@
+package lsmtree
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"main/interfaces"
+	"main/memtable"
+)
+
+/*
+ * Compaction merges a set of SSTables into new ones, keeping only the
+ * newest version of every key plus the older ones live snapshots can
+ * still see. Which tables get merged and where the
+ * output goes is up to the CompactionStrategy, the LSM just runs what
+ * the strategy picks in a background goroutine.
+ */
+
+type CompactionStrategy interface {
+	// Pick returns the next compaction to run or nil if there is nothing
+	// to do. tables is ordered by precedence, oldest first.
+	Pick(tables []*SSTable) *Compaction
+}
+
+type Compaction struct {
+	// Inputs must keep the precedence order they have in LSM.SStables.
+	Inputs      []*SSTable
+	OutputLevel int
+	// Bottommost is set when no table outside the inputs can hold an
+	// older version of their keys, tombstones are dropped then.
+	Bottommost bool
+	// MaxOutputBytes splits the output into several tables, 0 writes
+	// a single one.
+	MaxOutputBytes int
+}
+
+func (t *SSTable) Level() int {
+	return t.level
+}
+
+func (t *SSTable) Size() int {
+	return t.dataLength
+}
+
+func (t *SSTable) overlaps(minKey, maxKey interfaces.Comparable) bool {
+	if t.minKey == nil || minKey == nil {
+		return false
+	}
+	return t.minKey.Compare(maxKey) <= 0 && t.maxKey.Compare(minKey) >= 0
+}
+
+// entries reads back the whole table in key order.
+func (t *SSTable) entries() ([]*memtable.Entry, error) {
+	if t.version > 0 {
+		return t.blockEntries()
+	}
+
+	data, err := os.ReadFile(t.dataLocation)
+	if err != nil {
+		return nil, err
+	}
+
+	mem := memtable.NewMemTable(memtable.NewAVLTree())
+	if err := mem.Load(bytes.NewReader(data), nil, nil, 0); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", t.dataLocation, err)
+	}
+	entries := mem.Entries()
+	for _, entry := range entries {
+		entry.Key = newInternalKey(entry.Key, 0)
+	}
+	return entries, nil
+}
+
+func (l *LSM) scheduleCompaction() {
+	select {
+	case l.compactCh <- struct{}{}:
+	default:
+	}
+}
+
+func (l *LSM) compactionLoop() {
+	defer close(l.compactDone)
+	for {
+		select {
+		case <-l.compactCh:
+			// Close stops compactions that haven't started yet.
+			if err := l.Compact(); err != nil && !errors.Is(err, ErrClosed) {
+				l.logger.Printf("Error compacting SSTables: %v", err)
+			}
+		case <-l.compactStop:
+			return
+		}
+	}
+}
+
+// Compact runs compactions until the strategy has nothing left to pick.
+func (l *LSM) Compact() error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	for {
+		l.mu.RLock()
+		if l.closed {
+			l.mu.RUnlock()
+			return ErrClosed
+		}
+		c := l.compaction.Pick(slices.Clone(l.SStables))
+		l.mu.RUnlock()
+		if c == nil || len(c.Inputs) == 0 {
+			return nil
+		}
+
+		if err := l.runCompaction(c); err != nil {
+			return err
+		}
+	}
+}
+
+// UpgradeTables rewrites every table written in an older format version
+// in the current one, one table at a time and at the same level.
+// Compaction upgrades the tables it merges anyway, this gets rid of the
+// ones it never picks.
+func (l *LSM) UpgradeTables() error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	for {
+		var old *SSTable
+		l.mu.RLock()
+		if l.closed {
+			l.mu.RUnlock()
+			return ErrClosed
+		}
+		for _, table := range l.SStables {
+			if table.version < tableFormatVersion {
+				old = table
+				break
+			}
+		}
+		l.mu.RUnlock()
+		if old == nil {
+			return nil
+		}
+
+		c := &Compaction{Inputs: []*SSTable{old}, OutputLevel: old.level}
+		if err := l.runCompaction(c); err != nil {
+			return err
+		}
+	}
+}
+
+func (l *LSM) runCompaction(c *Compaction) error {
+	sources := make([][]*memtable.Entry, len(c.Inputs))
+	var tombstones []rangeTombstone
+	for i, table := range c.Inputs {
+		entries, err := table.entries()
+		if err != nil {
+			return err
+		}
+		sources[i] = entries
+		tombstones = append(tombstones, table.rangeDels.tombstones()...)
+	}
+
+	l.mu.RLock()
+	smallestSnapshot := l.smallestSnapshot()
+	op := l.mergeOperator
+	l.mu.RUnlock()
+
+	dels := fragmentTombstones(tombstones)
+	merged := mergeEntries(sources, dels, c.Bottommost, smallestSnapshot, op)
+	dels = dels.compact(smallestSnapshot, c.Bottommost)
+
+	chunks := splitEntries(merged, c.MaxOutputBytes)
+	if len(chunks) == 0 && len(dels) > 0 {
+		chunks = [][]*memtable.Entry{nil}
+	}
+	var outputs []*SSTable
+	for i, chunk := range chunks {
+		// each output gets the range tombstones up to the next one, the
+		// first and the last reach out to the ends.
+		var lo, hi interfaces.Comparable
+		if i > 0 {
+			lo = userKey(chunk[0].Key)
+		}
+		if i+1 < len(chunks) {
+			hi = userKey(chunks[i+1][0].Key)
+		}
+		table, err := l.writeTable(chunk, dels.clip(lo, hi), c.OutputLevel)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, table)
+	}
+
+	if err := l.installCompaction(c, outputs); err != nil {
+		return err
+	}
+	// the inputs are removed once readers still holding them let go.
+	unrefTables(c.Inputs)
+
+	l.logger.Printf("Compacted %d SSTables into %d at level %d", len(c.Inputs), len(outputs), c.OutputLevel)
+	return nil
+}
+
+// installCompaction swaps the inputs for the outputs, which take the
+// position of the newest input.
+func (l *LSM) installCompaction(c *Compaction, outputs []*SSTable) error {
+	edit := &versionEdit{}
+	for _, table := range c.Inputs {
+		edit.removed = append(edit.removed, filepath.Base(table.dataLocation))
+	}
+	for _, table := range outputs {
+		edit.added = append(edit.added, metaOf(table))
+	}
+
+	return l.logAndApply(edit, func() {
+		removed := func(table *SSTable) bool { return slices.Contains(c.Inputs, table) }
+		l.SStables = installTables(l.SStables, removed, outputs, (*SSTable).Level)
+	})
+}
+
+type mergeCursor struct {
+	entries []*memtable.Entry
+	pos     int
+	// higher rank means newer source
+	rank int
+}
+
+type mergeHeap []*mergeCursor
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	cmp := h[i].entries[h[i].pos].Key.Compare(h[j].entries[h[j].pos].Key)
+	if cmp != 0 {
+		return cmp < 0
+	}
+	return h[i].rank > h[j].rank
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(*mergeCursor)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// mergeEntries does a k-way merge of sorted sources, ordered oldest
+// first. A version is dropped once a newer one is visible to every
+// snapshot, which is every version at or below smallestSnapshot but
+// the newest, or once a range tombstone in dels every snapshot sees
+// deletes it. Tombstones go too when dropTombstones is set and no
+// snapshot can see what they delete. If that newest version is a merge
+// operand it is merged with the versions under it by op. Expired values
+// are written as tombstones.
+func mergeEntries(sources [][]*memtable.Entry, dels rangeFragments, dropTombstones bool, smallestSnapshot uint64, op MergeOperator) []*memtable.Entry {
+	h := &mergeHeap{}
+	for i, entries := range sources {
+		if len(entries) > 0 {
+			*h = append(*h, &mergeCursor{entries: entries, rank: i})
+		}
+	}
+	heap.Init(h)
+
+	at := now()
+	var result, versions []*memtable.Entry
+	var last interfaces.Comparable
+	for h.Len() > 0 {
+		cursor := (*h)[0]
+		entry := cursor.entries[cursor.pos]
+
+		cursor.pos++
+		if cursor.pos == len(cursor.entries) {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+
+		// tables written before sequence numbers existed all use 0, the
+		// first time such a key shows up it comes from the newest source.
+		if last != nil && last.Compare(entry.Key) == 0 {
+			continue
+		}
+		if last != nil && userKey(last).Compare(userKey(entry.Key)) != 0 {
+			result = appendVersions(result, versions, dels, dropTombstones, smallestSnapshot, op, at)
+			versions = versions[:0]
+		}
+		last = entry.Key
+		versions = append(versions, entry)
+	}
+	return appendVersions(result, versions, dels, dropTombstones, smallestSnapshot, op, at)
+}
+
+// appendVersions appends the versions of a user key, newest first, that
+// a reader can still ask for.
+func appendVersions(result, versions []*memtable.Entry, dels rangeFragments, dropTombstones bool, smallestSnapshot uint64, op MergeOperator, at time.Time) []*memtable.Entry {
+	if len(versions) == 0 {
+		return result
+	}
+	cover := dels.coverAt(userKey(versions[0].Key), smallestSnapshot)
+	for i, entry := range versions {
+		if entry.Key.(*internalKey).seq > smallestSnapshot {
+			result = append(result, entry)
+			continue
+		}
+		// the newest version every snapshot sees, the ones after it are
+		// shadowed. Under a range tombstone they are all deleted, the
+		// tombstone is kept as long as it is needed.
+		if entry.Key.(*internalKey).seq < cover {
+			return result
+		}
+		entry = expireEntry(entry, at)
+		if entry.Kind == memtable.KindMerge {
+			chain := versions[i:]
+			if j := slices.IndexFunc(chain, func(e *memtable.Entry) bool { return e.Key.(*internalKey).seq < cover }); j >= 0 {
+				chain = append(chain[:j:j], &memtable.Entry{Key: chain[j].Key, Kind: memtable.KindDeletion})
+			}
+			return append(result, mergeOperands(chain, dropTombstones, op, at)...)
+		}
+		if dropTombstones && entry.Kind == memtable.KindDeletion {
+			return result
+		}
+		return append(result, entry)
+	}
+	return result
+}
+
+// splitEntries cuts entries into chunks of about maxBytes, all versions
+// of a key stay in the same chunk.
+func splitEntries(entries []*memtable.Entry, maxBytes int) [][]*memtable.Entry {
+	if len(entries) == 0 {
+		return nil
+	}
+	if maxBytes <= 0 {
+		return [][]*memtable.Entry{entries}
+	}
+
+	var chunks [][]*memtable.Entry
+	start, size := 0, 0
+	for i, entry := range entries {
+		keyBytes, _ := entry.Key.ToBytes()
+		size += len(keyBytes) + 4 + len(entry.Value)
+		if size >= maxBytes && (i+1 == len(entries) || userKey(entries[i+1].Key).Compare(userKey(entry.Key)) != 0) {
+			chunks = append(chunks, entries[start:i+1])
+			start, size = i+1, 0
+		}
+	}
+	if start < len(entries) {
+		chunks = append(chunks, entries[start:])
+	}
+	return chunks
+}
+
+/*
+ * Size-tiered: flushed tables pile up until there are enough of a
+ * similar size, then they get merged into one bigger table. Only
+ * neighbouring tables are merged so the output can take their place
+ * in the precedence order.
+ */
+type SizeTieredStrategy struct {
+	// MinThreshold is how many similar tables trigger a merge.
+	MinThreshold int
+	// MaxThreshold caps how many tables a single merge takes.
+	MaxThreshold int
+	// a table joins a bucket if its size is within
+	// [BucketLow, BucketHigh] times the bucket average.
+	BucketLow  float64
+	BucketHigh float64
+}
+
+func NewSizeTieredStrategy() *SizeTieredStrategy {
+	return &SizeTieredStrategy{
+		MinThreshold: 4,
+		MaxThreshold: 32,
+		BucketLow:    0.5,
+		BucketHigh:   1.5,
+	}
+}
+
+func (s *SizeTieredStrategy) Pick(tables []*SSTable) *Compaction {
+	bestStart, bestEnd := -1, -1
+	var bestAvg float64
+
+	for start := 0; start < len(tables); {
+		end := start + 1
+		total := float64(tables[start].dataLength)
+		for end < len(tables) && end-start < s.MaxThreshold {
+			avg := total / float64(end-start)
+			size := float64(tables[end].dataLength)
+			if size < avg*s.BucketLow || size > avg*s.BucketHigh {
+				break
+			}
+			total += size
+			end++
+		}
+
+		// prefer the smallest tables, they are the cheapest to merge
+		// and the most of them pile up.
+		avg := total / float64(end-start)
+		if end-start >= s.MinThreshold && (bestStart < 0 || avg < bestAvg) {
+			bestStart, bestEnd, bestAvg = start, end, avg
+		}
+		start = end
+	}
+
+	if bestStart < 0 {
+		return nil
+	}
+
+	inputs := tables[bestStart:bestEnd]
+	outputLevel := inputs[len(inputs)-1].level
+	return &Compaction{
+		Inputs:      inputs,
+		OutputLevel: outputLevel,
+		Bottommost:  bestStart == 0,
+	}
+}
+
+/*
+ * Leveled: flushed tables land in L0 where they may overlap. Once L0
+ * has enough of them they are merged into L1. Every level from L1 on
+ * is a single sorted run of non overlapping tables, 10x bigger than
+ * the one above it, when a level outgrows its target one of its tables
+ * is merged into the next level.
+ */
+type LeveledStrategy struct {
+	L0CompactionTrigger int
+	// BaseLevelBytes is the target size of L1.
+	BaseLevelBytes  int
+	LevelMultiplier int
+	MaxLevels       int
+	// TargetFileBytes is the size output tables are split at.
+	TargetFileBytes int
+
+	// the max key of the last table compacted out of each level, so the
+	// next compaction continues after it.
+	compactPointer map[int]interfaces.Comparable
+}
+
+func NewLeveledStrategy() *LeveledStrategy {
+	return &LeveledStrategy{
+		L0CompactionTrigger: 4,
+		BaseLevelBytes:      10 << 20,
+		LevelMultiplier:     10,
+		MaxLevels:           7,
+		TargetFileBytes:     2 << 20,
+	}
+}
+
+func (s *LeveledStrategy) levelTarget(level int) int {
+	target := s.BaseLevelBytes
+	for i := 1; i < level; i++ {
+		target *= s.LevelMultiplier
+	}
+	return target
+}
+
+func (s *LeveledStrategy) Pick(tables []*SSTable) *Compaction {
+	levels := make([][]*SSTable, s.MaxLevels)
+	for _, table := range tables {
+		level := min(table.level, s.MaxLevels-1)
+		levels[level] = append(levels[level], table)
+	}
+
+	if len(levels[0]) >= s.L0CompactionTrigger {
+		return s.compactInto(tables, levels, levels[0], 1)
+	}
+
+	bestLevel, bestScore := -1, 1.0
+	for level := 1; level < s.MaxLevels-1; level++ {
+		size := 0
+		for _, table := range levels[level] {
+			size += table.dataLength
+		}
+		score := float64(size) / float64(s.levelTarget(level))
+		if score > bestScore {
+			bestLevel, bestScore = level, score
+		}
+	}
+	if bestLevel < 0 {
+		return nil
+	}
+
+	return s.compactInto(tables, levels, []*SSTable{s.nextTable(bestLevel, levels[bestLevel])}, bestLevel+1)
+}
+
+// nextTable picks the table after the compact pointer of the level,
+// wrapping around to the start of the key space.
+func (s *LeveledStrategy) nextTable(level int, tables []*SSTable) *SSTable {
+	sorted := slices.Clone(tables)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].minKey.Compare(sorted[j].minKey) < 0
+	})
+
+	pick := sorted[0]
+	if pointer := s.compactPointer[level]; pointer != nil {
+		for _, table := range sorted {
+			if table.minKey.Compare(pointer) > 0 {
+				pick = table
+				break
+			}
+		}
+	}
+
+	if s.compactPointer == nil {
+		s.compactPointer = make(map[int]interfaces.Comparable)
+	}
+	s.compactPointer[level] = pick.maxKey
+	return pick
+}
+
+func (s *LeveledStrategy) compactInto(tables []*SSTable, levels [][]*SSTable, picked []*SSTable, outputLevel int) *Compaction {
+	var minKey, maxKey interfaces.Comparable
+	for _, table := range picked {
+		if table.minKey == nil {
+			continue
+		}
+		if minKey == nil || table.minKey.Compare(minKey) < 0 {
+			minKey = table.minKey
+		}
+		if maxKey == nil || table.maxKey.Compare(maxKey) > 0 {
+			maxKey = table.maxKey
+		}
+	}
+
+	chosen := slices.Clone(picked)
+	for _, table := range levels[outputLevel] {
+		if table.overlaps(minKey, maxKey) {
+			chosen = append(chosen, table)
+		}
+	}
+
+	bottommost := true
+	for level := outputLevel + 1; level < len(levels); level++ {
+		if len(levels[level]) > 0 {
+			bottommost = false
+		}
+	}
+
+	// keep the precedence order of the tables slice.
+	var inputs []*SSTable
+	for _, table := range tables {
+		if slices.Contains(chosen, table) {
+			inputs = append(inputs, table)
+		}
+	}
+
+	return &Compaction{
+		Inputs:         inputs,
+		OutputLevel:    outputLevel,
+		Bottommost:     bottommost,
+		MaxOutputBytes: s.TargetFileBytes,
+	}
+}
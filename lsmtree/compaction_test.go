@@ -0,0 +1,211 @@
+package lsmtree
+
+import (
+	"main/keys"
+	"main/memtable"
+	"strconv"
+	"testing"
+)
+
+func ikey(k uint32, seq uint64) *internalKey {
+	return newInternalKey(keys.NewIntKey(k), seq)
+}
+
+func TestMergeEntriesNewestWins(t *testing.T) {
+	older := []*memtable.Entry{
+		{Key: ikey(1, 1), Value: []byte("old-1")},
+		{Key: ikey(2, 2), Value: []byte("old-2")},
+		{Key: ikey(4, 3), Value: []byte("old-4")},
+	}
+	newer := []*memtable.Entry{
+		{Key: ikey(2, 4), Kind: memtable.KindDeletion},
+		{Key: ikey(3, 5), Value: []byte("new-3")},
+		{Key: ikey(4, 6), Value: []byte("new-4")},
+	}
+
+	merged := mergeEntries([][]*memtable.Entry{older, newer}, nil, false, 10, nil)
+	want := []string{"old-1", "", "new-3", "new-4"}
+	if len(merged) != len(want) {
+		t.Fatalf("Expected %d entries, got %d", len(want), len(merged))
+	}
+	for i, entry := range merged {
+		if string(entry.Value) != want[i] {
+			t.Errorf("Entry %d: expected '%s', got '%s'", i, want[i], string(entry.Value))
+		}
+	}
+
+	merged = mergeEntries([][]*memtable.Entry{older, newer}, nil, true, 10, nil)
+	if len(merged) != 3 {
+		t.Fatalf("Expected tombstone to be dropped, got %d entries", len(merged))
+	}
+	for _, entry := range merged {
+		if userKey(entry.Key).Compare(keys.NewIntKey(2)) == 0 {
+			t.Errorf("Deleted key 2 should not survive a bottommost merge")
+		}
+	}
+}
+
+func TestMergeEntriesKeepsSnapshotVersions(t *testing.T) {
+	older := []*memtable.Entry{
+		{Key: ikey(2, 2), Value: []byte("old-2")},
+		{Key: ikey(4, 3), Value: []byte("old-4")},
+	}
+	newer := []*memtable.Entry{
+		{Key: ikey(2, 4), Kind: memtable.KindDeletion},
+		{Key: ikey(4, 6), Value: []byte("new-4")},
+	}
+
+	// a snapshot at 3 still sees old-2 and old-4, so the tombstone
+	// hiding old-2 has to stay as well.
+	merged := mergeEntries([][]*memtable.Entry{older, newer}, nil, true, 3, nil)
+	want := []string{"", "old-2", "new-4", "old-4"}
+	if len(merged) != len(want) {
+		t.Fatalf("Expected %d entries, got %d", len(want), len(merged))
+	}
+	for i, entry := range merged {
+		if string(entry.Value) != want[i] {
+			t.Errorf("Entry %d: expected '%s', got '%s'", i, want[i], string(entry.Value))
+		}
+	}
+
+	// at 5 nobody sees key 2 anymore, but old-4 is still visible.
+	merged = mergeEntries([][]*memtable.Entry{older, newer}, nil, true, 5, nil)
+	want = []string{"new-4", "old-4"}
+	if len(merged) != len(want) {
+		t.Fatalf("Expected %d entries, got %d", len(want), len(merged))
+	}
+	for i, entry := range merged {
+		if string(entry.Value) != want[i] {
+			t.Errorf("Entry %d: expected '%s', got '%s'", i, want[i], string(entry.Value))
+		}
+	}
+}
+
+// fillWithOverwrites writes n keys three times over and deletes every
+// fifth one, returning what each key should read as.
+func fillWithOverwrites(t *testing.T, lsm *LSM, n int) map[int]string {
+	want := make(map[int]string)
+	for round := range 3 {
+		for i := range n {
+			val := "val_" + strconv.Itoa(round) + "_" + strconv.Itoa(i)
+			if err := lsm.Put(keys.NewIntKey(uint32(i)), []byte(val)); err != nil {
+				t.Fatalf("Put failed at %d: %v", i, err)
+			}
+			want[i] = val
+		}
+	}
+	for i := 0; i < n; i += 5 {
+		lsm.Delete(keys.NewIntKey(uint32(i)))
+		delete(want, i)
+	}
+	return want
+}
+
+func checkContent(t *testing.T, lsm *LSM, n int, want map[int]string) {
+	for i := range n {
+		found, got, err := lsm.Get(keys.NewIntKey(uint32(i)))
+		if err != nil {
+			t.Fatalf("Get failed for key %d: %v", i, err)
+		}
+		val, ok := want[i]
+		if !ok {
+			if found && got != nil {
+				t.Errorf("Expected nil for deleted key '%d', got '%s'", i, string(got))
+			}
+			continue
+		}
+		if !found || string(got) != val {
+			t.Errorf("Expected value '%s' for key '%d', got '%s'", val, i, string(got))
+		}
+	}
+}
+
+func TestSizeTieredCompaction(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 10, 2, 0.01, NewSizeTieredStrategy())
+	n := 100
+	want := fillWithOverwrites(t, lsm, n)
+
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	// 32 flushes of similar size must not stay as 32 tables, at most
+	// MinThreshold-1 tables can be left in each tier.
+	if len(lsm.SStables) > 9 {
+		t.Errorf("Expected compaction to merge tables, got %d", len(lsm.SStables))
+	}
+	checkContent(t, lsm, n, want)
+
+	// a restart has to read the compacted tables in the same order.
+	crash(lsm)
+	checkContent(t, newTestLSM(t, 10, 2, 0.01, NewSizeTieredStrategy()), n, want)
+}
+
+func TestLeveledCompaction(t *testing.T) {
+	useTempDataDir(t)
+	strategy := NewLeveledStrategy()
+	strategy.L0CompactionTrigger = 2
+	strategy.BaseLevelBytes = 1000
+	strategy.TargetFileBytes = 400
+
+	lsm := newTestLSM(t, 10, 2, 0.01, strategy)
+	n := 200
+	want := fillWithOverwrites(t, lsm, n)
+
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	levels := make(map[int][]*SSTable)
+	for _, table := range lsm.SStables {
+		levels[table.level] = append(levels[table.level], table)
+	}
+	if len(levels[0]) >= strategy.L0CompactionTrigger {
+		t.Errorf("Expected L0 to be compacted, it holds %d tables", len(levels[0]))
+	}
+	if len(levels[2]) == 0 {
+		t.Errorf("Expected L1 to outgrow its target and spill into L2")
+	}
+
+	for level, tables := range levels {
+		if level == 0 {
+			continue
+		}
+		for i, a := range tables {
+			for _, b := range tables[i+1:] {
+				if a.overlaps(b.minKey, b.maxKey) {
+					t.Errorf("Tables of L%d overlap: [%v, %v] and [%v, %v]",
+						level, a.minKey.GetValue(), a.maxKey.GetValue(), b.minKey.GetValue(), b.maxKey.GetValue())
+				}
+			}
+		}
+	}
+	checkContent(t, lsm, n, want)
+
+	// nothing is below the deepest level, so its tombstones are gone.
+	deepest := 0
+	for level := range levels {
+		deepest = max(deepest, level)
+	}
+	for _, table := range levels[deepest] {
+		entries, err := table.entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if entry.Kind == memtable.KindDeletion {
+				t.Errorf("Tombstone for key %v survived in the bottom level", entry.Key.GetValue())
+			}
+		}
+	}
+
+	crash(lsm)
+	checkContent(t, newTestLSM(t, 10, 2, 0.01, strategy), n, want)
+}
@@ -0,0 +1,185 @@
+package lsmtree
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"main/memtable"
+)
+
+// how many full memtables can wait for the flusher before writers stall.
+const maxImmutableMemtables = 2
+
+// immutableMemtable is a full memtable that is still served to readers
+// while the flusher writes it out.
+type immutableMemtable struct {
+	mem         *memtable.MemTable
+	walSegments []string
+}
+
+// makeRoomForWrite swaps a full memtable out for an empty one, the
+// caller must hold l.mu.
+func (l *LSM) makeRoomForWrite() error {
+	for {
+		// Close may have come in while the write was stalled.
+		if l.closed {
+			return ErrClosed
+		}
+		if l.flushErr != nil {
+			return l.flushErr
+		}
+		if !l.memtableFull() {
+			return nil
+		}
+		if len(l.immutables) >= maxImmutableMemtables {
+			// the flusher is behind, stall writes until it catches up.
+			l.flushed.Wait()
+			continue
+		}
+		return l.switchMemtable()
+	}
+}
+
+// memtableFull tells whether the memtable reached either the entry
+// count threshold or the write buffer size, the caller must hold l.mu.
+func (l *LSM) memtableFull() bool {
+	if l.threshold > 0 && l.memtable.Size() >= l.threshold {
+		return true
+	}
+	return l.writeBufferSize > 0 && l.memtable.ApproximateMemoryUsage() >= l.writeBufferSize
+}
+
+// switchMemtable queues the memtable for the flusher and starts an
+// empty one, the caller must hold l.mu.
+func (l *LSM) switchMemtable() error {
+	segments, err := l.rotateWAL()
+	if err != nil {
+		return err
+	}
+	l.immutables = append(l.immutables, &immutableMemtable{mem: l.memtable, walSegments: segments})
+	if l.writeBuffer != nil {
+		l.writeBuffer.add(0, l.memtable.ApproximateMemoryUsage())
+	}
+	l.memtable = newMemTable()
+	l.scheduleFlush()
+	return nil
+}
+
+func (l *LSM) scheduleFlush() {
+	select {
+	case l.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+func (l *LSM) flushLoop() {
+	defer close(l.flushDone)
+	for {
+		select {
+		case <-l.flushCh:
+			l.flushImmutables()
+		case <-l.flushStop:
+			return
+		}
+	}
+}
+
+// flushImmutables writes the immutable memtables to SSTables, oldest
+// first so the tables keep their precedence order.
+func (l *LSM) flushImmutables() {
+	for {
+		l.mu.RLock()
+		if len(l.immutables) == 0 {
+			l.mu.RUnlock()
+			return
+		}
+		imm := l.immutables[0]
+		smallestSnapshot := l.smallestSnapshot()
+		op := l.mergeOperator
+		l.mu.RUnlock()
+
+		// versions no snapshot needs are dropped and merge operands
+		// merged, the way compaction does.
+		dels := fragmentTombstones(memTombstones(imm.mem))
+		entries := mergeEntries([][]*memtable.Entry{imm.mem.Entries()}, dels, false, smallestSnapshot, op)
+		table, err := l.writeTable(entries, dels.compact(smallestSnapshot, false), 0)
+		if err != nil {
+			l.mu.Lock()
+			l.flushErr = fmt.Errorf("error flushing memtable: %w", err)
+			l.flushed.Broadcast()
+			l.mu.Unlock()
+			return
+		}
+
+		err = l.logAndApply(&versionEdit{added: []*tableMeta{metaOf(table)}}, func() {
+			l.SStables = installTables(l.SStables, func(*SSTable) bool { return false }, []*SSTable{table}, (*SSTable).Level)
+			l.immutables = l.immutables[1:]
+			if l.writeBuffer != nil {
+				usage := imm.mem.ApproximateMemoryUsage()
+				l.writeBuffer.add(-usage, -usage)
+			}
+			l.flushed.Broadcast()
+		})
+		if err != nil {
+			l.mu.Lock()
+			l.flushErr = fmt.Errorf("error flushing memtable: %w", err)
+			l.flushed.Broadcast()
+			l.mu.Unlock()
+			return
+		}
+
+		if err := removeSegments(imm.walSegments); err != nil {
+			l.logger.Printf("Error removing wal segments: %v", err)
+		}
+		l.scheduleCompaction()
+	}
+}
+
+// waitForFlush blocks until every immutable memtable is on disk.
+func (l *LSM) waitForFlush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.immutables) > 0 && l.flushErr == nil {
+		l.flushed.Wait()
+	}
+	return l.flushErr
+}
+
+// stopBackgroundWork lets a running flush and compaction finish and
+// stops both goroutines.
+func (l *LSM) stopBackgroundWork() {
+	l.stopOnce.Do(func() {
+		close(l.flushStop)
+		close(l.compactStop)
+	})
+	<-l.flushDone
+	<-l.compactDone
+}
+
+// refTables returns the current tables with a reference taken on each,
+// the caller must hold l.mu and release them with unrefTables.
+func (l *LSM) refTables() []*SSTable {
+	tables := slices.Clone(l.SStables)
+	for _, table := range tables {
+		table.refs.Add(1)
+	}
+	return tables
+}
+
+func unrefTables(tables []*SSTable) {
+	for _, table := range tables {
+		table.unref()
+	}
+}
+
+func (t *SSTable) unref() {
+	if t.refs.Add(-1) > 0 {
+		return
+	}
+	t.detachCache()
+	t.files.evict(t.id)
+	if err := os.Remove(t.dataLocation); err != nil && !os.IsNotExist(err) {
+		t.logger.Printf("Error removing SSTable: %v", err)
+	}
+}
@@ -0,0 +1,649 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"main/interfaces"
+	"main/keys"
+	"main/memtable"
+)
+
+/*
+ * Iterators walk the keys of the whole tree in order. Every source
+ * (the memtables and each SSTable) gets its own iterator over internal
+ * keys and a merging iterator puts all versions in order. Table
+ * iterators decode a single data block at a time. Memtable
+ * iterators walk the live skip lists, writes that come in later carry
+ * larger sequence numbers and stay hidden. The Iterator
+ * handed out to callers picks the newest version of each key visible at
+ * its sequence number and hides tombstones. A merge operand is read
+ * together with the older versions under it, see merge.go. The range
+ * tombstones visible at creation are fragmented once, versions they
+ * cover read as deleted.
+ */
+
+type Iterator interface {
+	// Seek moves to the first key >= key.
+	Seek(key interfaces.Comparable)
+	SeekToFirst()
+	SeekToLast()
+	Next()
+	Prev()
+	Key() interfaces.Comparable
+	Value() []byte
+	Valid() bool
+	// Err is the error that made the iterator invalid, like a merge
+	// operand that doesn't merge.
+	Err() error
+	Close()
+}
+
+type internalIterator interface {
+	Seek(key interfaces.Comparable)
+	SeekToFirst()
+	SeekToLast()
+	Next()
+	Prev()
+	Key() interfaces.Comparable
+	Value() []byte
+	Kind() memtable.EntryKind
+	Valid() bool
+}
+
+// sliceIterator walks a sorted slice of entries without duplicate keys.
+type sliceIterator struct {
+	entries []*memtable.Entry
+	pos     int
+}
+
+func newSliceIterator(entries []*memtable.Entry) *sliceIterator {
+	return &sliceIterator{entries: entries, pos: -1}
+}
+
+func (s *sliceIterator) Seek(key interfaces.Comparable) {
+	s.pos = sort.Search(len(s.entries), func(i int) bool {
+		return s.entries[i].Key.Compare(key) >= 0
+	})
+}
+
+func (s *sliceIterator) SeekToFirst() { s.pos = 0 }
+
+func (s *sliceIterator) SeekToLast() { s.pos = len(s.entries) - 1 }
+
+func (s *sliceIterator) Next() { s.pos++ }
+
+func (s *sliceIterator) Prev() { s.pos-- }
+
+func (s *sliceIterator) Valid() bool { return s.pos >= 0 && s.pos < len(s.entries) }
+
+func (s *sliceIterator) Key() interfaces.Comparable { return s.entries[s.pos].Key }
+
+func (s *sliceIterator) Value() []byte { return s.entries[s.pos].Value }
+
+func (s *sliceIterator) Kind() memtable.EntryKind { return s.entries[s.pos].Kind }
+
+// tableIterator walks a block based table one data block at a time,
+// the blocks are read through the block cache. Seek finds the block to
+// start in by a binary search of the index.
+type tableIterator struct {
+	table *SSTable
+	// the first key and the handle of every data block.
+	index   []*memtable.Entry
+	block   int
+	entries []*memtable.Entry
+	pos     int
+	err     error
+}
+
+func newTableIterator(t *SSTable) *tableIterator {
+	it := &tableIterator{table: t, block: -1, pos: -1}
+	index, err := t.index()
+	if err != nil {
+		it.err = err
+		return it
+	}
+	it.index = index.ToKVs()
+	return it
+}
+
+// load decodes the records of block i, the iterator is left before
+// them.
+func (it *tableIterator) load(i int) {
+	it.block, it.entries, it.pos = i, nil, -1
+	if i < 0 || i >= len(it.index) || it.err != nil {
+		return
+	}
+	r := &tableReader{table: it.table}
+	defer r.Close()
+	handle := decodeBlockHandle(it.index[i].Value)
+	block, err := r.dataBlock(handle)
+	if err != nil {
+		it.err = err
+		return
+	}
+
+	// records are copied out of the block, it isn't needed past Close.
+	rd := bytes.NewReader(block)
+	for rd.Len() > 0 {
+		entry, err := it.table.readRecord(rd)
+		if err != nil {
+			it.err = &CorruptionError{File: it.table.dataLocation, Block: fmt.Sprintf("data block at %d", handle.offset), Offset: int64(handle.offset), Reason: err.Error()}
+			it.entries = nil
+			return
+		}
+		it.entries = append(it.entries, entry)
+	}
+}
+
+// skipForward moves on to the first record of the next blocks once
+// the current one is exhausted.
+func (it *tableIterator) skipForward() {
+	for it.err == nil && it.pos >= len(it.entries) && it.block+1 < len(it.index) {
+		it.load(it.block + 1)
+		it.pos = 0
+	}
+}
+
+func (it *tableIterator) skipBackward() {
+	for it.err == nil && it.pos < 0 && it.block > 0 {
+		it.load(it.block - 1)
+		it.pos = len(it.entries) - 1
+	}
+}
+
+func (it *tableIterator) Seek(key interfaces.Comparable) {
+	// the last block starting at or before key.
+	i := sort.Search(len(it.index), func(i int) bool {
+		return it.index[i].Key.Compare(key) > 0
+	})
+	it.load(max(i-1, 0))
+	it.pos = sort.Search(len(it.entries), func(i int) bool {
+		return it.entries[i].Key.Compare(key) >= 0
+	})
+	it.skipForward()
+}
+
+func (it *tableIterator) SeekToFirst() {
+	it.load(0)
+	it.pos = 0
+	it.skipForward()
+}
+
+func (it *tableIterator) SeekToLast() {
+	it.load(len(it.index) - 1)
+	it.pos = len(it.entries) - 1
+	it.skipBackward()
+}
+
+func (it *tableIterator) Next() {
+	it.pos++
+	it.skipForward()
+}
+
+func (it *tableIterator) Prev() {
+	it.pos--
+	it.skipBackward()
+}
+
+func (it *tableIterator) Valid() bool {
+	return it.err == nil && it.pos >= 0 && it.pos < len(it.entries)
+}
+
+func (it *tableIterator) Key() interfaces.Comparable { return it.entries[it.pos].Key }
+
+func (it *tableIterator) Value() []byte { return it.entries[it.pos].Value }
+
+func (it *tableIterator) Kind() memtable.EntryKind { return it.entries[it.pos].Kind }
+
+func (it *tableIterator) Err() error { return it.err }
+
+// mergingIterator yields every key of its children once, with the
+// value of the first child (the newest source) that has it.
+type mergingIterator struct {
+	children []internalIterator
+	current  int
+	forward  bool
+}
+
+func newMergingIterator(children []internalIterator) *mergingIterator {
+	return &mergingIterator{children: children, current: -1, forward: true}
+}
+
+func (m *mergingIterator) Seek(key interfaces.Comparable) {
+	for _, child := range m.children {
+		child.Seek(key)
+	}
+	m.forward = true
+	m.findSmallest()
+}
+
+func (m *mergingIterator) SeekToFirst() {
+	for _, child := range m.children {
+		child.SeekToFirst()
+	}
+	m.forward = true
+	m.findSmallest()
+}
+
+func (m *mergingIterator) SeekToLast() {
+	for _, child := range m.children {
+		child.SeekToLast()
+	}
+	m.forward = false
+	m.findLargest()
+}
+
+func (m *mergingIterator) Next() {
+	key := m.Key()
+
+	if !m.forward {
+		// children are sitting at or before key, move all of them past it.
+		for _, child := range m.children {
+			child.Seek(key)
+			if child.Valid() && child.Key().Compare(key) == 0 {
+				child.Next()
+			}
+		}
+		m.forward = true
+		m.findSmallest()
+		return
+	}
+
+	for _, child := range m.children {
+		if child.Valid() && child.Key().Compare(key) == 0 {
+			child.Next()
+		}
+	}
+	m.findSmallest()
+}
+
+func (m *mergingIterator) Prev() {
+	key := m.Key()
+
+	if m.forward {
+		// children are sitting at or after key, move all of them before it.
+		for _, child := range m.children {
+			child.Seek(key)
+			if child.Valid() {
+				child.Prev()
+			} else {
+				child.SeekToLast()
+			}
+		}
+		m.forward = false
+		m.findLargest()
+		return
+	}
+
+	for _, child := range m.children {
+		if child.Valid() && child.Key().Compare(key) == 0 {
+			child.Prev()
+		}
+	}
+	m.findLargest()
+}
+
+// ties keep the lower index, children are ordered newest first.
+func (m *mergingIterator) findSmallest() {
+	m.current = -1
+	for i, child := range m.children {
+		if child.Valid() && (m.current < 0 || child.Key().Compare(m.children[m.current].Key()) < 0) {
+			m.current = i
+		}
+	}
+}
+
+func (m *mergingIterator) findLargest() {
+	m.current = -1
+	for i, child := range m.children {
+		if child.Valid() && (m.current < 0 || child.Key().Compare(m.children[m.current].Key()) > 0) {
+			m.current = i
+		}
+	}
+}
+
+func (m *mergingIterator) Valid() bool { return m.current >= 0 }
+
+// Err returns the first error of a child that failed to read.
+func (m *mergingIterator) Err() error {
+	for _, child := range m.children {
+		if c, ok := child.(interface{ Err() error }); ok && c.Err() != nil {
+			return c.Err()
+		}
+	}
+	return nil
+}
+
+func (m *mergingIterator) Key() interfaces.Comparable { return m.children[m.current].Key() }
+
+func (m *mergingIterator) Value() []byte { return m.children[m.current].Value() }
+
+func (m *mergingIterator) Kind() memtable.EntryKind { return m.children[m.current].Kind() }
+
+// lsmIterator turns the internal keys of its merged sources into user
+// keys as of seq: newer versions are ignored, older ones are shadowed by
+// the newest visible version and deleted keys are skipped.
+//
+// Going forward iter sits on the entry being returned. Going backward
+// it sits before every version of the current key, which is kept in
+// savedKey and savedValue. So is a merged value going forward, iter
+// then sits past the versions it was merged from.
+type lsmIterator struct {
+	iter       internalIterator
+	seq        uint64
+	op         MergeOperator
+	dels       rangeFragments
+	now        time.Time
+	forward    bool
+	valid      bool
+	merged     bool
+	savedKey   interfaces.Comparable
+	savedValue []byte
+	err        error
+	closed     bool
+	// the tables read from, referenced until Close.
+	tables []*SSTable
+}
+
+func newLSMIterator(iter internalIterator, seq uint64, op MergeOperator, dels rangeFragments) *lsmIterator {
+	return &lsmIterator{iter: iter, seq: seq, op: op, dels: dels, now: now(), forward: true}
+}
+
+// entry returns the kind and value of the version iter sits on, values
+// that expired by the time the iterator was created and versions under
+// a range tombstone read as deleted.
+func (it *lsmIterator) entry() (memtable.EntryKind, []byte) {
+	if key := it.current(); key.seq < it.dels.coverAt(key.user, it.seq) {
+		return memtable.KindDeletion, nil
+	}
+	return liveEntry(it.iter.Kind(), it.iter.Value(), it.now)
+}
+
+func (it *lsmIterator) current() *internalKey {
+	return it.iter.Key().(*internalKey)
+}
+
+func (it *lsmIterator) Seek(key interfaces.Comparable) {
+	it.forward = true
+	it.iter.Seek(newInternalKey(key, it.seq))
+	it.findNextUserEntry(nil)
+}
+
+func (it *lsmIterator) SeekToFirst() {
+	it.forward = true
+	it.iter.SeekToFirst()
+	it.findNextUserEntry(nil)
+}
+
+func (it *lsmIterator) SeekToLast() {
+	it.forward = false
+	it.iter.SeekToLast()
+	it.findPrevUserEntry()
+}
+
+func (it *lsmIterator) Next() {
+	var skip interfaces.Comparable
+	if !it.forward {
+		// iter is right before the versions of savedKey.
+		it.forward = true
+		skip = it.savedKey
+		if it.iter.Valid() {
+			it.iter.Next()
+		} else {
+			it.iter.SeekToFirst()
+		}
+	} else if it.merged {
+		// iter is past the versions merged already.
+		skip = it.savedKey
+	} else {
+		skip = it.current().user
+		it.iter.Next()
+	}
+	it.findNextUserEntry(skip)
+}
+
+func (it *lsmIterator) Prev() {
+	if it.forward {
+		// back up to before every version of the current key.
+		if !it.merged {
+			it.savedKey = it.current().user
+		}
+		if !it.iter.Valid() {
+			it.iter.SeekToLast()
+		}
+		for it.iter.Valid() && it.current().user.Compare(it.savedKey) >= 0 {
+			it.iter.Prev()
+		}
+		if !it.iter.Valid() {
+			it.valid, it.merged = false, false
+			it.savedKey, it.savedValue = nil, nil
+			return
+		}
+		it.forward = false
+	}
+	it.findPrevUserEntry()
+}
+
+// findNextUserEntry moves iter to the next visible, live entry with a
+// user key past skip.
+func (it *lsmIterator) findNextUserEntry(skip interfaces.Comparable) {
+	it.merged = false
+	for ; it.iter.Valid(); it.iter.Next() {
+		key := it.current()
+		if key.seq > it.seq || (skip != nil && key.user.Compare(skip) <= 0) {
+			continue
+		}
+		switch kind, _ := it.entry(); kind {
+		case memtable.KindDeletion:
+			// every older version of the key is deleted as well.
+			skip = key.user
+			continue
+		case memtable.KindMerge:
+			it.mergeForward(key.user)
+			return
+		}
+		it.valid = true
+		return
+	}
+	it.valid = false
+}
+
+// mergeForward merges the operand iter sits on with the older versions
+// of user, leaving iter past the last version it needed.
+func (it *lsmIterator) mergeForward(user interfaces.Comparable) {
+	var chain mergeChain
+	for ; it.iter.Valid() && it.current().user.Compare(user) == 0; it.iter.Next() {
+		if !chain.add(it.entry()) {
+			break
+		}
+	}
+	value, err := chain.value(it.op)
+	if err != nil {
+		it.valid, it.err = false, err
+		return
+	}
+	it.valid, it.merged = true, true
+	it.savedKey, it.savedValue = user, value
+}
+
+// findPrevUserEntry walks back over the versions of the previous user
+// key, oldest first. Values and deletions start over, merge operands
+// pile up on top of them.
+func (it *lsmIterator) findPrevUserEntry() {
+	it.merged = false
+	var user interfaces.Comparable
+	var base []byte
+	var operands [][]byte
+	live := false
+	for ; it.iter.Valid(); it.iter.Prev() {
+		key := it.current()
+		if key.seq > it.seq {
+			continue
+		}
+		if user == nil || key.user.Compare(user) != 0 {
+			if live {
+				// reached the key before the one found.
+				break
+			}
+			user, base, operands = key.user, nil, nil
+		}
+		switch kind, value := it.entry(); kind {
+		case memtable.KindValue:
+			base, operands, live = value, nil, true
+		case memtable.KindDeletion:
+			base, operands, live = nil, nil, false
+		case memtable.KindMerge:
+			operands, live = append(operands, value), true
+		}
+	}
+
+	if !live {
+		it.valid = false
+		it.savedKey, it.savedValue = nil, nil
+		it.forward = true
+		return
+	}
+	value := base
+	if len(operands) > 0 {
+		var err error
+		if value, err = fullMerge(it.op, base, operands); err != nil {
+			it.valid, it.err = false, err
+			return
+		}
+	}
+	it.savedKey, it.savedValue = user, value
+	it.valid = true
+}
+
+func (it *lsmIterator) Valid() bool { return !it.closed && it.valid && it.Err() == nil }
+
+func (it *lsmIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	if m, ok := it.iter.(*mergingIterator); ok {
+		return m.Err()
+	}
+	return nil
+}
+
+func (it *lsmIterator) Key() interfaces.Comparable {
+	if it.forward && !it.merged {
+		return it.current().user
+	}
+	return it.savedKey
+}
+
+func (it *lsmIterator) Value() []byte {
+	if it.forward && !it.merged {
+		_, value := it.entry()
+		return value
+	}
+	return it.savedValue
+}
+
+func (it *lsmIterator) Close() {
+	if it.closed {
+		return
+	}
+	it.closed = true
+	it.iter = newSliceIterator(nil)
+	unrefTables(it.tables)
+	it.tables = nil
+}
+
+// NewIterator returns an unpositioned iterator over a point-in-time
+// view of the tree, call Seek or SeekToFirst before using it. The
+// tables it reads are kept until Close.
+func (l *LSM) NewIterator() (Iterator, error) {
+	l.mu.RLock()
+	return l.newIterator(l.seq, nil)
+}
+
+// newIterator builds an iterator reading as of seq, the caller must
+// hold l.mu for reading, it is released before the tables are read.
+// The entries of writes, if any, win over every other version.
+func (l *LSM) newIterator(seq uint64, writes *memtable.MemTable) (Iterator, error) {
+	if l.closed {
+		l.mu.RUnlock()
+		return nil, ErrClosed
+	}
+	var children []internalIterator
+	if writes != nil {
+		children = append(children, writes.NewIterator())
+	}
+	mems := l.memtables()
+	for _, mem := range mems {
+		children = append(children, mem.NewIterator())
+	}
+	tables := l.refTables()
+	op := l.mergeOperator
+	l.mu.RUnlock()
+
+	for i := len(tables) - 1; i >= 0; i-- {
+		if tables[i].version > 0 {
+			children = append(children, newTableIterator(tables[i]))
+			continue
+		}
+		// version 0 tables have no blocks, they are read as a whole.
+		entries, err := tables[i].entries()
+		if err != nil {
+			unrefTables(tables)
+			return nil, err
+		}
+		children = append(children, newSliceIterator(entries))
+	}
+
+	dels := visibleTombstones(seq, mems, tables)
+	it := newLSMIterator(newMergingIterator(children), seq, op, dels)
+	it.tables = tables
+	return it, nil
+}
+
+// Scan returns the live entries with start <= key < end, a nil bound
+// leaves that side open.
+func (l *LSM) Scan(start, end interfaces.Comparable) ([]*memtable.Entry, error) {
+	it, err := l.NewIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	if start != nil {
+		it.Seek(start)
+	} else {
+		it.SeekToFirst()
+	}
+
+	var result []*memtable.Entry
+	for ; it.Valid(); it.Next() {
+		if end != nil && it.Key().Compare(end) >= 0 {
+			break
+		}
+		result = append(result, &memtable.Entry{Key: it.Key(), Value: it.Value()})
+	}
+	return result, it.Err()
+}
+
+// PrefixScan returns the live string keys starting with prefix.
+func (l *LSM) PrefixScan(prefix string) ([]*memtable.Entry, error) {
+	it, err := l.NewIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var result []*memtable.Entry
+	for it.Seek(keys.NewStringKey(prefix)); it.Valid(); it.Next() {
+		key, ok := it.Key().(*keys.StringKey)
+		if !ok || !strings.HasPrefix(key.GetValue().(string), prefix) {
+			break
+		}
+		result = append(result, &memtable.Entry{Key: it.Key(), Value: it.Value()})
+	}
+	return result, it.Err()
+}
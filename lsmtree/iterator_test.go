@@ -0,0 +1,239 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+	"main/cache"
+	"main/keys"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// fillIterationData spreads keys 0..n-1 over several SSTables and the
+// memtable, overwriting the even keys and deleting every multiple of 3.
+func fillIterationData(t *testing.T, lsm *LSM, n int) []int {
+	for i := range n {
+		if err := lsm.Put(keys.NewIntKey(uint32(i)), []byte("val_"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Put failed at %d: %v", i, err)
+		}
+	}
+	for i := 0; i < n; i += 2 {
+		if err := lsm.Put(keys.NewIntKey(uint32(i)), []byte("new_"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Put failed at %d: %v", i, err)
+		}
+	}
+	var live []int
+	for i := range n {
+		if i%3 == 0 {
+			lsm.Delete(keys.NewIntKey(uint32(i)))
+			continue
+		}
+		live = append(live, i)
+	}
+	return live
+}
+
+func expectedValue(i int) string {
+	if i%2 == 0 {
+		return "new_" + strconv.Itoa(i)
+	}
+	return "val_" + strconv.Itoa(i)
+}
+
+func TestIteratorForwardAndBackward(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 7, 2, 0.01, nil)
+	live := fillIterationData(t, lsm, 60)
+
+	it, err := lsm.NewIterator()
+	if err != nil {
+		t.Fatalf("NewIterator failed: %v", err)
+	}
+	defer it.Close()
+
+	i := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if i >= len(live) {
+			t.Fatalf("Iterator returned more than %d keys", len(live))
+		}
+		if it.Key().GetValue() != uint32(live[i]) || string(it.Value()) != expectedValue(live[i]) {
+			t.Errorf("Expected %d=%s, got %v=%s", live[i], expectedValue(live[i]), it.Key().GetValue(), it.Value())
+		}
+		i++
+	}
+	if i != len(live) {
+		t.Errorf("Expected %d keys going forward, got %d", len(live), i)
+	}
+
+	i = len(live) - 1
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		if it.Key().GetValue() != uint32(live[i]) {
+			t.Errorf("Expected key %d going backward, got %v", live[i], it.Key().GetValue())
+		}
+		i--
+	}
+	if i != -1 {
+		t.Errorf("Expected to walk back over all keys, %d left", i+1)
+	}
+}
+
+func TestIteratorSeekAndChangeDirection(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 7, 2, 0.01, nil)
+	fillIterationData(t, lsm, 60)
+
+	it, err := lsm.NewIterator()
+	if err != nil {
+		t.Fatalf("NewIterator failed: %v", err)
+	}
+	defer it.Close()
+
+	// 30 is deleted, so Seek lands on 31.
+	it.Seek(keys.NewIntKey(30))
+	if !it.Valid() || it.Key().GetValue() != uint32(31) {
+		t.Fatalf("Expected Seek(30) to land on 31")
+	}
+	it.Next()
+	if !it.Valid() || it.Key().GetValue() != uint32(32) {
+		t.Fatalf("Expected Next to move to 32")
+	}
+	it.Prev()
+	it.Prev()
+	if !it.Valid() || it.Key().GetValue() != uint32(29) {
+		t.Fatalf("Expected two Prev calls to move to 29, skipping deleted 30")
+	}
+	it.Next()
+	if !it.Valid() || it.Key().GetValue() != uint32(31) {
+		t.Fatalf("Expected Next to move back to 31")
+	}
+
+	it.Seek(keys.NewIntKey(1000))
+	if it.Valid() {
+		t.Errorf("Expected Seek past the last key to be invalid")
+	}
+
+	it.Close()
+	it.SeekToFirst()
+	if it.Valid() {
+		t.Errorf("Expected a closed iterator to be invalid")
+	}
+}
+
+func TestScan(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 7, 2, 0.01, nil)
+	fillIterationData(t, lsm, 60)
+
+	entries, err := lsm.Scan(keys.NewIntKey(10), keys.NewIntKey(20))
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	want := []int{10, 11, 13, 14, 16, 17, 19}
+	if len(entries) != len(want) {
+		t.Fatalf("Expected %d entries, got %d", len(want), len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Key.GetValue() != uint32(want[i]) || string(entry.Value) != expectedValue(want[i]) {
+			t.Errorf("Expected %d=%s, got %v=%s", want[i], expectedValue(want[i]), entry.Key.GetValue(), entry.Value)
+		}
+	}
+
+	entries, err = lsm.Scan(nil, nil)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(entries) != 40 {
+		t.Errorf("Expected an unbounded scan to return 40 entries, got %d", len(entries))
+	}
+}
+
+func TestPrefixScan(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 5, 2, 0.01, nil)
+	for _, prefix := range []string{"apple", "banana", "cherry"} {
+		for i := range 6 {
+			key := keys.NewStringKey(fmt.Sprintf("%s-%d", prefix, i))
+			if err := lsm.Put(key, []byte(prefix)); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+	}
+	lsm.Delete(keys.NewStringKey("banana-3"))
+
+	entries, err := lsm.PrefixScan("banana")
+	if err != nil {
+		t.Fatalf("PrefixScan failed: %v", err)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("Expected 5 banana keys, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		if string(entry.Value) != "banana" {
+			t.Errorf("Unexpected entry %v=%s in banana prefix", entry.Key.GetValue(), entry.Value)
+		}
+	}
+}
+
+func TestIteratorReadsBlocksLazily(t *testing.T) {
+	blocks := cache.New(8<<20, cache.LRU)
+	// every flush gets merged into L1 right away.
+	strategy := NewLeveledStrategy()
+	strategy.L0CompactionTrigger = 1
+	lsm, err := Open(t.TempDir(), WithThreshold(500), WithCompactionStrategy(strategy), WithBlockCache(blocks), WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer lsm.Close()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := range 2000 {
+		lsm.Put(keys.NewIntKey(uint32(i)), value)
+	}
+	flushAll(t, lsm)
+	total := 0
+	for _, table := range lsm.SStables {
+		total += len(tableIndex(t, table))
+	}
+
+	it, err := lsm.NewIterator()
+	if err != nil {
+		t.Fatalf("NewIterator failed: %v", err)
+	}
+	before := blocks.Stats()
+	it.Seek(keys.NewIntKey(1000))
+	for range 5 {
+		it.Next()
+	}
+	it.Prev()
+	if !it.Valid() || it.Key().GetValue() != uint32(1004) {
+		t.Fatalf("Expected to be at key 1004, got %v", it.Key().GetValue())
+	}
+	if read := blocks.Stats().Misses - before.Misses; read == 0 || read > 4 {
+		t.Errorf("Expected a few of the %d blocks to be read, got %d", total, read)
+	}
+
+	// the tables stay around for the iterator while compaction replaces
+	// them.
+	files := lsm.SStables
+	for i := range 2000 {
+		lsm.Put(keys.NewIntKey(uint32(i)), []byte("new"))
+	}
+	flushAll(t, lsm)
+	count := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if !bytes.Equal(it.Value(), value) {
+			t.Fatalf("Expected the old value of key %v, got %q", it.Key().GetValue(), it.Value())
+		}
+		count++
+	}
+	if count != 2000 || it.Err() != nil {
+		t.Errorf("Expected 2000 keys, got %d, %v", count, it.Err())
+	}
+	it.Close()
+	for _, table := range files {
+		if _, err := os.Stat(table.dataLocation); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed once the iterator is closed, got %v", table.dataLocation, err)
+		}
+	}
+}
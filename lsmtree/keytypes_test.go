@@ -0,0 +1,130 @@
+package lsmtree
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"main/interfaces"
+	"main/keys"
+	"testing"
+)
+
+const pointKeyType uint8 = 0x10
+
+// pointKey is an application key type, sorting by x, then y.
+type pointKey struct {
+	x, y uint16
+}
+
+func init() {
+	// before the built in types.
+	if err := keys.Register(pointKeyType, pointKeyFromBytes, -1); err != nil {
+		panic(err)
+	}
+}
+
+func (p *pointKey) Compare(other interfaces.Comparable) int8 {
+	o, ok := other.(*pointKey)
+	if !ok {
+		return keys.CompareTypes(p, other)
+	}
+	if c := cmp.Compare(p.x, o.x); c != 0 {
+		return int8(c)
+	}
+	return int8(cmp.Compare(p.y, o.y))
+}
+
+func (p *pointKey) GetValue() any {
+	return fmt.Sprintf("(%d,%d)", p.x, p.y)
+}
+
+func (p *pointKey) ToBytes() ([]byte, error) {
+	return []byte{pointKeyType, byte(p.x >> 8), byte(p.x), byte(p.y >> 8), byte(p.y)}, nil
+}
+
+func (p *pointKey) Hash(numHashes uint32) ([]uint32, error) {
+	encoded, _ := p.ToBytes()
+	h := fnv.New64a()
+	h.Write(encoded)
+	sum := h.Sum64()
+	hashes := make([]uint32, numHashes)
+	for i := range hashes {
+		hashes[i] = uint32(sum) + uint32(i)*uint32(sum>>32)
+	}
+	return hashes, nil
+}
+
+func pointKeyFromBytes(buf io.Reader) (interfaces.Comparable, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(buf, b[:]); err != nil {
+		return nil, fmt.Errorf("error parsing point: %w", err)
+	}
+	return &pointKey{x: binary.BigEndian.Uint16(b[:2]), y: binary.BigEndian.Uint16(b[2:])}, nil
+}
+
+func TestKeyTypes(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := Open(dir, WithThreshold(10), WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	// points first, then ints, strings and byte keys.
+	want := []interfaces.Comparable{
+		&pointKey{1, 2}, &pointKey{1, 7}, &pointKey{3, 0},
+		keys.NewIntKey(0), keys.NewIntKey(9),
+		keys.NewStringKey(""), keys.NewStringKey("a"),
+		keys.NewBytesKey([]byte{0}), keys.NewBytesKey([]byte{0, 0xff}), keys.NewBytesKey([]byte{1}),
+	}
+	for i := len(want) - 1; i >= 0; i-- {
+		if err := lsm.Put(want[i], []byte(fmt.Sprint(want[i].GetValue()))); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	lsm.DeleteRange(&pointKey{2, 0}, &pointKey{3, 0})
+	lsm.Put(&pointKey{2, 5}, []byte("deleted"))
+	lsm.DeleteRange(&pointKey{2, 0}, &pointKey{3, 0})
+
+	check := func(lsm *LSM) {
+		t.Helper()
+		for _, key := range want {
+			if _, got, err := lsm.Get(key); err != nil || string(got) != fmt.Sprint(key.GetValue()) {
+				t.Errorf("Expected %v for key %v, got %q, %v", key.GetValue(), key.GetValue(), got, err)
+			}
+		}
+		if found, got, _ := lsm.Get(&pointKey{2, 5}); found && got != nil {
+			t.Errorf("Expected the range deletion to cover (2,5), got %q", got)
+		}
+		it, err := lsm.NewIterator()
+		if err != nil {
+			t.Fatalf("NewIterator failed: %v", err)
+		}
+		defer it.Close()
+		i := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			if i >= len(want) || keys.Compare(it.Key(), want[i]) != 0 {
+				t.Fatalf("Expected to iterate over %v in order, got %v at %d", want, it.Key().GetValue(), i)
+			}
+			i++
+		}
+		if i != len(want) {
+			t.Errorf("Expected %d keys while iterating, got %d", len(want), i)
+		}
+	}
+
+	check(lsm)
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	// the tables and the manifest hold every type now.
+	lsm, err = Open(dir, WithThreshold(10), WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer lsm.Close()
+	if len(lsm.SStables) == 0 {
+		t.Fatalf("Expected the keys to be flushed on close")
+	}
+	check(lsm)
+}
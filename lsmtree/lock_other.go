@@ -0,0 +1,22 @@
+//go:build !unix
+
+package lsmtree
+
+import (
+	"errors"
+	"os"
+)
+
+// lockFile creates path and fails if it exists. Without flock a crashed
+// process leaves the file behind, it has to be removed by hand.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return nil, ErrLocked
+	}
+	return f, err
+}
+
+func unlockFile(f *os.File) error {
+	return errors.Join(f.Close(), os.Remove(f.Name()))
+}
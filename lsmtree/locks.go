@@ -0,0 +1,223 @@
+package lsmtree
+
+import (
+	"errors"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * The lock manager hands out shared and exclusive locks on keys to
+ * pessimistic transactions. Keys are spread over stripes, each with its
+ * own mutex, so transactions on different keys rarely wait on the same
+ * mutex. A key can be held by several transactions in shared mode or
+ * by one in exclusive mode, a transaction holding the only shared lock
+ * can upgrade it.
+ *
+ * A transaction that has to wait records the ones in its way in the
+ * waits-for graph. If that closes a cycle, the youngest transaction of
+ * the cycle is picked as the victim: its wait fails with ErrDeadlock
+ * and it is expected to roll back, which lets the others go on. Waits
+ * also fail with ErrLockTimeout once the timeout of the transaction has
+ * passed.
+ */
+
+const (
+	lockStripes        = 16
+	defaultLockTimeout = time.Second
+)
+
+var (
+	// ErrLockTimeout is returned when a lock wasn't granted in time.
+	ErrLockTimeout = errors.New("timed out waiting for a lock")
+	// ErrDeadlock is returned to the transaction picked to break a
+	// deadlock, it should roll back.
+	ErrDeadlock = errors.New("deadlock detected")
+)
+
+type lockMode uint8
+
+const (
+	lockShared lockMode = iota + 1
+	lockExclusive
+)
+
+type keyLock struct {
+	// mode held by each transaction.
+	holders map[uint64]lockMode
+	// closed and replaced whenever a holder lets go.
+	released chan struct{}
+}
+
+type lockStripe struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+// waitState is a transaction blocked on a lock.
+type waitState struct {
+	// the transactions holding the lock it waits for.
+	blockers []uint64
+	// closed once the transaction is picked as a deadlock victim.
+	abort  chan struct{}
+	victim bool
+}
+
+type lockManager struct {
+	stripes [lockStripes]lockStripe
+	// IDs of the transactions, younger ones get larger IDs.
+	lastTx atomic.Uint64
+	// waits-for graph, guarded by mu.
+	mu      sync.Mutex
+	waiting map[uint64]*waitState
+}
+
+func newLockManager() *lockManager {
+	m := &lockManager{waiting: map[uint64]*waitState{}}
+	for i := range m.stripes {
+		m.stripes[i].locks = map[string]*keyLock{}
+	}
+	return m
+}
+
+func (m *lockManager) stripe(key string) *lockStripe {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &m.stripes[h.Sum32()%lockStripes]
+}
+
+// lock blocks until tx holds key in mode or better, for at most
+// timeout.
+func (m *lockManager) lock(tx uint64, key string, mode lockMode, timeout time.Duration) error {
+	defer m.stopWaiting(tx)
+	stripe := m.stripe(key)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		stripe.mu.Lock()
+		kl := stripe.locks[key]
+		if kl == nil {
+			kl = &keyLock{holders: map[uint64]lockMode{}, released: make(chan struct{})}
+			stripe.locks[key] = kl
+		}
+		blockers := kl.blockers(tx, mode)
+		if len(blockers) == 0 {
+			kl.holders[tx] = max(kl.holders[tx], mode)
+			stripe.mu.Unlock()
+			return nil
+		}
+		released := kl.released
+		stripe.mu.Unlock()
+
+		abort, err := m.wait(tx, blockers)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-released:
+		case <-abort:
+			return ErrDeadlock
+		case <-timer.C:
+			return ErrLockTimeout
+		}
+	}
+}
+
+// blockers returns the other transactions that keep tx from holding
+// the lock in mode.
+func (kl *keyLock) blockers(tx uint64, mode lockMode) []uint64 {
+	var blockers []uint64
+	for holder, held := range kl.holders {
+		if holder != tx && (mode == lockExclusive || held == lockExclusive) {
+			blockers = append(blockers, holder)
+		}
+	}
+	return blockers
+}
+
+// unlock releases the locks tx holds on keys.
+func (m *lockManager) unlock(tx uint64, keys []string) {
+	for _, key := range keys {
+		stripe := m.stripe(key)
+		stripe.mu.Lock()
+		if kl := stripe.locks[key]; kl != nil {
+			delete(kl.holders, tx)
+			close(kl.released)
+			kl.released = make(chan struct{})
+			if len(kl.holders) == 0 {
+				delete(stripe.locks, key)
+			}
+		}
+		stripe.mu.Unlock()
+	}
+}
+
+// wait records that tx waits for blockers and looks for a deadlock.
+// The returned channel is closed if tx is picked as a victim later on.
+func (m *lockManager) wait(tx uint64, blockers []uint64) (<-chan struct{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ws := m.waiting[tx]
+	if ws == nil {
+		ws = &waitState{abort: make(chan struct{})}
+		m.waiting[tx] = ws
+	}
+	if ws.victim {
+		return nil, ErrDeadlock
+	}
+	ws.blockers = blockers
+
+	if cycle := m.findCycle(tx); cycle != nil {
+		victim := slices.Max(cycle)
+		if victim == tx {
+			return nil, ErrDeadlock
+		}
+		vs := m.waiting[victim]
+		vs.victim = true
+		close(vs.abort)
+	}
+	return ws.abort, nil
+}
+
+func (m *lockManager) stopWaiting(tx uint64) {
+	m.mu.Lock()
+	delete(m.waiting, tx)
+	m.mu.Unlock()
+}
+
+// findCycle returns the transactions on a cycle of the waits-for graph
+// through tx, or nil. Victims are on their way out and don't count.
+// The caller must hold m.mu.
+func (m *lockManager) findCycle(tx uint64) []uint64 {
+	visited := map[uint64]bool{}
+	var path []uint64
+	var visit func(node uint64) bool
+	visit = func(node uint64) bool {
+		ws := m.waiting[node]
+		if ws == nil || ws.victim {
+			return false
+		}
+		path = append(path, node)
+		for _, next := range ws.blockers {
+			if next == tx {
+				return true
+			}
+			if !visited[next] {
+				visited[next] = true
+				if visit(next) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if visit(tx) {
+		return path
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package lsmtree
+
+import (
+	"errors"
+	"main/keys"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockModes(t *testing.T) {
+	m := newLockManager()
+	short := 20 * time.Millisecond
+
+	// shared locks get along, an exclusive one waits for them.
+	if err := m.lock(1, "a", lockShared, short); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if err := m.lock(2, "a", lockShared, short); err != nil {
+		t.Fatalf("Expected a second shared lock, got %v", err)
+	}
+	if err := m.lock(1, "a", lockExclusive, short); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("Expected the upgrade to time out while shared twice, got %v", err)
+	}
+	m.unlock(2, []string{"a"})
+	if err := m.lock(1, "a", lockExclusive, short); err != nil {
+		t.Errorf("Expected the only holder to upgrade, got %v", err)
+	}
+	if err := m.lock(2, "a", lockShared, short); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("Expected a shared lock to wait for the exclusive one, got %v", err)
+	}
+	// other keys aren't in the way.
+	if err := m.lock(2, "b", lockExclusive, short); err != nil {
+		t.Errorf("Expected a lock on another key, got %v", err)
+	}
+
+	// the waiter gets the lock as soon as it is released.
+	done := make(chan error)
+	go func() { done <- m.lock(2, "a", lockExclusive, time.Second) }()
+	time.Sleep(short)
+	m.unlock(1, []string{"a"})
+	if err := <-done; err != nil {
+		t.Errorf("Expected the lock after the release, got %v", err)
+	}
+	m.unlock(2, []string{"a", "b"})
+	for i := range m.stripes {
+		if len(m.stripes[i].locks) != 0 {
+			t.Errorf("Expected every lock to be gone, got %v in stripe %d", m.stripes[i].locks, i)
+		}
+	}
+}
+
+func TestPessimisticTx(t *testing.T) {
+	lsm, err := Open(t.TempDir(), WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer lsm.Close()
+
+	a, b := keys.NewIntKey(1), keys.NewIntKey(2)
+	lsm.Put(a, []byte("old"))
+	opts := TxOptions{Pessimistic: true, LockTimeout: 50 * time.Millisecond}
+
+	tx1, err := lsm.BeginTxWith(opts)
+	if err != nil {
+		t.Fatalf("BeginTxWith failed: %v", err)
+	}
+	if err := tx1.Put(a, []byte("new")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, got, _ := tx1.Get(a); string(got) != "new" {
+		t.Errorf("Expected the transaction to read its write, got %q", got)
+	}
+	tx2, _ := lsm.BeginTxWith(opts)
+	if _, _, err := tx2.Get(a); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("Expected ErrLockTimeout, got %v", err)
+	}
+	// pessimistic transactions read the latest version.
+	lsm.Put(b, []byte("later"))
+	if _, got, _ := tx2.Get(b); string(got) != "later" {
+		t.Errorf("Expected the latest version of b, got %q", got)
+	}
+	if err := tx1.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if _, got, err := tx2.Get(a); err != nil || string(got) != "new" {
+		t.Errorf("Expected the committed write once the lock is free, got %q, %v", got, err)
+	}
+	tx2.Rollback()
+
+	// each waits for the key the other one holds, the younger one is
+	// picked to break the deadlock.
+	opts.LockTimeout = time.Second
+	older, _ := lsm.BeginTxWith(opts)
+	younger, _ := lsm.BeginTxWith(opts)
+	older.GetForUpdate(a)
+	younger.GetForUpdate(b)
+	done := make(chan error)
+	go func() { done <- older.Put(b, []byte("older")) }()
+	time.Sleep(20 * time.Millisecond)
+	if err := younger.Put(a, []byte("younger")); !errors.Is(err, ErrDeadlock) {
+		t.Errorf("Expected ErrDeadlock, got %v", err)
+	}
+	younger.Rollback()
+	if err := <-done; err != nil {
+		t.Errorf("Expected the older transaction to go on, got %v", err)
+	}
+	if err := older.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if _, got, _ := lsm.Get(b); string(got) != "older" {
+		t.Errorf("Expected the older transaction to write b, got %q", got)
+	}
+}
+
+func TestPessimisticTxConcurrentIncrements(t *testing.T) {
+	lsm, err := Open(t.TempDir(), WithThreshold(20), WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer lsm.Close()
+
+	counter := keys.NewIntKey(0)
+	lsm.Put(counter, []byte("0"))
+	increment := func() error {
+		tx, err := lsm.BeginTxWith(TxOptions{Pessimistic: true})
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		_, value, err := tx.GetForUpdate(counter)
+		if err != nil {
+			return err
+		}
+		n, _ := strconv.Atoi(string(value))
+		tx.Put(counter, []byte(strconv.Itoa(n+1)))
+		return tx.Commit()
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 25 {
+				if err := increment(); err != nil {
+					t.Errorf("increment failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, value, _ := lsm.Get(counter); string(value) != "100" {
+		t.Errorf("Expected 100 increments, got %s", value)
+	}
+}
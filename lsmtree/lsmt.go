@@ -2,27 +2,92 @@ package lsmtree
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"fmt"
 	"main/bloomfilter"
+	"main/cache"
+	"main/compression"
 	"main/interfaces"
 	"main/keys"
 	"main/memtable"
 	"main/util"
+	"main/wal"
 )
 
+// LSM is safe for concurrent use.
 type LSM struct {
-	memtable          memtable.MemTable
-	SStables          []*SSTable
-	sparsityFactor    uint32
+	// mu guards the memtables, SStables and the wal writer. Writers
+	// hold it exclusively, readers only long enough to grab references.
+	mu       sync.RWMutex
+	memtable *memtable.MemTable
+	// full memtables waiting for the flusher, oldest first.
+	immutables []*immutableMemtable
+	// signaled whenever the flusher retires an immutable memtable.
+	flushed  *sync.Cond
+	flushErr error
+	// sequence number of the last write, every write gets the next one.
+	seq uint64
+	// live snapshots, oldest first.
+	snapshots []*Snapshot
+	// ordered by precedence, a table shadows every table before it.
+	SStables       []*SSTable
+	sparsityFactor uint32
+	// a memtable is flushed once it holds threshold entries or takes
+	// writeBufferSize bytes, 0 turns either limit off.
 	threshold         uint32
+	writeBufferSize   int64
+	writeBuffer       *WriteBufferManager
 	falsePositiveRate float64
 	dataPath          string
+	syncPolicy        wal.SyncPolicy
+	wal               *wal.Writer
+	// codec for the data blocks of new tables, existing tables keep
+	// whatever they were written with.
+	compressor compression.Compressor
+	// shared by every table for their data blocks, nil turns caching off.
+	blockCache *cache.Cache
+	// off unless set, see rowcache.go.
+	rowCache *cache.Cache
+	// combines KindMerge entries, see merge.go.
+	mergeOperator MergeOperator
+	// open files of the tables, see tablecache.go.
+	tableCache *tableCache
+	// key locks of pessimistic transactions, see locks.go.
+	locks  *lockManager
+	logger Logger
+	// LOCK file of dataPath, held until Close.
+	lock   *os.File
+	closed bool
+	// segments replayed at startup, they back the current memtable
+	// until it gets flushed.
+	replayedSegments []string
+	// number of the last table file, see nextFileNumber.
+	lastFileNumber atomic.Uint64
+	// manifestMu orders manifest writes, it is taken before mu.
+	manifestMu     sync.Mutex
+	manifest       *wal.Writer
+	manifestNumber uint64
+	manifestBytes  int
+	compaction     CompactionStrategy
+	compactMu      sync.Mutex
+	compactCh      chan struct{}
+	compactStop    chan struct{}
+	compactDone    chan struct{}
+	flushCh        chan struct{}
+	flushStop      chan struct{}
+	flushDone      chan struct{}
+	stopOnce       sync.Once
 }
 
 type SSTable struct {
@@ -31,125 +96,449 @@ type SSTable struct {
 	dataLength   int
 	sparseIndex  memtable.MemTableImplementation
 	bloomfilter  bloomfilter.BloomFilterImplementation
+	level        int
+	minKey       interfaces.Comparable
+	maxKey       interfaces.Comparable
+	// format version of the file, see table.go.
+	version uint32
+	// sequence number range of the entries, 0 for tables written before
+	// sequence numbers existed. minSeq is only known from the manifest.
+	minSeq uint64
+	maxSeq uint64
+	// range tombstones, see rangedel.go.
+	rangeDels rangeFragments
+	// one reference belongs to LSM.SStables, the rest to readers. The
+	// file is removed once compaction dropped the table and the last
+	// reader is done with it.
+	refs   atomic.Int32
+	logger Logger
+	// filter and index block of the table, they are pinned in the block
+	// cache under the offsets and the fields above are cleared, see
+	// filter and index.
+	filterHandle blockHandle
+	indexHandle  blockHandle
+	blockCache   *cache.Cache
+	files        *tableCache
+	// key of the table in the block and row caches, see setupTable.
+	id uint64
 }
 
-var TOMBSTONE = []byte{0x7f}
+const (
+	defaultWriteBufferSize   = 4 << 20
+	defaultSparsityFactor    = 4
+	defaultFalsePositiveRate = 0.01
+	defaultBlockCacheSize    = 8 << 20
+	lockFileName             = "LOCK"
+)
 
-func NewLSMTree(threshold uint32, sparsityFactor uint32, falsePositiveRate float64) *LSM {
+var (
+	// ErrClosed is returned by operations on an LSM after Close.
+	ErrClosed = errors.New("lsm is closed")
+	// ErrLocked is returned by Open when another LSM holds the directory.
+	ErrLocked = errors.New("data directory is locked by another process")
+)
 
+// NewLSMTree opens the store in $CWD/data, a nil compaction strategy
+// defaults to size-tiered compaction. It panics if the store can't be
+// opened, use Open to get the error instead.
+func NewLSMTree(threshold uint32, sparsityFactor uint32, falsePositiveRate float64, compaction CompactionStrategy) *LSM {
 	cwd, _ := os.Getwd()
-	dataPath := filepath.Join(cwd, "data")
+	opts := []Option{
+		WithThreshold(threshold),
+		WithSparsityFactor(sparsityFactor),
+		WithFalsePositiveRate(falsePositiveRate),
+	}
+	if compaction != nil {
+		opts = append(opts, WithCompactionStrategy(compaction))
+	}
+
+	lsm, err := Open(filepath.Join(cwd, "data"), opts...)
+	if err != nil {
+		panic(err)
+	}
+	return lsm
+}
+
+// Open opens the store in dir, creating it if needed, and starts the
+// background flushes and compactions. The directory stays locked until
+// Close, a second Open of it fails with ErrLocked.
+func Open(dir string, opts ...Option) (*LSM, error) {
+	dataPath, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dataPath, 0755); err != nil {
+		return nil, err
+	}
 
 	lsm := &LSM{
-		threshold:         threshold,
-		sparsityFactor:    sparsityFactor,
-		falsePositiveRate: falsePositiveRate,
-		memtable:          *memtable.NewMemTable(memtable.NewAVLTree()),
+		writeBufferSize:   defaultWriteBufferSize,
+		sparsityFactor:    defaultSparsityFactor,
+		falsePositiveRate: defaultFalsePositiveRate,
+		memtable:          newMemTable(),
 		dataPath:          dataPath,
+		syncPolicy:        wal.SyncPolicy{Mode: wal.SyncNever},
+		compressor:        compression.None{},
+		compaction:        NewSizeTieredStrategy(),
+		blockCache:        cache.New(defaultBlockCacheSize, cache.LRU),
+		tableCache:        newTableCache(defaultMaxOpenFiles, false),
+		locks:             newLockManager(),
+		logger:            defaultLogger,
+		compactCh:         make(chan struct{}, 1),
+		compactStop:       make(chan struct{}),
+		compactDone:       make(chan struct{}),
+		flushCh:           make(chan struct{}, 1),
+		flushStop:         make(chan struct{}),
+		flushDone:         make(chan struct{}),
+	}
+	lsm.flushed = sync.NewCond(&lsm.mu)
+	for _, opt := range opts {
+		opt(lsm)
 	}
+	// registered once the memtable is replayed, so its usage counts.
+	manager := lsm.writeBuffer
+	lsm.writeBuffer = nil
 
-	err := lsm.loadSSTables(dataPath)
+	lsm.lock, err = lockFile(filepath.Join(dataPath, lockFileName))
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("error locking %s: %w", dataPath, err)
 	}
 
-	return lsm
+	if err := lsm.loadSSTables(dataPath); err != nil {
+		return nil, errors.Join(err, lsm.release(false))
+	}
+	if err := lsm.replayWAL(); err != nil {
+		return nil, errors.Join(err, lsm.release(false))
+	}
+	if manager != nil {
+		lsm.SetWriteBufferManager(manager)
+	}
+
+	go lsm.flushLoop()
+	go lsm.compactionLoop()
+	lsm.scheduleCompaction()
+
+	return lsm, nil
+}
+
+// Close flushes the memtable, waits for background work to finish and
+// releases the data directory. Closing twice is a no-op, every other
+// operation fails with ErrClosed.
+func (l *LSM) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	var err error
+	if l.memtable.Size() > 0 && l.flushErr == nil {
+		err = l.switchMemtable()
+	}
+	l.mu.Unlock()
+
+	if err == nil {
+		err = l.waitForFlush()
+	}
+	l.stopBackgroundWork()
+	return errors.Join(err, l.release(err == nil))
 }
 
+// release closes the files the LSM keeps open and unlocks the data
+// directory, background work must be stopped. If flushed is set the
+// memtable is on disk and its wal segment can go.
+func (l *LSM) release(flushed bool) error {
+	l.SetWriteBufferManager(nil)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var errs []error
+	if l.wal != nil {
+		errs = append(errs, l.wal.Close())
+		if flushed {
+			errs = append(errs, removeSegments(append(l.replayedSegments, l.wal.Path())))
+		}
+	}
+	for _, table := range l.SStables {
+		table.detachCache()
+	}
+	l.tableCache.closeAll()
+	l.manifestMu.Lock()
+	if l.manifest != nil {
+		errs = append(errs, l.manifest.Close())
+	}
+	l.manifestMu.Unlock()
+	errs = append(errs, unlockFile(l.lock))
+	return errors.Join(errs...)
+}
+
+// SetSyncPolicy controls how often the write-ahead log is fsynced.
+func (l *LSM) SetSyncPolicy(policy wal.SyncPolicy) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.wal.SetPolicy(policy); err != nil {
+		return err
+	}
+	l.syncPolicy = policy
+	return nil
+}
+
+// SetCompressor picks the codec used for data blocks of tables written
+// from now on, flushes and compactions alike.
+func (l *LSM) SetCompressor(compressor compression.Compressor) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.compressor = compressor
+}
+
+// BlockCacheStats reports the hits, misses and memory usage of the
+// block cache, all zero if caching is off. A shared cache reports the
+// numbers of every tree using it.
+func (l *LSM) BlockCacheStats() cache.Stats {
+	if l.blockCache == nil {
+		return cache.Stats{}
+	}
+	return l.blockCache.Stats()
+}
+
+// loadSSTables opens the tables listed in the manifest, or every table
+// file in dataPath for a store written before the manifest existed, and
+// starts a new manifest.
 func (l *LSM) loadSSTables(dataPath string) error {
+	name, err := readCurrent(dataPath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		err = l.loadSSTablesFromDir(dataPath)
+	case err == nil:
+		err = l.recoverManifest(name)
+	}
+	if err != nil {
+		return err
+	}
+
+	l.logger.Printf("Loaded %d SStables", len(l.SStables))
+	if err := l.reportOrphans(); err != nil {
+		return err
+	}
+
+	l.manifestMu.Lock()
+	defer l.manifestMu.Unlock()
+	return l.rotateManifest()
+}
+
+func (l *LSM) loadSSTablesFromDir(dataPath string) error {
 	entries, err := os.ReadDir(dataPath)
 	if err != nil {
 		return err
 	}
 
 	type fileEntry struct {
-		name    string
+		table   *SSTable
 		modTime time.Time
 	}
 
 	var files []fileEntry
 	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), "sstable_") {
+			continue
+		}
 		info, err := e.Info()
 		if err != nil {
 			return err
 		}
-		files = append(files, fileEntry{name: e.Name(), modTime: info.ModTime()})
-	}
 
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].modTime.Before(files[j].modTime)
-	})
-
-	for _, e := range files {
-		filePath := filepath.Join(dataPath, e.name)
-		f, err := os.Open(filePath)
+		filePath := filepath.Join(dataPath, e.Name())
+		table, err := l.openSSTable(filePath, levelFromFileName(e.Name()))
 		if err != nil {
 			return err
 		}
-		defer f.Close()
-
-		sparseIndex := memtable.NewAVLTree()
-		bloomFilter := bloomfilter.NewBloomFilter(l.threshold, l.falsePositiveRate)
-		memtable := memtable.NewMemTable(memtable.NewAVLTree())
+		l.logger.Printf("Loaded SSTable from %s", filePath)
+		files = append(files, fileEntry{table: table, modTime: info.ModTime()})
+		l.seq = max(l.seq, table.maxSeq)
+	}
 
-		buf := new(bytes.Buffer)
-		_, err = buf.ReadFrom(f)
-		if err != nil {
-			return err
+	// deeper levels hold older data, so they come first. Within a level
+	// newer tables hold larger sequence numbers, tables written before
+	// those existed fall back to their modtime.
+	sort.Slice(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if a.table.level != b.table.level {
+			return a.table.level > b.table.level
 		}
-		err = memtable.Load(buf, bloomFilter, sparseIndex, 5)
-		if err != nil {
-			return err
+		if a.table.maxSeq != b.table.maxSeq {
+			return a.table.maxSeq < b.table.maxSeq
 		}
+		return a.modTime.Before(b.modTime)
+	})
 
-		fmt.Printf("Loaded SSTable from %s\n", filePath)
-		l.SStables = append(l.SStables, &SSTable{
-			dataLocation: f.Name(),
-			dataLength:   buf.Len(),
-			sparseIndex:  sparseIndex,
-			bloomfilter:  bloomFilter,
-		})
+	for _, e := range files {
+		l.SStables = append(l.SStables, e.table)
 	}
 
-	fmt.Printf("Loaded %d SStables", len(files))
-
 	return nil
 }
 
+// levelFromFileName reads the level suffix compaction puts on its
+// output tables, flushed tables don't have one and live in level 0.
+func levelFromFileName(name string) int {
+	_, suffix, found := strings.Cut(strings.TrimPrefix(name, "sstable_"), "_L")
+	if !found {
+		return 0
+	}
+	level, err := strconv.Atoi(suffix)
+	if err != nil {
+		return 0
+	}
+	return level
+}
+
+// newMemTable returns an empty memtable. Skip lists let readers in
+// while a write is in progress.
+func newMemTable() *memtable.MemTable {
+	return memtable.NewMemTable(memtable.NewSkipList())
+}
+
+// setKeyRange records the user key range of the entries.
+func (t *SSTable) setKeyRange(entries []*memtable.Entry) {
+	if len(entries) == 0 {
+		return
+	}
+	t.minKey = userKey(entries[0].Key)
+	t.maxKey = userKey(entries[len(entries)-1].Key)
+}
+
+// extendKeyRange widens the key range to the range tombstones. Their end
+// keys aren't deleted, but counting them keeps the range simple.
+func (t *SSTable) extendKeyRange() {
+	if len(t.rangeDels) == 0 {
+		return
+	}
+	start, end := t.rangeDels[0].start, t.rangeDels[len(t.rangeDels)-1].end
+	if t.minKey == nil || start.Compare(t.minKey) < 0 {
+		t.minKey = start
+	}
+	if t.maxKey == nil || end.Compare(t.maxKey) > 0 {
+		t.maxKey = end
+	}
+}
+
 func (l *LSM) Get(key interfaces.Comparable) (bool, []byte, error) {
-	found, val := l.memtable.Get(key)
-	if found {
-		if bytes.Equal(val, TOMBSTONE) {
-			return false, nil, nil
+	l.mu.RLock()
+	return l.getAt(key, l.seq)
+}
+
+// memGet returns the newest version of key visible at seq, or nil.
+func memGet(mem *memtable.MemTable, key interfaces.Comparable, seq uint64) *memtable.Entry {
+	entry := mem.Seek(newInternalKey(key, seq))
+	if entry == nil || userKey(entry.Key).Compare(key) != 0 {
+		return nil
+	}
+	return entry
+}
+
+// memtables returns the memtable and the immutable ones, newest first.
+// The caller must hold l.mu.
+func (l *LSM) memtables() []*memtable.MemTable {
+	mems := []*memtable.MemTable{l.memtable}
+	for i := len(l.immutables) - 1; i >= 0; i-- {
+		mems = append(mems, l.immutables[i].mem)
+	}
+	return mems
+}
+
+// getAt reads key as of seq, the caller must hold l.mu for reading.
+// It is released before anything is read, the memtables are skip lists
+// that writers only ever add to.
+func (l *LSM) getAt(key interfaces.Comparable, seq uint64) (bool, []byte, error) {
+	if l.closed {
+		l.mu.RUnlock()
+		return false, nil, ErrClosed
+	}
+	mems := l.memtables()
+	tables := l.refTables()
+	rows := l.rowCache
+	op := l.mergeOperator
+	l.mu.RUnlock()
+	defer unrefTables(tables)
+
+	at := now()
+	cover := rangeCover(key, seq, mems, tables)
+	for _, mem := range mems {
+		if entry := readEntry(memGet(mem, key, seq), at, cover); entry != nil {
+			switch entry.Kind {
+			case memtable.KindDeletion:
+				return false, nil, nil
+			case memtable.KindMerge:
+				value, err := getMerged(op, key, seq, at, cover, mems, tables)
+				return err == nil, value, err
+			}
+			return true, entry.Value, nil
 		}
-		return true, val, nil
 	}
-	for i := len(l.SStables) - 1; i >= 0; i-- {
-		SSTable := *l.SStables[i]
-		found, data, err := SSTable.Find(key)
+
+	for i := len(tables) - 1; i >= 0; i-- {
+		SSTable := tables[i]
+		entry, err := SSTable.findCached(rows, key, seq)
 		if err != nil {
 			return false, nil, err
 		}
-		if found {
-			return true, data, nil
+		if entry = readEntry(entry, at, cover); entry != nil {
+			if entry.Kind == memtable.KindMerge {
+				value, err := getMerged(op, key, seq, at, cover, mems, tables)
+				return err == nil, value, err
+			}
+			return true, entry.Value, nil
 		}
 	}
 	return false, nil, nil
 }
 
-func (l *LSM) writeSSTableData(buf bytes.Buffer) (string, error) {
-	fileName := filepath.Join(l.dataPath, fmt.Sprintf("sstable_%d", time.Now().UnixNano()))
-	f, err := os.Create(fileName)
-	if err != nil {
-		fmt.Println("Error creating file:", err)
-		return "", err
+// nextFileNumber returns the number of a new table file, the current
+// time in nanoseconds unless an earlier call already took it.
+func (l *LSM) nextFileNumber() uint64 {
+	for {
+		last := l.lastFileNumber.Load()
+		number := max(uint64(time.Now().UnixNano()), last+1)
+		if l.lastFileNumber.CompareAndSwap(last, number) {
+			return number
+		}
+	}
+}
+
+func (l *LSM) writeSSTableData(buf bytes.Buffer, level int) (string, error) {
+	// flushes and compactions write tables at the same time, a file that
+	// already exists is never opened again.
+	var fileName string
+	var f *os.File
+	var err error
+	for {
+		fileName = filepath.Join(l.dataPath, fmt.Sprintf("sstable_%d", l.nextFileNumber()))
+		if level > 0 {
+			fileName += fmt.Sprintf("_L%d", level)
+		}
+		f, err = os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			l.logger.Printf("Error creating file: %v", err)
+			return "", err
+		}
+		break
 	}
 	defer f.Close()
 
-	fmt.Println("Writing SSTable to:", fileName)
+	l.logger.Printf("Writing SSTable to: %s", fileName)
 	_, err = f.Write(buf.Bytes())
 	if err != nil {
-		fmt.Println("Error creating file:", err)
+		l.logger.Printf("Error creating file: %v", err)
+		return "", err
+	}
+
+	// the wal segment gets removed right after this, so the table
+	// has to be on disk before that.
+	err = f.Sync()
+	if err != nil {
 		return "", err
 	}
 
@@ -157,69 +546,118 @@ func (l *LSM) writeSSTableData(buf bytes.Buffer) (string, error) {
 }
 
 func (l *LSM) Put(key interfaces.Comparable, val []byte) error {
-	if l.memtable.Size() >= l.threshold {
-		buf := new(bytes.Buffer)
-		sparseIndex := memtable.NewAVLTree()
-		bloomFilter := bloomfilter.NewBloomFilter(l.threshold, l.falsePositiveRate)
+	batch := NewWriteBatch()
+	batch.Put(key, val)
+	return l.Write(batch)
+}
 
-		err := l.memtable.Dump(buf, bloomFilter, sparseIndex, int32(l.sparsityFactor))
-		if err != nil {
-			return err
-		}
+// writeSSTable dumps the memtable into a new table file.
+func (l *LSM) writeSSTable(mem *memtable.MemTable, level int) (*SSTable, error) {
+	return l.writeTable(mem.Entries(), fragmentTombstones(memTombstones(mem)), level)
+}
 
-		fileName, err := l.writeSSTableData(*buf)
-		if err != nil {
-			return err
-		}
+// writeTable writes sorted entries and range tombstones into a new
+// table file.
+func (l *LSM) writeTable(entries []*memtable.Entry, dels rangeFragments, level int) (*SSTable, error) {
+	bloomFilter := bloomfilter.NewBloomFilter(max(uint32(len(entries)), 1), l.falsePositiveRate)
 
-		l.SStables = append(l.SStables, &SSTable{
-			dataLocation: fileName,
-			dataLength:   buf.Len(),
-			sparseIndex:  sparseIndex,
-			bloomfilter:  bloomFilter,
-		})
+	l.mu.RLock()
+	compressor := l.compressor
+	l.mu.RUnlock()
 
+	buf, table, err := buildTable(entries, dels, bloomFilter, compressor)
+	if err != nil {
+		return nil, err
 	}
-	l.memtable.Put(key, val)
-	return nil
+
+	fileName, err := l.writeSSTableData(*buf, level)
+	if err != nil {
+		return nil, err
+	}
+
+	table.dataLocation = fileName
+	table.level = level
+	table.refs.Store(1)
+	l.setupTable(table)
+	return table, nil
 }
 
-func (l *LSM) Delete(key interfaces.Comparable) {
-	l.Put(key, TOMBSTONE)
+func (l *LSM) Delete(key interfaces.Comparable) error {
+	batch := NewWriteBatch()
+	batch.Delete(key)
+	return l.Write(batch)
 }
 
 func (t *SSTable) readSSTableData(lowerBound uint32, upperBound uint32) (*bytes.Reader, error) {
 	buffer := make([]byte, upperBound-lowerBound)
-	f, err := os.Open(t.dataLocation)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	_, err = f.Seek(int64(lowerBound), io.SeekStart)
+	h, err := t.files.acquire(t)
 	if err != nil {
 		return nil, err
 	}
+	defer t.files.release(h)
 
-	_, err = f.Read(buffer)
-	if err != nil {
+	_, err = h.ReadAt(buffer, int64(lowerBound))
+	if err != nil && err != io.EOF {
 		return nil, err
 	}
 
 	return bytes.NewReader(buffer), nil
 }
 
+// Find returns the newest version of key in the table.
 func (t *SSTable) Find(key interfaces.Comparable) (bool, []byte, error) {
-	found, err := t.bloomfilter.Contains(key)
-	if err != nil {
+	entry, err := t.findAt(key, math.MaxUint64)
+	if err != nil || entry == nil {
 		return false, nil, err
 	}
+	return true, entry.Value, nil
+}
+
+// findAt returns the newest version of key written at or before seq,
+// nil if the table has none.
+func (t *SSTable) findAt(key interfaces.Comparable, seq uint64) (*memtable.Entry, error) {
+	filter, err := t.filter()
+	if err != nil {
+		return nil, err
+	}
+	found, err := filter.Contains(key)
+	if err != nil {
+		return nil, err
+	}
 	if !found {
-		return false, nil, nil
+		return nil, nil
 	}
+	return t.find(key, seq)
+}
 
-	lowerBound, _ := util.ParseInt32(bytes.NewReader(t.sparseIndex.Floor(key)))
-	upperBound, _ := util.ParseInt32(bytes.NewReader(t.sparseIndex.Ceil(key)))
+// find is findAt without the bloom filter check.
+func (t *SSTable) find(key interfaces.Comparable, seq uint64) (*memtable.Entry, error) {
+	if t.version > 0 {
+		entry, err := t.findInBlock(newInternalKey(key, seq))
+		if entry != nil && entry.Kind == memtable.KindDeletion {
+			entry.Value = nil
+		}
+		return entry, err
+	}
+	found, value, err := t.findLegacy(key)
+	if err != nil || !found {
+		return nil, err
+	}
+	if value == nil {
+		return &memtable.Entry{Key: key, Kind: memtable.KindDeletion}, nil
+	}
+	return &memtable.Entry{Key: key, Kind: memtable.KindValue, Value: value}, nil
+}
+
+// findLegacy scans the version 0 data section between the sparse index
+// entries around key.
+func (t *SSTable) findLegacy(key interfaces.Comparable) (bool, []byte, error) {
+	index, err := t.index()
+	if err != nil {
+		return false, nil, err
+	}
+	lowerBound, _ := util.ParseInt32(bytes.NewReader(index.Floor(key)))
+	upperBound, _ := util.ParseInt32(bytes.NewReader(index.Ceil(key)))
 	if lowerBound == 0 {
 		return false, nil, nil
 	}
@@ -251,7 +689,7 @@ func (t *SSTable) Find(key interfaces.Comparable) (bool, []byte, error) {
 		}
 
 		if key.Compare(parsed_key) == 0 {
-			if bytes.Equal(valueBytes, TOMBSTONE) {
+			if bytes.Equal(valueBytes, legacyTombstone) {
 				return true, nil, nil
 			}
 			return true, valueBytes, nil
@@ -1,16 +1,60 @@
 package lsmtree
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"main/compression"
 	"main/keys"
+	"main/wal"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+// useTempDataDir points NewLSMTree at an empty data directory so tests
+// don't pick up each other's SSTables and WAL segments.
+func useTempDataDir(tb testing.TB) {
+	dir := tb.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "data"), 0755); err != nil {
+		tb.Fatal(err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.Chdir(cwd) })
+}
+
+// newTestLSM opens an LSM that is closed before the test's data
+// directory is removed.
+func newTestLSM(tb testing.TB, threshold uint32, sparsityFactor uint32, falsePositiveRate float64, compaction CompactionStrategy) *LSM {
+	lsm := NewLSMTree(threshold, sparsityFactor, falsePositiveRate, compaction)
+	tb.Cleanup(func() { lsm.Close() })
+	return lsm
+}
+
+// crash stops lsm the way a killed process would: nothing gets flushed,
+// its files are just let go so the directory can be opened again.
+func crash(lsm *LSM) {
+	lsm.stopBackgroundWork()
+	lsm.mu.Lock()
+	lsm.closed = true
+	lsm.mu.Unlock()
+	lsm.release(false)
+}
+
 func TestLSMTree(t *testing.T) {
-	lsm := NewLSMTree(10, 2, 0.01)
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 10, 2, 0.01, nil)
 	key := keys.NewStringKey("foo")
 	value := []byte("bar")
 	err := lsm.Put(key, value)
@@ -33,7 +77,8 @@ func TestLSMTree(t *testing.T) {
 
 func TestMaintainTheLatestVersionOfKey(t *testing.T) {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	lsm := NewLSMTree(10, 10, 0.01)
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 10, 10, 0.01, nil)
 	n := 50
 	latest_val := ""
 	for i := range n {
@@ -54,7 +99,8 @@ func TestMaintainTheLatestVersionOfKey(t *testing.T) {
 }
 
 func TestMaintainLatestVersionWithCompaction(t *testing.T) {
-	lsm := NewLSMTree(10, 2, 0.01)
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 10, 2, 0.01, nil)
 	testKey := keys.NewStringKey("test-key")
 	latestValue := ""
 	for i := range 100 {
@@ -81,7 +127,8 @@ func TestMaintainLatestVersionWithCompaction(t *testing.T) {
 }
 
 func TestLSMTreeBulkRandom(t *testing.T) {
-	lsm := NewLSMTree(50, 3, 0.01)
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 50, 3, 0.01, nil)
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	n := 20000
 	keyToValue := make(map[int]string)
@@ -111,13 +158,18 @@ func TestLSMTreeBulkRandom(t *testing.T) {
 }
 
 func TestDeleteMultipleKeysAndCheckNil(t *testing.T) {
-	lsm := NewLSMTree(5, 3, 0.01)
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 5, 3, 0.01, nil)
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	n := 20
 	keyToValue := make(map[int]string)
 	keysArr := make([]int, n)
 	for i := range n {
 		s := r.Intn(1000)
+		// a key drawn twice would end up in both the deleted and kept halves.
+		for keyToValue[s] != "" {
+			s = r.Intn(1000)
+		}
 		keysArr[i] = s
 		val := "val_" + strconv.Itoa(i)
 		keyToValue[s] = val
@@ -154,7 +206,8 @@ func TestDeleteMultipleKeysAndCheckNil(t *testing.T) {
 }
 
 func BenchmarkLSMTreePutGet(b *testing.B) {
-	lsm := NewLSMTree(1000, 10, 0.01)
+	useTempDataDir(b)
+	lsm := newTestLSM(b, 1000, 10, 0.01, nil)
 	n := 100000
 	for i := 0; i < n; i++ {
 		key := keys.NewIntKey(uint32(i))
@@ -176,3 +229,359 @@ func BenchmarkLSMTreePutGet(b *testing.B) {
 		}
 	}
 }
+
+func TestRecoverFromWAL(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 10, 2, 0.01, nil)
+	n := 25
+	for i := range n {
+		err := lsm.Put(keys.NewIntKey(uint32(i)), []byte("val_"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("Put failed at %d: %v", i, err)
+		}
+	}
+	lsm.Delete(keys.NewIntKey(3))
+	lsm.Delete(keys.NewIntKey(24))
+
+	// simulate a crash: the memtable is never flushed, a new instance
+	// on the same directory has to rebuild it from the log.
+	crash(lsm)
+	recovered := newTestLSM(t, 10, 2, 0.01, nil)
+	for i := range n {
+		found, got, err := recovered.Get(keys.NewIntKey(uint32(i)))
+		if err != nil {
+			t.Fatalf("Get failed for key %d: %v", i, err)
+		}
+		if i == 3 || i == 24 {
+			if found && got != nil {
+				t.Errorf("Expected nil for deleted key '%d', got '%s'", i, string(got))
+			}
+			continue
+		}
+		want := "val_" + strconv.Itoa(i)
+		if !found || string(got) != want {
+			t.Errorf("Expected value '%s' for key '%d', got '%s'", want, i, string(got))
+		}
+	}
+}
+
+func TestTombstoneByteIsAValue(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 10, 2, 0.01, nil)
+	n := 25
+	for i := range n {
+		if err := lsm.Put(keys.NewIntKey(uint32(i)), []byte{0x7f}); err != nil {
+			t.Fatalf("Put failed at %d: %v", i, err)
+		}
+	}
+	lsm.Delete(keys.NewIntKey(3))
+
+	check := func(lsm *LSM) {
+		t.Helper()
+		for i := range n {
+			found, got, err := lsm.Get(keys.NewIntKey(uint32(i)))
+			if err != nil {
+				t.Fatalf("Get failed for key %d: %v", i, err)
+			}
+			if i == 3 {
+				if found && got != nil {
+					t.Errorf("Expected key 3 to be deleted, got %x", got)
+				}
+				continue
+			}
+			if !found || !bytes.Equal(got, []byte{0x7f}) {
+				t.Errorf("Expected 7f for key %d, got %v, %x", i, found, got)
+			}
+		}
+
+		entries, err := lsm.Scan(nil, nil)
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if len(entries) != n-1 {
+			t.Errorf("Expected %d live keys, got %d", n-1, len(entries))
+		}
+	}
+
+	// from the memtables, the tables, and after a restart with part of
+	// it in the WAL.
+	check(lsm)
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	check(lsm)
+	crash(lsm)
+	check(newTestLSM(t, 10, 2, 0.01, nil))
+}
+
+func TestWALSegmentsRemovedAfterFlush(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 5, 2, 0.01, nil)
+	for i := range 23 {
+		err := lsm.Put(keys.NewIntKey(uint32(i)), []byte("val_"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("Put failed at %d: %v", i, err)
+		}
+	}
+
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	segments, err := lsm.walSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Errorf("Expected only the active wal segment to remain, got %v", segments)
+	}
+}
+
+// logRecorder keeps what the LSM logs.
+type logRecorder struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (r *logRecorder) Printf(format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, fmt.Sprintf(format, args...))
+}
+
+func (r *logRecorder) contains(prefix string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, line := range r.lines {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOpenAndClose(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	logger := &logRecorder{}
+	lsm, err := Open(dir, WithThreshold(1000), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for i := range 100 {
+		if err := lsm.Put(keys.NewIntKey(uint32(i)), []byte("val_"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Put failed at %d: %v", i, err)
+		}
+	}
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := lsm.Close(); err != nil {
+		t.Errorf("Expected a second Close to do nothing, got %v", err)
+	}
+	if err := lsm.Put(keys.NewIntKey(0), []byte("late")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected Put after Close to fail with ErrClosed, got %v", err)
+	}
+	if err := lsm.Delete(keys.NewIntKey(0)); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected Delete after Close to fail with ErrClosed, got %v", err)
+	}
+	if _, _, err := lsm.Get(keys.NewIntKey(0)); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected Get after Close to fail with ErrClosed, got %v", err)
+	}
+	if !logger.contains("Writing SSTable") {
+		t.Errorf("Expected the flush to go to the logger, got %v", logger.lines)
+	}
+
+	// Close flushed the memtable, nothing is left to replay.
+	lsm, err = Open(dir, WithLogger(logger))
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer lsm.Close()
+	if len(lsm.SStables) != 1 || lsm.memtable.Size() != 0 {
+		t.Errorf("Expected one table and an empty memtable, got %d tables and %d entries", len(lsm.SStables), lsm.memtable.Size())
+	}
+	if logger.contains("Replayed") {
+		t.Errorf("Expected no WAL segments to replay")
+	}
+	for i := range 100 {
+		want := "val_" + strconv.Itoa(i)
+		if found, got, err := lsm.Get(keys.NewIntKey(uint32(i))); err != nil || !found || string(got) != want {
+			t.Errorf("Expected %s for key %d, got %s, %v", want, i, got, err)
+		}
+	}
+}
+
+func TestCloseWakesStalledWriter(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := Open(dir, WithThreshold(1), WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	// the flusher blocks on the manifest, so the immutables pile up
+	// and the writer stalls.
+	lsm.manifestMu.Lock()
+	acked := make(chan int, 100)
+	done := make(chan error)
+	go func() {
+		for i := range 100 {
+			if err := lsm.Put(keys.NewIntKey(uint32(i)), []byte("val_"+strconv.Itoa(i))); err != nil {
+				done <- err
+				return
+			}
+			acked <- i
+		}
+		done <- nil
+	}()
+	stalled := func() bool {
+		lsm.mu.RLock()
+		defer lsm.mu.RUnlock()
+		return len(lsm.immutables) >= maxImmutableMemtables && lsm.memtableFull()
+	}
+	for !stalled() {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan error)
+	go func() { closed <- lsm.Close() }()
+	for {
+		lsm.mu.RLock()
+		isClosed := lsm.closed
+		lsm.mu.RUnlock()
+		if isClosed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	lsm.manifestMu.Unlock()
+
+	if err := <-done; !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected the stalled writer to fail with ErrClosed, got %v", err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	close(acked)
+
+	// every acknowledged write made it to disk.
+	lsm, err = Open(dir, WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer lsm.Close()
+	for i := range acked {
+		want := "val_" + strconv.Itoa(i)
+		if found, got, err := lsm.Get(keys.NewIntKey(uint32(i))); err != nil || !found || string(got) != want {
+			t.Errorf("Expected %s for key %d, got %s, %v", want, i, got, err)
+		}
+	}
+}
+
+func TestOpenLocksDirectory(t *testing.T) {
+	dir := t.TempDir()
+	first, err := Open(dir, WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if _, err := Open(dir, WithLogger(&logRecorder{})); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected a second Open to fail with ErrLocked, got %v", err)
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	second, err := Open(dir, WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Expected Open to succeed after Close, got %v", err)
+	}
+	second.Close()
+}
+
+func TestOpenOptions(t *testing.T) {
+	manager := NewWriteBufferManager(1 << 20)
+	policy := wal.SyncPolicy{Mode: wal.SyncEveryWrite}
+	lsm, err := Open(t.TempDir(),
+		WithThreshold(7),
+		WithWriteBufferSize(1<<10),
+		WithWriteBufferManager(manager),
+		WithSparsityFactor(3),
+		WithFalsePositiveRate(0.2),
+		WithCompressor(compression.Flate{Level: 1}),
+		WithCompactionStrategy(NewLeveledStrategy()),
+		WithSyncPolicy(policy),
+		WithLogger(&logRecorder{}),
+	)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer lsm.Close()
+
+	if lsm.threshold != 7 || lsm.writeBufferSize != 1<<10 || lsm.sparsityFactor != 3 || lsm.falsePositiveRate != 0.2 {
+		t.Errorf("Expected the size options to be applied, got %d, %d, %d, %v", lsm.threshold, lsm.writeBufferSize, lsm.sparsityFactor, lsm.falsePositiveRate)
+	}
+	if _, ok := lsm.compressor.(compression.Flate); !ok {
+		t.Errorf("Expected the flate compressor, got %T", lsm.compressor)
+	}
+	if _, ok := lsm.compaction.(*LeveledStrategy); !ok {
+		t.Errorf("Expected leveled compaction, got %T", lsm.compaction)
+	}
+	if lsm.syncPolicy != policy {
+		t.Errorf("Expected sync policy %v, got %v", policy, lsm.syncPolicy)
+	}
+
+	if err := lsm.Put(keys.NewIntKey(1), []byte("one")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if manager.MemoryUsage() != lsm.memtable.ApproximateMemoryUsage() {
+		t.Errorf("Expected the memtable to count against the manager, got %d and %d", manager.MemoryUsage(), lsm.memtable.ApproximateMemoryUsage())
+	}
+}
+
+func TestConcurrentPutGet(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 20, 3, 0.01, nil)
+	writers, perWriter := 8, 300
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				key := keys.NewIntKey(uint32(w*perWriter + i))
+				if err := lsm.Put(key, []byte("val_"+strconv.Itoa(w*perWriter+i))); err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+				// read back something another writer may be flushing.
+				if _, _, err := lsm.Get(keys.NewIntKey(uint32(i))); err != nil {
+					t.Errorf("Get failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 20 {
+			if _, err := lsm.Scan(nil, nil); err != nil {
+				t.Errorf("Scan failed: %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	for i := range writers * perWriter {
+		found, got, err := lsm.Get(keys.NewIntKey(uint32(i)))
+		if err != nil {
+			t.Fatalf("Get failed for key %d: %v", i, err)
+		}
+		if !found || string(got) != "val_"+strconv.Itoa(i) {
+			t.Errorf("Expected value 'val_%d' for key '%d', got '%s'", i, i, string(got))
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package lsmtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"main/interfaces"
+	"main/keys"
+	"main/util"
+	"main/wal"
+)
+
+/*
+ * The MANIFEST is the source of truth for which tables make up the tree
+ * and in what order. It is a log of version edits framed like the WAL
+ * (see the wal package), each edit is applied on top of the previous
+ * ones with installTables. CURRENT holds the name of the live manifest
+ * and is replaced atomically with a rename.
+ *
+ * A new manifest starts with an edit adding every live table and the
+ * order of the key types (see the keys package), it gets written on
+ * startup and whenever the current one grows past maxManifestBytes.
+ * Opening a tree fails if the registered types no longer sort the way
+ * the manifest recorded.
+ *
+ * Version edit format, a list of tagged fields:
+ *   [1 byte]  - editLastSeq, followed by the last sequence number (uint64)
+ *   [1 byte]  - editRemoved, followed by:
+ *       [4 bytes] - File name length (uint32)
+ *       [N bytes] - File name
+ *   [1 byte]  - editAdded, followed by:
+ *       [4 bytes] - File name length (uint32)
+ *       [N bytes] - File name
+ *       [4 bytes] - Level (uint32)
+ *       [1 byte]  - 1 if a key range follows, 0 for an empty table
+ *       [N bytes] - Smallest user key (keys.ParseKey format)
+ *       [N bytes] - Largest user key (keys.ParseKey format)
+ *       [8 bytes] - Smallest sequence number (uint64)
+ *       [8 bytes] - Largest sequence number (uint64)
+ *   [1 byte]  - editKeyTypes, followed by:
+ *       [4 bytes] - Number of key types (uint32)
+ *       [N bytes] - Type bytes, in the order their keys sort
+ */
+
+const (
+	editLastSeq  byte = 0x01
+	editRemoved  byte = 0x02
+	editAdded    byte = 0x03
+	editKeyTypes byte = 0x04
+
+	currentFileName  = "CURRENT"
+	manifestPrefix   = "MANIFEST-"
+	maxManifestBytes = 4 << 20
+)
+
+type tableMeta struct {
+	name           string
+	level          int
+	minKey, maxKey interfaces.Comparable
+	minSeq, maxSeq uint64
+}
+
+type versionEdit struct {
+	lastSeq uint64
+	removed []string
+	added   []*tableMeta
+	// only set in the first edit of a manifest.
+	keyTypes []uint8
+}
+
+func metaOf(t *SSTable) *tableMeta {
+	return &tableMeta{
+		name:   filepath.Base(t.dataLocation),
+		level:  t.level,
+		minKey: t.minKey,
+		maxKey: t.maxKey,
+		minSeq: t.minSeq,
+		maxSeq: t.maxSeq,
+	}
+}
+
+func writeName(buf *bytes.Buffer, name string) {
+	binary.Write(buf, binary.BigEndian, uint32(len(name)))
+	buf.WriteString(name)
+}
+
+func readName(rd io.Reader) (string, error) {
+	length, err := util.ParseInt32(rd)
+	if err != nil {
+		return "", err
+	}
+	name := make([]byte, length)
+	if _, err := io.ReadFull(rd, name); err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+func (e *versionEdit) encode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(editLastSeq)
+	binary.Write(buf, binary.BigEndian, e.lastSeq)
+
+	for _, name := range e.removed {
+		buf.WriteByte(editRemoved)
+		writeName(buf, name)
+	}
+
+	for _, meta := range e.added {
+		buf.WriteByte(editAdded)
+		writeName(buf, meta.name)
+		binary.Write(buf, binary.BigEndian, uint32(meta.level))
+		if meta.minKey == nil {
+			buf.WriteByte(0)
+		} else {
+			buf.WriteByte(1)
+			for _, key := range []interfaces.Comparable{meta.minKey, meta.maxKey} {
+				keyBytes, err := key.ToBytes()
+				if err != nil {
+					return nil, fmt.Errorf("error serializing key range: %w", err)
+				}
+				buf.Write(keyBytes)
+			}
+		}
+		binary.Write(buf, binary.BigEndian, meta.minSeq)
+		binary.Write(buf, binary.BigEndian, meta.maxSeq)
+	}
+
+	if e.keyTypes != nil {
+		buf.WriteByte(editKeyTypes)
+		binary.Write(buf, binary.BigEndian, uint32(len(e.keyTypes)))
+		buf.Write(e.keyTypes)
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeVersionEdit(payload []byte) (*versionEdit, error) {
+	rd := bytes.NewReader(payload)
+	edit := &versionEdit{}
+	for rd.Len() > 0 {
+		tag, _ := rd.ReadByte()
+		switch tag {
+		case editLastSeq:
+			if err := binary.Read(rd, binary.BigEndian, &edit.lastSeq); err != nil {
+				return nil, fmt.Errorf("error parsing last sequence number: %w", err)
+			}
+		case editRemoved:
+			name, err := readName(rd)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing removed table: %w", err)
+			}
+			edit.removed = append(edit.removed, name)
+		case editAdded:
+			meta, err := decodeTableMeta(rd)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing added table: %w", err)
+			}
+			edit.added = append(edit.added, meta)
+		case editKeyTypes:
+			count, err := util.ParseInt32(rd)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing key types: %w", err)
+			}
+			edit.keyTypes = make([]uint8, count)
+			if _, err := io.ReadFull(rd, edit.keyTypes); err != nil {
+				return nil, fmt.Errorf("error parsing key types: %w", err)
+			}
+		default:
+			return nil, fmt.Errorf("unknown version edit field %d", tag)
+		}
+	}
+	return edit, nil
+}
+
+func decodeTableMeta(rd *bytes.Reader) (*tableMeta, error) {
+	name, err := readName(rd)
+	if err != nil {
+		return nil, err
+	}
+	level, err := util.ParseInt32(rd)
+	if err != nil {
+		return nil, err
+	}
+	meta := &tableMeta{name: name, level: int(level)}
+
+	hasRange, err := rd.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if hasRange == 1 {
+		if meta.minKey, err = keys.ParseKey(rd); err != nil {
+			return nil, err
+		}
+		if meta.maxKey, err = keys.ParseKey(rd); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := binary.Read(rd, binary.BigEndian, &meta.minSeq); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(rd, binary.BigEndian, &meta.maxSeq); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// installTables drops the removed tables and puts the added ones at
+// the position of the newest removed one, or at the end if nothing was
+// removed. Deeper levels stay in front. Replaying the manifest goes
+// through here as well, so the order on disk matches the one in memory.
+func installTables[T any](tables []T, removed func(T) bool, added []T, level func(T) int) []T {
+	position := -1
+	result := make([]T, 0, len(tables)+len(added))
+	for _, table := range tables {
+		if removed(table) {
+			position = len(result)
+			continue
+		}
+		result = append(result, table)
+	}
+	if position < 0 {
+		position = len(result)
+	}
+	result = slices.Insert(result, position, added...)
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return level(result[i]) > level(result[j])
+	})
+	return result
+}
+
+func readCurrent(dataPath string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dataPath, currentFileName))
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(name, manifestPrefix) {
+		return "", fmt.Errorf("CURRENT names %q, not a manifest", name)
+	}
+	return name, nil
+}
+
+// setCurrent points CURRENT at the manifest called name, readers see
+// either the old or the new content.
+func setCurrent(dataPath string, name string) error {
+	tmp := filepath.Join(dataPath, currentFileName+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(name + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dataPath, currentFileName)); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(dataPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// recoverManifest opens exactly the tables the manifest lists, in the
+// order it lists them.
+func (l *LSM) recoverManifest(name string) error {
+	number, err := strconv.ParseUint(strings.TrimPrefix(name, manifestPrefix), 10, 64)
+	if err != nil {
+		return fmt.Errorf("error parsing manifest number of %s: %w", name, err)
+	}
+	l.manifestNumber = number
+
+	var metas []*tableMeta
+	var keyTypes []uint8
+	path := filepath.Join(l.dataPath, name)
+	err = wal.Replay(path, func(payload []byte) error {
+		edit, err := decodeVersionEdit(payload)
+		if err != nil {
+			return fmt.Errorf("error replaying %s: %w", name, err)
+		}
+		removed := func(meta *tableMeta) bool {
+			for _, name := range edit.removed {
+				if meta.name == name {
+					return true
+				}
+			}
+			return false
+		}
+		metas = installTables(metas, removed, edit.added, func(meta *tableMeta) int { return meta.level })
+		l.seq = max(l.seq, edit.lastSeq)
+		if edit.keyTypes != nil {
+			keyTypes = edit.keyTypes
+		}
+		return nil
+	})
+	// an edit torn by a crash was never acknowledged.
+	if errors.Is(err, wal.ErrTornTail) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	// keys of several types would be out of order.
+	if err := keys.CheckTypeOrder(keyTypes); err != nil {
+		return fmt.Errorf("error opening %s: %w", name, err)
+	}
+
+	for _, meta := range metas {
+		filePath := filepath.Join(l.dataPath, meta.name)
+		table, err := l.openSSTable(filePath, meta.level)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("manifest %s lists missing sstable %s", name, meta.name)
+		}
+		if err != nil {
+			return err
+		}
+		table.minSeq = meta.minSeq
+		l.seq = max(l.seq, table.maxSeq)
+
+		l.logger.Printf("Loaded SSTable from %s", filePath)
+		l.SStables = append(l.SStables, table)
+	}
+	return nil
+}
+
+// reportOrphans lists table files the manifest doesn't know about, like
+// the output of a flush or compaction that crashed before logging it.
+// They are left alone.
+func (l *LSM) reportOrphans() error {
+	entries, err := os.ReadDir(l.dataPath)
+	if err != nil {
+		return err
+	}
+
+	live := make(map[string]bool, len(l.SStables))
+	for _, table := range l.SStables {
+		live[filepath.Base(table.dataLocation)] = true
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), "sstable_") || live[e.Name()] {
+			continue
+		}
+		l.logger.Printf("Ignoring orphan SSTable %s, it is not in the manifest", e.Name())
+	}
+	return nil
+}
+
+// rotateManifest starts a new manifest holding the current tables and
+// points CURRENT at it. The caller must hold l.manifestMu.
+func (l *LSM) rotateManifest() error {
+	number := l.manifestNumber + 1
+	name := fmt.Sprintf("%s%06d", manifestPrefix, number)
+	w, err := wal.Create(filepath.Join(l.dataPath, name), wal.SyncPolicy{Mode: wal.SyncEveryWrite})
+	if err != nil {
+		return err
+	}
+
+	l.mu.RLock()
+	edit := &versionEdit{lastSeq: l.seq, keyTypes: keys.TypeOrder()}
+	for _, table := range l.SStables {
+		edit.added = append(edit.added, metaOf(table))
+	}
+	l.mu.RUnlock()
+
+	payload, err := edit.encode()
+	if err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Append(payload); err != nil {
+		w.Close()
+		return err
+	}
+	if err := setCurrent(l.dataPath, name); err != nil {
+		w.Close()
+		return err
+	}
+
+	if l.manifest != nil {
+		old := l.manifest.Path()
+		if err := l.manifest.Close(); err != nil {
+			l.logger.Printf("Error closing manifest: %v", err)
+		}
+		if err := os.Remove(old); err != nil {
+			l.logger.Printf("Error removing manifest: %v", err)
+		}
+	} else if l.manifestNumber > 0 {
+		// the manifest recovered from on startup.
+		old := filepath.Join(l.dataPath, fmt.Sprintf("%s%06d", manifestPrefix, l.manifestNumber))
+		if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+			l.logger.Printf("Error removing manifest: %v", err)
+		}
+	}
+
+	l.manifest = w
+	l.manifestNumber = number
+	l.manifestBytes = len(payload)
+	return nil
+}
+
+// logAndApply records edit in the manifest and then runs apply under
+// l.mu, so the manifest and LSM.SStables change in the same order.
+func (l *LSM) logAndApply(edit *versionEdit, apply func()) error {
+	l.manifestMu.Lock()
+	defer l.manifestMu.Unlock()
+
+	l.mu.RLock()
+	edit.lastSeq = l.seq
+	l.mu.RUnlock()
+
+	payload, err := edit.encode()
+	if err != nil {
+		return err
+	}
+	if err := l.manifest.Append(payload); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	l.manifestBytes += len(payload)
+
+	l.mu.Lock()
+	apply()
+	l.mu.Unlock()
+
+	if l.manifestBytes > maxManifestBytes {
+		return l.rotateManifest()
+	}
+	return nil
+}
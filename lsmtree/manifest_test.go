@@ -0,0 +1,219 @@
+package lsmtree
+
+import (
+	"errors"
+	"main/keys"
+	"main/wal"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVersionEditRoundTrip(t *testing.T) {
+	edit := &versionEdit{
+		lastSeq: 42,
+		removed: []string{"sstable_1", "sstable_2_L1"},
+		added: []*tableMeta{
+			{name: "sstable_3_L1", level: 1, minKey: keys.NewIntKey(5), maxKey: keys.NewIntKey(90), minSeq: 3, maxSeq: 40},
+			{name: "sstable_4", level: 0},
+		},
+		keyTypes: []uint8{keys.IntKeyType, keys.StringKeyType},
+	}
+	payload, err := edit.encode()
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+
+	got, err := decodeVersionEdit(payload)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if got.lastSeq != 42 || len(got.removed) != 2 || got.removed[1] != "sstable_2_L1" || len(got.added) != 2 {
+		t.Fatalf("Decoded edit differs: %+v", got)
+	}
+	meta := got.added[0]
+	if meta.name != "sstable_3_L1" || meta.level != 1 || meta.minSeq != 3 || meta.maxSeq != 40 ||
+		meta.minKey.Compare(keys.NewIntKey(5)) != 0 || meta.maxKey.Compare(keys.NewIntKey(90)) != 0 {
+		t.Errorf("Decoded table differs: %+v", meta)
+	}
+	if got.added[1].minKey != nil {
+		t.Errorf("Expected the empty table to have no key range")
+	}
+	if !slices.Equal(got.keyTypes, edit.keyTypes) {
+		t.Errorf("Expected key types %v, got %v", edit.keyTypes, got.keyTypes)
+	}
+}
+
+func tableNames(lsm *LSM) []string {
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+	var names []string
+	for _, table := range lsm.SStables {
+		names = append(names, filepath.Base(table.dataLocation))
+	}
+	return names
+}
+
+func TestManifestRecoversTableOrder(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 10, 2, 0.01, nil)
+	want := fillWithOverwrites(t, lsm, 60)
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	crash(lsm)
+	order := tableNames(lsm)
+
+	// modtimes no longer matter, make the oldest table look the newest.
+	for i, name := range order {
+		modTime := time.Now().Add(-time.Duration(i) * time.Hour)
+		if err := os.Chtimes(filepath.Join(lsm.dataPath, name), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recovered := newTestLSM(t, 10, 2, 0.01, nil)
+	got := tableNames(recovered)
+	if strings.Join(got, ",") != strings.Join(order, ",") {
+		t.Errorf("Expected tables in order %v, got %v", order, got)
+	}
+	checkContent(t, recovered, 60, want)
+}
+
+func TestManifestIgnoresOrphanFiles(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 10, 2, 0.01, nil)
+	want := fillWithOverwrites(t, lsm, 30)
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	crash(lsm)
+
+	// a stray file with a table name and a table that was written but
+	// never logged, like after a crash in the middle of a flush.
+	if err := os.WriteFile(filepath.Join(lsm.dataPath, "sstable_1"), []byte("not a table"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	orphan, err := lsm.writeSSTable(fillMemTable(10), 0)
+	if err != nil {
+		t.Fatalf("writeSSTable failed: %v", err)
+	}
+
+	recovered := newTestLSM(t, 10, 2, 0.01, nil)
+	for _, name := range tableNames(recovered) {
+		if name == "sstable_1" || name == filepath.Base(orphan.dataLocation) {
+			t.Errorf("Expected orphan %s to be ignored", name)
+		}
+	}
+	checkContent(t, recovered, 30, want)
+}
+
+func TestManifestRotation(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 10, 2, 0.01, nil)
+	fillWithOverwrites(t, lsm, 30)
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	crash(lsm)
+
+	recovered := newTestLSM(t, 10, 2, 0.01, nil)
+	current, err := readCurrent(recovered.dataPath)
+	if err != nil {
+		t.Fatalf("readCurrent failed: %v", err)
+	}
+	if current != filepath.Base(recovered.manifest.Path()) {
+		t.Errorf("Expected CURRENT to name %s, got %s", recovered.manifest.Path(), current)
+	}
+	manifests, _ := filepath.Glob(filepath.Join(recovered.dataPath, manifestPrefix+"*"))
+	if len(manifests) != 1 {
+		t.Errorf("Expected the old manifest to be removed, found %v", manifests)
+	}
+}
+
+func TestManifestListsMissingTable(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 10, 2, 0.01, nil)
+	fillWithOverwrites(t, lsm, 30)
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	crash(lsm)
+
+	if err := os.Remove(lsm.SStables[0].dataLocation); err != nil {
+		t.Fatal(err)
+	}
+	recovered := &LSM{dataPath: lsm.dataPath, logger: lsm.logger}
+	if err := recovered.loadSSTables(lsm.dataPath); err == nil || !strings.Contains(err.Error(), "missing sstable") {
+		t.Errorf("Expected a missing table error, got %v", err)
+	}
+}
+
+func TestManifestChecksKeyTypeOrder(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 10, 2, 0.01, nil)
+	fillWithOverwrites(t, lsm, 30)
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	crash(lsm)
+	recovered := &LSM{dataPath: lsm.dataPath, logger: lsm.logger}
+	if err := recovered.loadSSTables(lsm.dataPath); err != nil {
+		t.Fatalf("Expected the recorded order to match, got %v", err)
+	}
+	recovered.manifest.Close()
+
+	// as if the tree was written while the types sorted the other way
+	// round.
+	order := keys.TypeOrder()
+	slices.Reverse(order)
+	payload, err := (&versionEdit{keyTypes: order}).encode()
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	w, err := wal.Create(filepath.Join(lsm.dataPath, "MANIFEST-000099"), wal.SyncPolicy{Mode: wal.SyncEveryWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(payload); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := setCurrent(lsm.dataPath, "MANIFEST-000099"); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered = &LSM{dataPath: lsm.dataPath, logger: lsm.logger}
+	if err := recovered.loadSSTables(lsm.dataPath); !errors.Is(err, keys.ErrTypeOrder) {
+		t.Errorf("Expected ErrTypeOrder, got %v", err)
+	}
+}
+
+func TestStoreWithoutManifestIsUpgraded(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 10, 2, 0.01, nil)
+	want := fillWithOverwrites(t, lsm, 30)
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	crash(lsm)
+
+	// a store from before the manifest only has its tables.
+	os.Remove(filepath.Join(lsm.dataPath, currentFileName))
+	os.Remove(lsm.manifest.Path())
+
+	recovered := newTestLSM(t, 10, 2, 0.01, nil)
+	if _, err := readCurrent(recovered.dataPath); err != nil {
+		t.Errorf("Expected a manifest to be written, got %v", err)
+	}
+	if len(recovered.SStables) != len(lsm.SStables) {
+		t.Errorf("Expected %d tables, got %d", len(lsm.SStables), len(recovered.SStables))
+	}
+	checkContent(t, recovered, 30, want)
+}
@@ -0,0 +1,250 @@
+package lsmtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"main/interfaces"
+	"main/memtable"
+)
+
+/*
+ * Merge writes an operand instead of a value, an entry of KindMerge.
+ * Nothing is read when it is written. Reads collect the operands of a
+ * key from newest to oldest until they reach a value, a deletion or
+ * the oldest version, then the MergeOperator of the tree applies them
+ * oldest first to whatever value was underneath.
+ *
+ * Flushes and compactions do the same for the versions every snapshot
+ * sees, so chains of operands don't pile up on disk. When the value
+ * under the operands is in another table the operands are combined
+ * into one with PartialMerge instead, if the operator can do that.
+ */
+
+// ErrNoMergeOperator is returned for merges, and reads of merged keys,
+// on an LSM opened without a merge operator.
+var ErrNoMergeOperator = errors.New("no merge operator configured")
+
+type MergeOperator interface {
+	// Name shows up in errors.
+	Name() string
+	// FullMerge applies operands, oldest first, to existing, which is
+	// nil if the key has no value.
+	FullMerge(existing []byte, operands [][]byte) ([]byte, error)
+	// PartialMerge combines operands, oldest first, into a single one.
+	// ok is false if that takes the value underneath them.
+	PartialMerge(operands [][]byte) (merged []byte, ok bool)
+}
+
+// Merge queues operand for key, operand is copied so the caller may
+// reuse it.
+func (b *WriteBatch) Merge(key interfaces.Comparable, operand []byte) {
+	b.ops = append(b.ops, batchOp{key: key, kind: memtable.KindMerge, value: bytes.Clone(operand)})
+}
+
+func (b *WriteBatch) hasMerge() bool {
+	return slices.ContainsFunc(b.ops, func(op batchOp) bool { return op.kind == memtable.KindMerge })
+}
+
+// Merge combines operand with the current value of key, see
+// WithMergeOperator.
+func (l *LSM) Merge(key interfaces.Comparable, operand []byte) error {
+	batch := NewWriteBatch()
+	batch.Merge(key, operand)
+	return l.Write(batch)
+}
+
+// mergeChain collects the versions of a key, newest first, down to the
+// first value or deletion.
+type mergeChain struct {
+	// newest first.
+	operands [][]byte
+	base     []byte
+	// a value or deletion ended the chain.
+	done bool
+}
+
+// add takes the next older version, it reports whether older versions
+// are still needed.
+func (c *mergeChain) add(kind memtable.EntryKind, value []byte) bool {
+	if kind == memtable.KindMerge {
+		c.operands = append(c.operands, value)
+		return true
+	}
+	if kind == memtable.KindValue {
+		c.base = value
+	}
+	c.done = true
+	return false
+}
+
+func (c *mergeChain) value(op MergeOperator) ([]byte, error) {
+	operands := slices.Clone(c.operands)
+	slices.Reverse(operands)
+	return fullMerge(op, c.base, operands)
+}
+
+// fullMerge is op.FullMerge with operands oldest first.
+func fullMerge(op MergeOperator, existing []byte, operands [][]byte) ([]byte, error) {
+	if op == nil {
+		return nil, ErrNoMergeOperator
+	}
+	value, err := op.FullMerge(existing, operands)
+	if err != nil {
+		return nil, fmt.Errorf("error merging with %s: %w", op.Name(), err)
+	}
+	return value, nil
+}
+
+// getMerged reads key as of seq once the newest version turned out to
+// be a merge operand, walking every version down to the first value or
+// deletion. Values that expired by at count as deletions, so do versions
+// older than the range tombstone cover.
+func getMerged(op MergeOperator, key interfaces.Comparable, seq uint64, at time.Time, cover uint64, mems []*memtable.MemTable, tables []*SSTable) ([]byte, error) {
+	var chain mergeChain
+	add := func(entry *memtable.Entry) bool {
+		entry = readEntry(entry, at, cover)
+		return chain.add(entry.Kind, entry.Value)
+	}
+	for _, mem := range mems {
+		it := mem.NewIterator()
+		for it.Seek(newInternalKey(key, seq)); it.Valid() && userKey(it.Key()).Compare(key) == 0; it.Next() {
+			if !add(&memtable.Entry{Key: it.Key(), Kind: it.Kind(), Value: it.Value()}) {
+				return chain.value(op)
+			}
+		}
+	}
+
+	for i := len(tables) - 1; i >= 0 && !chain.done; i-- {
+		if !tables[i].mayContain(key) {
+			continue
+		}
+		// version 0 tables hold a single version of every key and no
+		// block index to walk.
+		if tables[i].version == 0 {
+			entry, err := tables[i].find(key, seq)
+			if err != nil {
+				return nil, err
+			}
+			if entry != nil {
+				add(entry)
+			}
+			continue
+		}
+		err := tables[i].versions(newInternalKey(key, seq), add)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return chain.value(op)
+}
+
+// mergeOperands folds versions, newest first and starting with a merge
+// operand, into as few entries as op allows. bottommost tells that no
+// older versions exist outside versions.
+func mergeOperands(versions []*memtable.Entry, bottommost bool, op MergeOperator, at time.Time) []*memtable.Entry {
+	var chain mergeChain
+	n := 0
+	for n < len(versions) && chain.add(liveEntry(versions[n].Kind, versions[n].Value, at)) {
+		n++
+	}
+	// versions older than the value or deletion are shadowed.
+	needed := versions[:min(n+1, len(versions))]
+	if op == nil {
+		return needed
+	}
+
+	// merged into a value that expires the result would outlive it, the
+	// operands stay on top of it instead.
+	expiring := chain.done && chain.base != nil && versions[n].Kind == memtable.KindExpiringValue
+	newest := versions[0].Key
+	if (chain.done || bottommost) && !expiring {
+		if value, err := chain.value(op); err == nil {
+			return []*memtable.Entry{{Key: newest, Kind: memtable.KindValue, Value: value}}
+		}
+		// reads run into the same error, the versions are kept for
+		// them to report it.
+		return needed
+	}
+
+	operands := slices.Clone(chain.operands)
+	slices.Reverse(operands)
+	if merged, ok := op.PartialMerge(operands); ok {
+		return append([]*memtable.Entry{{Key: newest, Kind: memtable.KindMerge, Value: merged}}, needed[n:]...)
+	}
+	return needed
+}
+
+// UInt64AddOperator adds up big endian uint64 operands, wrapping
+// around on overflow. A missing value counts as 0.
+type UInt64AddOperator struct{}
+
+func (UInt64AddOperator) Name() string { return "uint64add" }
+
+func (UInt64AddOperator) FullMerge(existing []byte, operands [][]byte) ([]byte, error) {
+	var sum uint64
+	if existing != nil {
+		if len(existing) != 8 {
+			return nil, fmt.Errorf("existing value has %d bytes, expected 8", len(existing))
+		}
+		sum = binary.BigEndian.Uint64(existing)
+	}
+	for _, operand := range operands {
+		if len(operand) != 8 {
+			return nil, fmt.Errorf("operand has %d bytes, expected 8", len(operand))
+		}
+		sum += binary.BigEndian.Uint64(operand)
+	}
+	return binary.BigEndian.AppendUint64(nil, sum), nil
+}
+
+func (o UInt64AddOperator) PartialMerge(operands [][]byte) ([]byte, bool) {
+	merged, err := o.FullMerge(nil, operands)
+	return merged, err == nil
+}
+
+// StringAppendOperator appends the operands to the value, with
+// Delimiter between them.
+type StringAppendOperator struct {
+	Delimiter string
+}
+
+func (StringAppendOperator) Name() string { return "stringappend" }
+
+func (o StringAppendOperator) FullMerge(existing []byte, operands [][]byte) ([]byte, error) {
+	parts := operands
+	if existing != nil {
+		parts = append([][]byte{existing}, operands...)
+	}
+	return bytes.Join(parts, []byte(o.Delimiter)), nil
+}
+
+func (o StringAppendOperator) PartialMerge(operands [][]byte) ([]byte, bool) {
+	return bytes.Join(operands, []byte(o.Delimiter)), true
+}
+
+// MaxOperator keeps the largest of the value and the operands,
+// comparing them as byte strings. Big endian numbers of the same width
+// compare the same way.
+type MaxOperator struct{}
+
+func (MaxOperator) Name() string { return "max" }
+
+func (o MaxOperator) FullMerge(existing []byte, operands [][]byte) ([]byte, error) {
+	largest := existing
+	for _, operand := range operands {
+		if largest == nil || bytes.Compare(operand, largest) > 0 {
+			largest = operand
+		}
+	}
+	return largest, nil
+}
+
+func (o MaxOperator) PartialMerge(operands [][]byte) ([]byte, bool) {
+	merged, _ := o.FullMerge(nil, operands)
+	return merged, true
+}
@@ -0,0 +1,245 @@
+package lsmtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"main/interfaces"
+	"main/keys"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func u64(n uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
+
+func TestMergeOperators(t *testing.T) {
+	tests := []struct {
+		op       MergeOperator
+		existing []byte
+		operands [][]byte
+		want     string
+	}{
+		{UInt64AddOperator{}, nil, [][]byte{u64(1), u64(2)}, string(u64(3))},
+		{UInt64AddOperator{}, u64(10), [][]byte{u64(5)}, string(u64(15))},
+		{StringAppendOperator{Delimiter: ","}, nil, [][]byte{[]byte("a"), []byte("b")}, "a,b"},
+		{StringAppendOperator{Delimiter: ","}, []byte("x"), [][]byte{[]byte("y")}, "x,y"},
+		{MaxOperator{}, []byte("b"), [][]byte{[]byte("a"), []byte("c"), []byte("ab")}, "c"},
+		{MaxOperator{}, []byte("z"), [][]byte{[]byte("a")}, "z"},
+	}
+	for _, tt := range tests {
+		got, err := tt.op.FullMerge(tt.existing, tt.operands)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: Expected %q, got %q, %v", tt.op.Name(), tt.want, got, err)
+		}
+		// partial merges followed by a full merge get the same result.
+		partial, ok := tt.op.PartialMerge(tt.operands)
+		if !ok {
+			t.Errorf("%s: Expected operands to merge", tt.op.Name())
+			continue
+		}
+		if got, err := tt.op.FullMerge(tt.existing, [][]byte{partial}); err != nil || string(got) != tt.want {
+			t.Errorf("%s: Expected %q after a partial merge, got %q, %v", tt.op.Name(), tt.want, got, err)
+		}
+	}
+
+	if _, err := (UInt64AddOperator{}).FullMerge(nil, [][]byte{[]byte("abc")}); err == nil {
+		t.Errorf("Expected a short operand to fail")
+	}
+}
+
+func checkCounter(t *testing.T, lsm *LSM, key uint32, want uint64) {
+	t.Helper()
+	found, got, err := lsm.Get(keys.NewIntKey(key))
+	if err != nil || !found || string(got) != string(u64(want)) {
+		t.Errorf("Expected %d for key %d, got %v, %v", want, key, got, err)
+	}
+}
+
+func TestMergeCounters(t *testing.T) {
+	dir := t.TempDir()
+	// every flush gets merged into L1 right away.
+	strategy := NewLeveledStrategy()
+	strategy.L0CompactionTrigger = 1
+	opts := []Option{WithThreshold(10), WithCompactionStrategy(strategy), WithMergeOperator(UInt64AddOperator{}), WithLogger(&logRecorder{})}
+	lsm, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { lsm.Close() })
+
+	// key 0 starts from a value, key 1 from nothing and key 2 starts
+	// over after a delete. The operands end up spread over tables.
+	if err := lsm.Put(keys.NewIntKey(0), u64(100)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	for i := range 30 {
+		for key := range 3 {
+			if err := lsm.Merge(keys.NewIntKey(uint32(key)), u64(1)); err != nil {
+				t.Fatalf("Merge failed: %v", err)
+			}
+		}
+		if i == 19 {
+			lsm.Delete(keys.NewIntKey(2))
+		}
+	}
+	snap := lsm.NewSnapshot()
+	defer snap.Release()
+	lsm.Merge(keys.NewIntKey(0), u64(1000))
+
+	check := func() {
+		t.Helper()
+		checkCounter(t, lsm, 0, 1130)
+		checkCounter(t, lsm, 1, 30)
+		checkCounter(t, lsm, 2, 10)
+		if _, got, _ := snap.Get(keys.NewIntKey(0)); string(got) != string(u64(130)) {
+			t.Errorf("Expected the snapshot to read 130 for key 0, got %v", got)
+		}
+
+		results, err := lsm.MultiGet([]interfaces.Comparable{keys.NewIntKey(2), keys.NewIntKey(0), keys.NewIntKey(3)})
+		if err != nil {
+			t.Fatalf("MultiGet failed: %v", err)
+		}
+		if !results[0].Found || string(results[0].Value) != string(u64(10)) || string(results[1].Value) != string(u64(1130)) || results[2].Found {
+			t.Errorf("Unexpected MultiGet results %+v", results)
+		}
+
+		want := []uint64{1130, 30, 10}
+		entries, err := lsm.Scan(nil, nil)
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if len(entries) != len(want) {
+			t.Fatalf("Expected %d entries, got %d", len(want), len(entries))
+		}
+		for i, entry := range entries {
+			if string(entry.Value) != string(u64(want[i])) {
+				t.Errorf("Expected %d for key %d while scanning, got %v", want[i], i, entry.Value)
+			}
+		}
+
+		it, err := lsm.NewIterator()
+		if err != nil {
+			t.Fatalf("NewIterator failed: %v", err)
+		}
+		defer it.Close()
+		i := len(want) - 1
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			if string(it.Value()) != string(u64(want[i])) {
+				t.Errorf("Expected %d for key %d going backward, got %v", want[i], i, it.Value())
+			}
+			i--
+		}
+		if i != -1 || it.Err() != nil {
+			t.Errorf("Expected to go back over every key, stopped at %d: %v", i, it.Err())
+		}
+
+		// turning around on a merged key.
+		it.Seek(keys.NewIntKey(1))
+		it.Prev()
+		if !it.Valid() || string(it.Value()) != string(u64(want[0])) {
+			t.Errorf("Expected %d for key 0 after turning around, got %v", want[0], it.Value())
+		}
+		it.Next()
+		if !it.Valid() || string(it.Value()) != string(u64(want[1])) {
+			t.Errorf("Expected %d for key 1 after turning around, got %v", want[1], it.Value())
+		}
+	}
+
+	check()
+	lsm.mu.Lock()
+	err = lsm.switchMemtable()
+	lsm.mu.Unlock()
+	if err != nil {
+		t.Fatalf("switchMemtable failed: %v", err)
+	}
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	check()
+
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	check()
+	// the snapshot keeps the old count of key 0 and the operand on top.
+	if versions := countVersions(t, lsm, 1); versions != 1 {
+		t.Errorf("Expected the operands of key 1 to be merged, got %d versions", versions)
+	}
+	if versions := countVersions(t, lsm, 0); versions != 2 {
+		t.Errorf("Expected 2 versions of key 0, got %d", versions)
+	}
+
+	// operands in the WAL are replayed.
+	lsm.Merge(keys.NewIntKey(1), u64(5))
+	snap.Release()
+	crash(lsm)
+	lsm, err = Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer lsm.Close()
+	checkCounter(t, lsm, 1, 35)
+}
+
+func TestMergeWithoutOperator(t *testing.T) {
+	dir := t.TempDir()
+	lsm, err := Open(dir, WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := lsm.Merge(keys.NewIntKey(1), []byte("a")); !errors.Is(err, ErrNoMergeOperator) {
+		t.Errorf("Expected ErrNoMergeOperator, got %v", err)
+	}
+	lsm.Close()
+
+	// operands written with an operator can't be read without one.
+	lsm, err = Open(dir, WithMergeOperator(StringAppendOperator{}), WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	lsm.Merge(keys.NewIntKey(1), []byte("a"))
+	lsm.Close()
+
+	lsm, err = Open(dir, WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer lsm.Close()
+	if _, _, err := lsm.Get(keys.NewIntKey(1)); !errors.Is(err, ErrNoMergeOperator) {
+		t.Errorf("Expected ErrNoMergeOperator, got %v", err)
+	}
+}
+
+func TestMergeOnVersion0Table(t *testing.T) {
+	dir := t.TempDir()
+	buf := new(bytes.Buffer)
+	if err := fillLegacyMemTable(40).Dump(buf, nil, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sstable_1"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lsm, err := Open(dir, WithMergeOperator(StringAppendOperator{Delimiter: ","}), WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer lsm.Close()
+	for _, key := range []uint32{2, 3} {
+		if err := lsm.Merge(keys.NewIntKey(key), []byte("z")); err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+	}
+
+	// the operand goes on top of the value in the table, a key the
+	// table doesn't hold has nothing under it.
+	if found, got, err := lsm.Get(keys.NewIntKey(2)); err != nil || !found || string(got) != "val_2,z" {
+		t.Errorf("Expected 'val_2,z', got '%s', %v", got, err)
+	}
+	if found, got, err := lsm.Get(keys.NewIntKey(3)); err != nil || !found || string(got) != "z" {
+		t.Errorf("Expected 'z', got '%s', %v", got, err)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package lsmtree
+
+import "os"
+
+// tables are read with pread instead.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,301 @@
+package lsmtree
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+
+	"main/cache"
+	"main/interfaces"
+	"main/memtable"
+)
+
+/*
+ * MultiGet resolves keys in rounds. Every round each pending key is
+ * looked up in the newest table that may hold it, going by key range
+ * and bloom filter, and the tables of a round are read in parallel.
+ * Keys a table doesn't hold move on to their next table in the next
+ * round, so an older table is never read for a key a newer one has.
+ * Within a table the keys are sorted and every data block they need is
+ * read and decoded once.
+ */
+
+type GetResult struct {
+	Found bool
+	Value []byte
+}
+
+// pendingKey is a key MultiGet hasn't resolved yet.
+type pendingKey struct {
+	key interfaces.Comparable
+	// where the result goes, several for a key asked for twice.
+	slots []int
+	// index of the next table to look at, counting down.
+	next int
+	// the version found is a merge operand, see getMerged.
+	merge bool
+	// newest range tombstone covering the key, see rangeCover.
+	cover uint64
+}
+
+// MultiGet reads every key as of the same point in time, the results
+// are in the order of keys. Deleted keys are not found.
+func (l *LSM) MultiGet(keys []interfaces.Comparable) ([]GetResult, error) {
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return nil, ErrClosed
+	}
+	seq := l.seq
+	mems := l.memtables()
+	tables := l.refTables()
+	rows := l.rowCache
+	op := l.mergeOperator
+	l.mu.RUnlock()
+	defer unrefTables(tables)
+
+	at := now()
+	results := make([]GetResult, len(keys))
+	var pending []*pendingKey
+	for _, p := range groupKeys(keys) {
+		p.cover = rangeCover(p.key, seq, mems, tables)
+		if entry := readEntry(memtablesGet(mems, p.key, seq), at, p.cover); entry != nil {
+			result := GetResult{Found: entry.Kind != memtable.KindDeletion, Value: entry.Value}
+			if entry.Kind == memtable.KindMerge {
+				value, err := getMerged(op, p.key, seq, at, p.cover, mems, tables)
+				if err != nil {
+					return nil, err
+				}
+				result.Value = value
+			}
+			for _, slot := range p.slots {
+				results[slot] = result
+			}
+			continue
+		}
+		p.next = len(tables) - 1
+		pending = append(pending, p)
+	}
+
+	for len(pending) > 0 {
+		// group the keys by the table they go to next, in key order.
+		batches := map[int][]*pendingKey{}
+		var next []*pendingKey
+		for _, p := range pending {
+			for p.next >= 0 && !tables[p.next].mayContain(p.key) {
+				p.next--
+			}
+			if p.next >= 0 {
+				batches[p.next] = append(batches[p.next], p)
+				next = append(next, p)
+			}
+		}
+
+		found, err := lookupBatches(tables, batches, rows, seq, at)
+		if err != nil {
+			return nil, err
+		}
+
+		pending = pending[:0]
+		for _, p := range next {
+			if result, ok := found[p]; ok {
+				if p.merge {
+					value, err := getMerged(op, p.key, seq, at, p.cover, mems, tables)
+					if err != nil {
+						return nil, err
+					}
+					result = GetResult{Found: true, Value: value}
+				}
+				for _, slot := range p.slots {
+					results[slot] = result
+				}
+				continue
+			}
+			p.next--
+			pending = append(pending, p)
+		}
+	}
+	return results, nil
+}
+
+// groupKeys sorts keys and merges the duplicates.
+func groupKeys(keys []interfaces.Comparable) []*pendingKey {
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		return int(keys[a].Compare(keys[b]))
+	})
+
+	var grouped []*pendingKey
+	for _, i := range order {
+		if n := len(grouped); n > 0 && grouped[n-1].key.Compare(keys[i]) == 0 {
+			grouped[n-1].slots = append(grouped[n-1].slots, i)
+			continue
+		}
+		grouped = append(grouped, &pendingKey{key: keys[i], slots: []int{i}})
+	}
+	return grouped
+}
+
+// memtablesGet returns the newest version of key in mems visible at
+// seq, or nil.
+func memtablesGet(mems []*memtable.MemTable, key interfaces.Comparable, seq uint64) *memtable.Entry {
+	for _, mem := range mems {
+		if entry := memGet(mem, key, seq); entry != nil {
+			return entry
+		}
+	}
+	return nil
+}
+
+// mayContain checks the key range and the bloom filter of the table.
+func (t *SSTable) mayContain(key interfaces.Comparable) bool {
+	if t.minKey != nil && (key.Compare(t.minKey) < 0 || key.Compare(t.maxKey) > 0) {
+		return false
+	}
+	filter, err := t.filter()
+	if err != nil {
+		// errors come up again once the table is read.
+		return true
+	}
+	found, err := filter.Contains(key)
+	return found || err != nil
+}
+
+// lookupBatches reads the tables of one round in parallel, the result
+// holds the keys that were found, deleted ones included.
+func lookupBatches(tables []*SSTable, batches map[int][]*pendingKey, rows *cache.Cache, seq uint64, at time.Time) (map[*pendingKey]GetResult, error) {
+	var mu sync.Mutex
+	var errs []error
+	found := map[*pendingKey]GetResult{}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	for i, batch := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			batchFound, err := tables[i].multiFind(batch, rows, seq, at)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			for p, result := range batchFound {
+				found[p] = result
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return found, nil
+}
+
+// multiFind looks up sorted keys in the table, reading each data block
+// once. Keys the table doesn't hold are left out of the result, keys
+// whose newest version is a merge operand get marked. Values that
+// expired by at are deleted, so are versions under a range tombstone.
+func (t *SSTable) multiFind(batch []*pendingKey, rows *cache.Cache, seq uint64, at time.Time) (map[*pendingKey]GetResult, error) {
+	found := map[*pendingKey]GetResult{}
+	if t.version == 0 {
+		for _, p := range batch {
+			entry, err := t.findCached(rows, p.key, seq)
+			if err != nil {
+				return nil, err
+			}
+			if entry = readEntry(entry, at, p.cover); entry != nil {
+				found[p] = GetResult{Found: entry.Kind != memtable.KindDeletion, Value: entry.Value}
+				p.merge = entry.Kind == memtable.KindMerge
+			}
+		}
+		return found, nil
+	}
+
+	index, err := t.index()
+	if err != nil {
+		return nil, err
+	}
+	r := &tableReader{table: t}
+	defer r.Close()
+	blocks := map[blockHandle][]*memtable.Entry{}
+	useRows := rows != nil && seq >= t.maxSeq
+
+	for _, p := range batch {
+		var rowKey cache.Key
+		if useRows {
+			keyBytes, err := p.key.ToBytes()
+			if err != nil {
+				return nil, err
+			}
+			rowKey = cache.Key{ID: t.id, Row: string(keyBytes)}
+			if row, ok := rows.Get(rowKey); ok {
+				entry := readEntry(row.(*memtable.Entry), at, p.cover)
+				found[p] = GetResult{Found: entry.Kind != memtable.KindDeletion, Value: entry.Value}
+				continue
+			}
+		}
+
+		key := newInternalKey(p.key, seq)
+		for _, handle := range t.blocksFor(index, key) {
+			entries, ok := blocks[handle]
+			if !ok {
+				var err error
+				if entries, err = t.decodeBlock(r, handle); err != nil {
+					return nil, err
+				}
+				blocks[handle] = entries
+			}
+
+			i, _ := slices.BinarySearchFunc(entries, key, func(e *memtable.Entry, k *internalKey) int {
+				return int(e.Key.Compare(k))
+			})
+			if i == len(entries) {
+				continue
+			}
+			if userKey(entries[i].Key).Compare(p.key) == 0 {
+				stored := entries[i]
+				// tombstones come back without a value, as from find.
+				if stored.Kind == memtable.KindDeletion {
+					stored = &memtable.Entry{Key: stored.Key, Kind: stored.Kind}
+				}
+				entry := readEntry(stored, at, p.cover)
+				found[p] = GetResult{Found: entry.Kind != memtable.KindDeletion, Value: entry.Value}
+				p.merge = entry.Kind == memtable.KindMerge
+				if useRows && !p.merge {
+					rows.Insert(rowKey, stored, int64(len(rowKey.Row)+len(stored.Value)+rowCacheOverhead))
+				}
+			}
+			break
+		}
+	}
+	return found, nil
+}
+
+// decodeBlock reads every record of a data block.
+func (t *SSTable) decodeBlock(r *tableReader, handle blockHandle) ([]*memtable.Entry, error) {
+	block, err := r.dataBlock(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*memtable.Entry
+	rd := bytes.NewReader(block)
+	for rd.Len() > 0 {
+		entry, err := t.readRecord(rd)
+		if err != nil {
+			return nil, &CorruptionError{File: t.dataLocation, Block: fmt.Sprintf("data block at %d", handle.offset), Offset: int64(handle.offset), Reason: err.Error()}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,96 @@
+package lsmtree
+
+import (
+	"errors"
+	"main/cache"
+	"main/interfaces"
+	"main/keys"
+	"math/rand"
+	"testing"
+)
+
+func TestMultiGetMatchesGet(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 50, 2, 0.01, nil)
+	lsm.SetRowCache(cache.New(1<<20, cache.LRU))
+
+	// versions spread over tables, immutables and the memtable.
+	putRound(t, lsm, "old", 300)
+	for i := 0; i < 300; i += 7 {
+		lsm.Delete(keys.NewIntKey(uint32(i)))
+	}
+	putRound(t, lsm, "new", 120)
+	for i := 0; i < 120; i += 11 {
+		lsm.Delete(keys.NewIntKey(uint32(i)))
+	}
+
+	var batch []interfaces.Comparable
+	for range 200 {
+		batch = append(batch, keys.NewIntKey(uint32(rand.Intn(350))))
+	}
+	// the same key twice, and keys nothing has.
+	batch = append(batch, batch[0], keys.NewIntKey(1000), keys.NewIntKey(1001))
+
+	for round := range 2 {
+		results, err := lsm.MultiGet(batch)
+		if err != nil {
+			t.Fatalf("MultiGet failed: %v", err)
+		}
+		if len(results) != len(batch) {
+			t.Fatalf("Expected %d results, got %d", len(batch), len(results))
+		}
+		for i, key := range batch {
+			found, want, err := lsm.Get(key)
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			found = found && want != nil
+			if results[i].Found != found || string(results[i].Value) != string(want) {
+				t.Errorf("round %d: Expected %v, %s for key %v, got %v, %s", round, found, want, key.GetValue(), results[i].Found, results[i].Value)
+			}
+		}
+
+		if err := lsm.waitForFlush(); err != nil {
+			t.Fatalf("flush failed: %v", err)
+		}
+		if err := lsm.Compact(); err != nil {
+			t.Fatalf("Compact failed: %v", err)
+		}
+	}
+}
+
+func TestMultiGetReadsEachBlockOnce(t *testing.T) {
+	blocks := cache.New(1<<20, cache.LRU)
+	lsm, err := Open(t.TempDir(), WithThreshold(100), WithBlockCache(blocks), WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer lsm.Close()
+	putRound(t, lsm, "val", 101)
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	// 100 small records fit in a single block.
+	var batch []interfaces.Comparable
+	for i := range 100 {
+		batch = append(batch, keys.NewIntKey(uint32(i)))
+	}
+	results, err := lsm.MultiGet(batch)
+	if err != nil {
+		t.Fatalf("MultiGet failed: %v", err)
+	}
+	for i, result := range results {
+		if !result.Found {
+			t.Errorf("Expected key %d to be found", i)
+		}
+	}
+	if stats := blocks.Stats(); stats.Misses != 1 || stats.Hits != 0 {
+		t.Errorf("Expected a single block read, got %+v", stats)
+	}
+
+	lsm.Close()
+	if _, err := lsm.MultiGet(batch); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
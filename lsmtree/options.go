@@ -0,0 +1,102 @@
+package lsmtree
+
+import (
+	"log"
+	"os"
+
+	"main/cache"
+	"main/compression"
+	"main/wal"
+)
+
+// Option configures an LSM in Open.
+type Option func(*LSM)
+
+// Logger receives the messages about flushes, compactions and recovery.
+type Logger interface {
+	Printf(format string, args ...any)
+}
+
+// defaultLogger prints to stdout, without timestamps.
+var defaultLogger Logger = log.New(os.Stdout, "", 0)
+
+// WithThreshold flushes the memtable once it holds threshold entries,
+// 0 (the default) only flushes on its size.
+func WithThreshold(threshold uint32) Option {
+	return func(l *LSM) { l.threshold = threshold }
+}
+
+// WithWriteBufferSize flushes the memtable once it takes size bytes, 0
+// only flushes on the entry count.
+func WithWriteBufferSize(size int64) Option {
+	return func(l *LSM) { l.writeBufferSize = size }
+}
+
+// WithWriteBufferManager makes the memtables count against the budget
+// of m, see SetWriteBufferManager.
+func WithWriteBufferManager(m *WriteBufferManager) Option {
+	return func(l *LSM) { l.writeBuffer = m }
+}
+
+// WithSparsityFactor sets how many entries share a sparse index entry
+// in tables of the legacy format.
+func WithSparsityFactor(sparsityFactor uint32) Option {
+	return func(l *LSM) { l.sparsityFactor = sparsityFactor }
+}
+
+// WithFalsePositiveRate sets the false positive rate of the bloom
+// filters of new tables.
+func WithFalsePositiveRate(rate float64) Option {
+	return func(l *LSM) { l.falsePositiveRate = rate }
+}
+
+// WithCompressor picks the codec for the data blocks of new tables.
+func WithCompressor(compressor compression.Compressor) Option {
+	return func(l *LSM) { l.compressor = compressor }
+}
+
+// WithCompactionStrategy replaces the default size-tiered compaction.
+func WithCompactionStrategy(compaction CompactionStrategy) Option {
+	return func(l *LSM) { l.compaction = compaction }
+}
+
+// WithBlockCache replaces the default 8 MiB block cache, several trees
+// can share one. nil turns caching off.
+func WithBlockCache(c *cache.Cache) Option {
+	return func(l *LSM) { l.blockCache = c }
+}
+
+// WithRowCache keeps the results of table lookups in c, see
+// SetRowCache.
+func WithRowCache(c *cache.Cache) Option {
+	return func(l *LSM) { l.rowCache = c }
+}
+
+// WithMaxOpenFiles caps the number of table files kept open, at least
+// one is. The default is 500.
+func WithMaxOpenFiles(n int) Option {
+	return func(l *LSM) { l.tableCache.capacity = max(n, 1) }
+}
+
+// WithMmapReads maps table files into memory and reads blocks from
+// there, on Linux only. Elsewhere the option does nothing.
+func WithMmapReads(enabled bool) Option {
+	return func(l *LSM) { l.tableCache.mmap = enabled }
+}
+
+// WithMergeOperator sets the operator that combines the operands
+// written with Merge. A tree holding operands has to be opened with the
+// same operator every time.
+func WithMergeOperator(op MergeOperator) Option {
+	return func(l *LSM) { l.mergeOperator = op }
+}
+
+// WithLogger sends log messages to logger instead of stdout.
+func WithLogger(logger Logger) Option {
+	return func(l *LSM) { l.logger = logger }
+}
+
+// WithSyncPolicy controls how often the write-ahead log is fsynced.
+func WithSyncPolicy(policy wal.SyncPolicy) Option {
+	return func(l *LSM) { l.syncPolicy = policy }
+}
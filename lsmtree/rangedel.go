@@ -0,0 +1,292 @@
+package lsmtree
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"main/interfaces"
+	"main/keys"
+	"main/memtable"
+	"main/util"
+)
+
+/*
+ * DeleteRange writes a range tombstone, an entry of KindRangeDeletion
+ * that deletes every version of the keys in [start, end) older than
+ * itself. Memtables keep tombstones in a list next to the other entries
+ * and tables in a block of their own, fragmented: cut at every start
+ * and end key so the fragments don't overlap, each one listing the
+ * sequence numbers of the tombstones covering it.
+ *
+ * Reads look for the newest tombstone covering the key that is visible
+ * at their sequence number, every version older than it reads as a
+ * deletion. Flushes and compactions drop the versions no snapshot can
+ * see under a tombstone, and keep only the tombstones some snapshot
+ * still needs. At the bottommost level nothing older is left to delete
+ * and those go too.
+ *
+ * Range tombstone block format:
+ *   [4 bytes] - Number of fragments (uint32)
+ *   For each fragment, in key order:
+ *     [N bytes] - Start key (keys.ParseKey format)
+ *     [N bytes] - End key, not deleted
+ *     [4 bytes] - Number of sequence numbers (uint32)
+ *     [8 bytes] - Sequence number (uint64), for each, newest first
+ */
+
+// ErrInvalidRange is returned by DeleteRange when start isn't before
+// end.
+var ErrInvalidRange = errors.New("range start must be before its end")
+
+// DeleteRange queues a deletion of the keys from start up to, but not
+// including, end.
+func (b *WriteBatch) DeleteRange(start, end interfaces.Comparable) {
+	b.ops = append(b.ops, batchOp{key: start, kind: memtable.KindRangeDeletion, end: end})
+}
+
+// DeleteRange deletes every key >= start and < end.
+func (l *LSM) DeleteRange(start, end interfaces.Comparable) error {
+	if start.Compare(end) >= 0 {
+		return ErrInvalidRange
+	}
+	batch := NewWriteBatch()
+	batch.DeleteRange(start, end)
+	return l.Write(batch)
+}
+
+type rangeTombstone struct {
+	start, end interfaces.Comparable
+	seq        uint64
+}
+
+// rangeFragment is a piece of the key space and the tombstones covering
+// all of it.
+type rangeFragment struct {
+	start, end interfaces.Comparable
+	// newest first.
+	seqs []uint64
+}
+
+// rangeFragments don't overlap and are sorted by key.
+type rangeFragments []rangeFragment
+
+// memTombstones returns the range tombstones of mem.
+func memTombstones(mem *memtable.MemTable) []rangeTombstone {
+	var tombstones []rangeTombstone
+	for _, del := range mem.RangeDeletions() {
+		start := del.Start.(*internalKey)
+		tombstones = append(tombstones, rangeTombstone{start: start.user, end: del.End, seq: start.seq})
+	}
+	return tombstones
+}
+
+// fragmentTombstones cuts tombstones into fragments.
+func fragmentTombstones(tombstones []rangeTombstone) rangeFragments {
+	var bounds []interfaces.Comparable
+	for _, t := range tombstones {
+		bounds = append(bounds, t.start, t.end)
+	}
+	compare := func(a, b interfaces.Comparable) int { return int(a.Compare(b)) }
+	slices.SortFunc(bounds, compare)
+	bounds = slices.CompactFunc(bounds, func(a, b interfaces.Comparable) bool { return a.Compare(b) == 0 })
+
+	var frags rangeFragments
+	for i := 0; i+1 < len(bounds); i++ {
+		var seqs []uint64
+		for _, t := range tombstones {
+			if t.start.Compare(bounds[i]) <= 0 && t.end.Compare(bounds[i+1]) >= 0 {
+				seqs = append(seqs, t.seq)
+			}
+		}
+		slices.SortFunc(seqs, func(a, b uint64) int { return cmp.Compare(b, a) })
+		frags = frags.add(bounds[i], bounds[i+1], slices.Compact(seqs))
+	}
+	return frags
+}
+
+// add appends a fragment past the others, joining it to the last one
+// if they touch and have the same tombstones.
+func (f rangeFragments) add(start, end interfaces.Comparable, seqs []uint64) rangeFragments {
+	if len(seqs) == 0 || start.Compare(end) >= 0 {
+		return f
+	}
+	if n := len(f); n > 0 && f[n-1].end.Compare(start) == 0 && slices.Equal(f[n-1].seqs, seqs) {
+		f[n-1].end = end
+		return f
+	}
+	return append(f, rangeFragment{start: start, end: end, seqs: seqs})
+}
+
+// tombstones turns the fragments back into tombstones, one per sequence
+// number of each fragment.
+func (f rangeFragments) tombstones() []rangeTombstone {
+	var tombstones []rangeTombstone
+	for _, frag := range f {
+		for _, seq := range frag.seqs {
+			tombstones = append(tombstones, rangeTombstone{start: frag.start, end: frag.end, seq: seq})
+		}
+	}
+	return tombstones
+}
+
+// coverAt returns the sequence number of the newest tombstone visible
+// at seq that covers key, or 0. Versions of key older than that are
+// deleted.
+func (f rangeFragments) coverAt(key interfaces.Comparable, seq uint64) uint64 {
+	i := sort.Search(len(f), func(i int) bool { return f[i].end.Compare(key) > 0 })
+	if i == len(f) || f[i].start.Compare(key) > 0 {
+		return 0
+	}
+	for _, s := range f[i].seqs {
+		if s <= seq {
+			return s
+		}
+	}
+	return 0
+}
+
+// compact drops the tombstones no snapshot needs: below
+// smallestSnapshot only the newest of a fragment counts, and at the
+// bottommost level not even that one.
+func (f rangeFragments) compact(smallestSnapshot uint64, bottommost bool) rangeFragments {
+	var compacted rangeFragments
+	for _, frag := range f {
+		var seqs []uint64
+		for _, seq := range frag.seqs {
+			if seq > smallestSnapshot {
+				seqs = append(seqs, seq)
+				continue
+			}
+			if !bottommost {
+				seqs = append(seqs, seq)
+			}
+			break
+		}
+		compacted = compacted.add(frag.start, frag.end, seqs)
+	}
+	return compacted
+}
+
+// clip returns the parts of the fragments in [lo, hi), a nil bound
+// leaves that side open.
+func (f rangeFragments) clip(lo, hi interfaces.Comparable) rangeFragments {
+	var clipped rangeFragments
+	for _, frag := range f {
+		start, end := frag.start, frag.end
+		if lo != nil && start.Compare(lo) < 0 {
+			start = lo
+		}
+		if hi != nil && end.Compare(hi) > 0 {
+			end = hi
+		}
+		clipped = clipped.add(start, end, frag.seqs)
+	}
+	return clipped
+}
+
+func encodeRangeFragments(f rangeFragments) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, uint32(len(f))); err != nil {
+		return nil, err
+	}
+	for _, frag := range f {
+		for _, key := range []interfaces.Comparable{frag.start, frag.end} {
+			keyBytes, err := key.ToBytes()
+			if err != nil {
+				return nil, fmt.Errorf("error serializing range key: %w", err)
+			}
+			buf.Write(keyBytes)
+		}
+		binary.Write(buf, binary.BigEndian, uint32(len(frag.seqs)))
+		for _, seq := range frag.seqs {
+			binary.Write(buf, binary.BigEndian, seq)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeRangeFragments(data []byte) (rangeFragments, error) {
+	rd := bytes.NewReader(data)
+	count, err := util.ParseInt32(rd)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing fragment count: %w", err)
+	}
+
+	var f rangeFragments
+	for range count {
+		start, err := keys.ParseKey(rd)
+		if err != nil {
+			return nil, err
+		}
+		end, err := keys.ParseKey(rd)
+		if err != nil {
+			return nil, err
+		}
+		n, err := util.ParseInt32(rd)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing sequence number count: %w", err)
+		}
+		if int64(n)*8 > int64(rd.Len()) {
+			return nil, fmt.Errorf("fragment has %d sequence numbers, only %d bytes left", n, rd.Len())
+		}
+		seqs := make([]uint64, n)
+		if err := binary.Read(rd, binary.BigEndian, seqs); err != nil {
+			return nil, fmt.Errorf("error parsing sequence numbers: %w", err)
+		}
+		f = append(f, rangeFragment{start: start, end: end, seqs: seqs})
+	}
+	return f, nil
+}
+
+// rangeCover is coverAt over the tombstones of every memtable and table.
+func rangeCover(key interfaces.Comparable, seq uint64, mems []*memtable.MemTable, tables []*SSTable) uint64 {
+	var cover uint64
+	for _, mem := range mems {
+		for _, t := range memTombstones(mem) {
+			if t.seq <= seq && t.seq > cover && t.start.Compare(key) <= 0 && t.end.Compare(key) > 0 {
+				cover = t.seq
+			}
+		}
+	}
+	for _, table := range tables {
+		cover = max(cover, table.rangeDels.coverAt(key, seq))
+	}
+	return cover
+}
+
+// visibleTombstones fragments every tombstone visible at seq.
+func visibleTombstones(seq uint64, mems []*memtable.MemTable, tables []*SSTable) rangeFragments {
+	var tombstones []rangeTombstone
+	for _, mem := range mems {
+		tombstones = append(tombstones, memTombstones(mem)...)
+	}
+	for _, table := range tables {
+		tombstones = append(tombstones, table.rangeDels.tombstones()...)
+	}
+	tombstones = slices.DeleteFunc(tombstones, func(t rangeTombstone) bool { return t.seq > seq })
+	return fragmentTombstones(tombstones)
+}
+
+// entrySeq is the sequence number of a version, 0 for keys written
+// before those existed.
+func entrySeq(entry *memtable.Entry) uint64 {
+	if ik, ok := entry.Key.(*internalKey); ok {
+		return ik.seq
+	}
+	return 0
+}
+
+// readEntry is entryAt for a version that a tombstone with sequence
+// number cover may delete.
+func readEntry(entry *memtable.Entry, at time.Time, cover uint64) *memtable.Entry {
+	if entry != nil && entrySeq(entry) < cover {
+		return &memtable.Entry{Key: entry.Key, Kind: memtable.KindDeletion}
+	}
+	return entryAt(entry, at)
+}
@@ -0,0 +1,200 @@
+package lsmtree
+
+import (
+	"errors"
+	"main/interfaces"
+	"main/keys"
+	"slices"
+	"testing"
+)
+
+func TestRangeFragments(t *testing.T) {
+	key := func(i uint32) interfaces.Comparable { return keys.NewIntKey(i) }
+	frags := fragmentTombstones([]rangeTombstone{
+		{start: key(0), end: key(10), seq: 5},
+		{start: key(5), end: key(15), seq: 8},
+		{start: key(20), end: key(30), seq: 3},
+		{start: key(20), end: key(30), seq: 3},
+	})
+
+	type fragment struct {
+		start, end uint32
+		seqs       []uint64
+	}
+	check := func(name string, f rangeFragments, want []fragment) {
+		t.Helper()
+		if len(f) != len(want) {
+			t.Fatalf("%s: Expected %d fragments, got %d", name, len(want), len(f))
+		}
+		for i, w := range want {
+			if f[i].start.GetValue() != w.start || f[i].end.GetValue() != w.end || !slices.Equal(f[i].seqs, w.seqs) {
+				t.Errorf("%s: Expected fragment %d to be %+v, got %v-%v %v", name, i, w, f[i].start.GetValue(), f[i].end.GetValue(), f[i].seqs)
+			}
+		}
+	}
+	check("fragmented", frags, []fragment{{0, 5, []uint64{5}}, {5, 10, []uint64{8, 5}}, {10, 15, []uint64{8}}, {20, 30, []uint64{3}}})
+
+	covers := []struct {
+		key       uint32
+		seq, want uint64
+	}{
+		{0, 10, 5}, {7, 10, 8}, {7, 6, 5}, {7, 4, 0}, {10, 10, 8}, {15, 10, 0}, {17, 10, 0}, {29, 3, 3}, {30, 10, 0},
+	}
+	for _, c := range covers {
+		if got := frags.coverAt(key(c.key), c.seq); got != c.want {
+			t.Errorf("Expected key %d to be covered by %d at %d, got %d", c.key, c.want, c.seq, got)
+		}
+	}
+
+	// fragments left with the same tombstones are joined again.
+	check("compacted", frags.compact(9, false), []fragment{{0, 5, []uint64{5}}, {5, 15, []uint64{8}}, {20, 30, []uint64{3}}})
+	check("bottommost", frags.compact(6, true), []fragment{{5, 15, []uint64{8}}})
+	check("clipped", frags.clip(key(7), key(25)), []fragment{{7, 10, []uint64{8, 5}}, {10, 15, []uint64{8}}, {20, 25, []uint64{3}}})
+
+	data, err := encodeRangeFragments(frags)
+	if err != nil {
+		t.Fatalf("encodeRangeFragments failed: %v", err)
+	}
+	decoded, err := decodeRangeFragments(data)
+	if err != nil {
+		t.Fatalf("decodeRangeFragments failed: %v", err)
+	}
+	check("decoded", decoded, []fragment{{0, 5, []uint64{5}}, {5, 10, []uint64{8, 5}}, {10, 15, []uint64{8}}, {20, 30, []uint64{3}}})
+}
+
+func TestDeleteRange(t *testing.T) {
+	dir := t.TempDir()
+	// every flush gets merged into L1 right away.
+	strategy := NewLeveledStrategy()
+	strategy.L0CompactionTrigger = 1
+	opts := []Option{WithCompactionStrategy(strategy), WithMergeOperator(UInt64AddOperator{}), WithLogger(&logRecorder{})}
+	lsm, err := Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { lsm.Close() })
+
+	key := func(i uint32) interfaces.Comparable { return keys.NewIntKey(i) }
+	if err := lsm.DeleteRange(key(5), key(5)); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("Expected ErrInvalidRange, got %v", err)
+	}
+
+	for i := range uint32(20) {
+		lsm.Put(key(i), u64(uint64(i)))
+	}
+	snap := lsm.NewSnapshot()
+	defer snap.Release()
+	if err := lsm.DeleteRange(key(5), key(15)); err != nil {
+		t.Fatalf("DeleteRange failed: %v", err)
+	}
+	// written over the range after it was deleted.
+	lsm.Put(key(10), u64(100))
+	lsm.Merge(key(8), u64(1))
+
+	check := func(lsm *LSM) {
+		t.Helper()
+		want := map[uint32]uint64{}
+		for i := range uint32(20) {
+			if i < 5 || i >= 15 {
+				want[i] = uint64(i)
+			}
+		}
+		want[10], want[8] = 100, 1
+
+		var batch []interfaces.Comparable
+		for i := range uint32(20) {
+			batch = append(batch, key(i))
+		}
+		results, err := lsm.MultiGet(batch)
+		if err != nil {
+			t.Fatalf("MultiGet failed: %v", err)
+		}
+		for i := range uint32(20) {
+			value, ok := want[i]
+			found, got, err := lsm.Get(key(i))
+			if err != nil || (found && got != nil) != ok || (ok && string(got) != string(u64(value))) {
+				t.Errorf("Expected %v, %d for key %d, got %v, %v, %v", ok, value, i, found, got, err)
+			}
+			if results[i].Found != ok || (ok && string(results[i].Value) != string(u64(value))) {
+				t.Errorf("Expected MultiGet to return %v, %d for key %d, got %+v", ok, value, i, results[i])
+			}
+		}
+
+		it, err := lsm.NewIterator()
+		if err != nil {
+			t.Fatalf("NewIterator failed: %v", err)
+		}
+		defer it.Close()
+		var forward, backward []uint32
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			forward = append(forward, it.Key().GetValue().(uint32))
+		}
+		for it.SeekToLast(); it.Valid(); it.Prev() {
+			backward = append(backward, it.Key().GetValue().(uint32))
+		}
+		slices.Reverse(backward)
+		if len(forward) != len(want) || !slices.Equal(forward, backward) {
+			t.Errorf("Expected to iterate over %d keys both ways, got %v and %v", len(want), forward, backward)
+		}
+		for _, k := range forward {
+			if _, ok := want[k]; !ok {
+				t.Errorf("Expected key %d to be skipped while iterating", k)
+			}
+		}
+
+		// the snapshot was taken before the range was deleted.
+		if _, got, err := snap.Get(key(7)); err != nil || string(got) != string(u64(7)) {
+			t.Errorf("Expected the snapshot to read 7 for key 7, got %v, %v", got, err)
+		}
+	}
+
+	check(lsm)
+	flushAll(t, lsm)
+	check(lsm)
+	if versions := countVersions(t, lsm, 7); versions != 1 {
+		t.Errorf("Expected the snapshot to keep key 7, got %d versions", versions)
+	}
+
+	// a table around the others, compaction picks them all up and no
+	// snapshot needs what the range deleted.
+	snap.Release()
+	lsm.Put(key(0), u64(0))
+	lsm.Put(key(19), u64(19))
+	flushAll(t, lsm)
+	for _, i := range []uint32{5, 7, 14} {
+		if versions := countVersions(t, lsm, i); versions != 0 {
+			t.Errorf("Expected compaction to drop key %d, got %d versions", i, versions)
+		}
+	}
+	for _, table := range lsm.SStables {
+		if len(table.rangeDels) != 0 {
+			t.Errorf("Expected the range tombstone to be dropped at the bottom, got %d fragments", len(table.rangeDels))
+		}
+	}
+
+	// a table holding nothing but a range tombstone, and one in the WAL.
+	lsm.DeleteRange(key(0), key(2))
+	lsm.mu.Lock()
+	err = lsm.switchMemtable()
+	lsm.mu.Unlock()
+	if err != nil {
+		t.Fatalf("switchMemtable failed: %v", err)
+	}
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	lsm.DeleteRange(key(2), key(4))
+	crash(lsm)
+
+	lsm, err = Open(dir, opts...)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer lsm.Close()
+	for i := range uint32(5) {
+		found, got, err := lsm.Get(key(i))
+		if err != nil || (found && got != nil) != (i == 4) {
+			t.Errorf("Expected only key 4 of the first five to be found, got %v, %v, %v for key %d", found, got, err, i)
+		}
+	}
+}
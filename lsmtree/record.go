@@ -0,0 +1,189 @@
+package lsmtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"main/interfaces"
+	"main/keys"
+	"main/memtable"
+	"main/util"
+)
+
+/*
+ * Record format, shared by SSTable data blocks and the WAL:
+ *   [N bytes] - Key (keys.ParseKey format)
+ *   [1 byte]  - Entry kind (memtable.EntryKind)
+ *   [4 bytes] - Value length (int32)
+ *   [N bytes] - Value data
+ *
+ * The key of a data block record is an internal key, the user key
+ * followed by its 8 byte sequence number.
+ *
+ * Version 0 tables use the MemTable.Dump layout instead, without the
+ * kind byte. A value of legacyTombstone marks a delete there.
+ */
+
+// internalKey is a user key at the sequence number of the write that
+// produced it. Versions of the same user key sort newest first, so
+// seeking to (key, seq) lands on the newest version visible at seq.
+type internalKey struct {
+	user interfaces.Comparable
+	seq  uint64
+	// type byte of the user key and, when it is keys.Sortable, the key
+	// encoded so that bytes.Compare orders it like Compare does.
+	userType  uint8
+	sortBytes []byte
+}
+
+/*
+ * Sort bytes of an internal key:
+ *   [N bytes] - Sort bytes of the user key, every 0x00 followed by 0xff
+ *   [2 bytes] - 0x00 0x01
+ *   [8 bytes] - Sequence number, inverted (uint64)
+ *
+ * The terminator sorts before any byte that can follow it in a longer
+ * user key, and the inverted sequence number puts newer versions first.
+ * They are only compared between keys of the same user key type.
+ */
+
+func newInternalKey(user interfaces.Comparable, seq uint64) *internalKey {
+	k := &internalKey{user: user, seq: seq}
+	if typed, ok := user.(keys.Typed); ok {
+		k.userType = typed.KeyType()
+	}
+	if sortable, ok := user.(keys.Sortable); ok {
+		userBytes := sortable.SortBytes()
+		k.sortBytes = make([]byte, 0, len(userBytes)+10)
+		for _, b := range userBytes {
+			k.sortBytes = append(k.sortBytes, b)
+			if b == 0x00 {
+				k.sortBytes = append(k.sortBytes, 0xff)
+			}
+		}
+		k.sortBytes = append(k.sortBytes, 0x00, 0x01)
+		k.sortBytes = binary.BigEndian.AppendUint64(k.sortBytes, ^seq)
+	}
+	return k
+}
+
+func (k *internalKey) Compare(other interfaces.Comparable) int8 {
+	o := other.(*internalKey)
+	if k.sortBytes != nil && o.sortBytes != nil && k.userType == o.userType {
+		return int8(bytes.Compare(k.sortBytes, o.sortBytes))
+	}
+	if cmp := keys.Compare(k.user, o.user); cmp != 0 {
+		return cmp
+	}
+	if k.seq > o.seq {
+		return -1
+	} else if k.seq < o.seq {
+		return 1
+	}
+	return 0
+}
+
+// KeyType and SortBytes let memtables compare internal keys on their
+// sort bytes as well.
+func (k *internalKey) KeyType() uint8 {
+	return k.userType
+}
+
+func (k *internalKey) SortBytes() []byte {
+	return k.sortBytes
+}
+
+func (k *internalKey) GetValue() any {
+	return k.user.GetValue()
+}
+
+func (k *internalKey) ToBytes() ([]byte, error) {
+	userBytes, err := k.user.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint64(userBytes, k.seq), nil
+}
+
+// Hash only looks at the user key, bloom filters answer for every
+// version of a key.
+func (k *internalKey) Hash(numHashes uint32) ([]uint32, error) {
+	return k.user.Hash(numHashes)
+}
+
+// userKey strips the sequence number off internal keys.
+func userKey(key interfaces.Comparable) interfaces.Comparable {
+	if ik, ok := key.(*internalKey); ok {
+		return ik.user
+	}
+	return key
+}
+
+func parseInternalKey(rd io.Reader) (interfaces.Comparable, error) {
+	user, err := keys.ParseKey(rd)
+	if err != nil {
+		return nil, err
+	}
+	seqBytes := make([]byte, 8)
+	if _, err := io.ReadFull(rd, seqBytes); err != nil {
+		return nil, fmt.Errorf("error parsing sequence number: %w", err)
+	}
+	return newInternalKey(user, binary.BigEndian.Uint64(seqBytes)), nil
+}
+
+// legacyTombstone is the value of deletes in version 0 tables.
+var legacyTombstone = []byte{0x7f}
+
+func writeRecord(buf *bytes.Buffer, key interfaces.Comparable, kind memtable.EntryKind, val []byte) error {
+	keyBytes, err := key.ToBytes()
+	if err != nil {
+		return fmt.Errorf("error serializing key: %w", err)
+	}
+	buf.Write(keyBytes)
+	buf.WriteByte(byte(kind))
+	if err := binary.Write(buf, binary.BigEndian, int32(len(val))); err != nil {
+		return fmt.Errorf("error serializing value length: %w", err)
+	}
+	buf.Write(val)
+	return nil
+}
+
+func readRecord(rd *bytes.Reader) (*memtable.Entry, error) {
+	return readRecordWith(rd, keys.ParseKey)
+}
+
+func readRecordWith(rd *bytes.Reader, parseKey func(io.Reader) (interfaces.Comparable, error)) (*memtable.Entry, error) {
+	key, err := parseKey(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	kind, err := rd.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing entry kind: %w", err)
+	}
+	if memtable.EntryKind(kind) > memtable.KindRangeDeletion {
+		return nil, fmt.Errorf("unknown entry kind %d", kind)
+	}
+
+	val, err := readValue(rd)
+	if err != nil {
+		return nil, err
+	}
+	return &memtable.Entry{Key: key, Value: val, Kind: memtable.EntryKind(kind)}, nil
+}
+
+func readValue(rd *bytes.Reader) ([]byte, error) {
+	valueLength, err := util.ParseInt32(rd)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing value length: %w", err)
+	}
+
+	val := make([]byte, valueLength)
+	if _, err := io.ReadFull(rd, val); err != nil {
+		return nil, fmt.Errorf("error parsing value data: %w", err)
+	}
+	return val, nil
+}
@@ -0,0 +1,67 @@
+package lsmtree
+
+import (
+	"main/interfaces"
+	"main/keys"
+	"testing"
+)
+
+// decodedKey is an internal key without sort bytes, compared on its
+// user key and sequence number.
+func decodedKey(user interfaces.Comparable, seq uint64) *internalKey {
+	return &internalKey{user: user, seq: seq}
+}
+
+func TestInternalKeySortBytes(t *testing.T) {
+	users := []interfaces.Comparable{
+		keys.NewIntKey(0), keys.NewIntKey(1), keys.NewIntKey(256),
+		keys.NewStringKey(""), keys.NewStringKey("a"), keys.NewStringKey("a\x00"), keys.NewStringKey("a\x00\x01"), keys.NewStringKey("a\x01"), keys.NewStringKey("b"),
+		keys.NewBytesKey(nil), keys.NewBytesKey([]byte{0}), keys.NewBytesKey([]byte{0, 0xff}), keys.NewBytesKey([]byte{1}),
+	}
+	var all []*internalKey
+	for _, user := range users {
+		for _, seq := range []uint64{0, 1, 1 << 40, 1<<64 - 1} {
+			all = append(all, newInternalKey(user, seq))
+		}
+	}
+
+	for _, a := range all {
+		if a.sortBytes == nil {
+			t.Fatalf("Expected sort bytes for %v", a.user.GetValue())
+		}
+		for _, b := range all {
+			want := decodedKey(a.user, a.seq).Compare(decodedKey(b.user, b.seq))
+			if got := a.Compare(b); got != want {
+				t.Errorf("Expected (%v, %d) vs (%v, %d) to be %d, got %d", a.user.GetValue(), a.seq, b.user.GetValue(), b.seq, want, got)
+			}
+		}
+	}
+}
+
+func BenchmarkInternalKeyCompare(b *testing.B) {
+	users := []struct {
+		name string
+		pair [2]interfaces.Comparable
+	}{
+		{"int", [2]interfaces.Comparable{keys.NewIntKey(1000), keys.NewIntKey(1001)}},
+		{"string", [2]interfaces.Comparable{keys.NewStringKey("user:000123:profile"), keys.NewStringKey("user:000123:settings")}},
+		{"bytes", [2]interfaces.Comparable{keys.NewBytesKey([]byte("user:000123:profile")), keys.NewBytesKey([]byte("user:000123:settings"))}},
+	}
+	for _, u := range users {
+		name, pair := u.name, u.pair
+		b.Run(name+"/sort-bytes", func(b *testing.B) {
+			x, y := newInternalKey(pair[0], 7), newInternalKey(pair[1], 9)
+			b.ReportAllocs()
+			for range b.N {
+				x.Compare(y)
+			}
+		})
+		b.Run(name+"/decoded", func(b *testing.B) {
+			x, y := decodedKey(pair[0], 7), decodedKey(pair[1], 9)
+			b.ReportAllocs()
+			for range b.N {
+				x.Compare(y)
+			}
+		})
+	}
+}
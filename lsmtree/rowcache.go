@@ -0,0 +1,69 @@
+package lsmtree
+
+import (
+	"main/cache"
+	"main/interfaces"
+	"main/memtable"
+)
+
+/*
+ * The row cache keeps the result of table lookups, keyed by the table
+ * and the user key. A row is the newest version of the key in that
+ * table, so it is never stale: writes made after it was cached are in
+ * a memtable or a newer table, and getAt looks at those first. Rows are
+ * kept as stored, expiring values are checked every time they are read.
+ * When compaction drops a table its rows are no longer looked up and
+ * age out.
+ */
+
+// rowCacheOverhead is charged for every row on top of key and value.
+const rowCacheOverhead = 64
+
+// findCached is findAt going through the row cache. Reads of an older
+// version than the newest in the table bypass it, and so do merge
+// operands, they are read along with the versions under them.
+func (t *SSTable) findCached(rows *cache.Cache, key interfaces.Comparable, seq uint64) (*memtable.Entry, error) {
+	if rows == nil || seq < t.maxSeq {
+		return t.findAt(key, seq)
+	}
+	filter, err := t.filter()
+	if err != nil {
+		return nil, err
+	}
+	if found, err := filter.Contains(key); err != nil || !found {
+		return nil, err
+	}
+	keyBytes, err := key.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	rowKey := cache.Key{ID: t.id, Row: string(keyBytes)}
+	if row, ok := rows.Get(rowKey); ok {
+		return row.(*memtable.Entry), nil
+	}
+	entry, err := t.find(key, seq)
+	if err == nil && entry != nil && entry.Kind != memtable.KindMerge {
+		rows.Insert(rowKey, entry, int64(len(keyBytes)+len(entry.Value)+rowCacheOverhead))
+	}
+	return entry, err
+}
+
+// SetRowCache turns the row cache on, or off for nil. Rows of the cache
+// used so far are left to age out.
+func (l *LSM) SetRowCache(c *cache.Cache) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rowCache = c
+}
+
+// RowCacheStats reports the hits, misses and memory usage of the row
+// cache, all zero if it is off.
+func (l *LSM) RowCacheStats() cache.Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.rowCache == nil {
+		return cache.Stats{}
+	}
+	return l.rowCache.Stats()
+}
@@ -0,0 +1,118 @@
+package lsmtree
+
+import (
+	"main/cache"
+	"main/keys"
+	"strconv"
+	"testing"
+)
+
+func TestRowCacheFollowsWrites(t *testing.T) {
+	useTempDataDir(t)
+	strategy := NewLeveledStrategy()
+	strategy.L0CompactionTrigger = 1
+	lsm := newTestLSM(t, 10, 2, 0.01, strategy)
+	lsm.SetRowCache(cache.New(1<<20, cache.LRU))
+
+	// reads only go through the row cache once keys are in tables.
+	flushed := func() {
+		t.Helper()
+		putRound(t, lsm, "filler", 10)
+		if err := lsm.waitForFlush(); err != nil {
+			t.Fatalf("flush failed: %v", err)
+		}
+	}
+	expect := func(key uint32, want string) {
+		t.Helper()
+		found, got, err := lsm.Get(keys.NewIntKey(key))
+		if err != nil {
+			t.Fatalf("Get failed for key %d: %v", key, err)
+		}
+		if want == "" {
+			if found && got != nil {
+				t.Errorf("Expected key %d to be deleted, got %s", key, got)
+			}
+			return
+		}
+		if !found || string(got) != want {
+			t.Errorf("Expected %s for key %d, got %s", want, key, got)
+		}
+	}
+
+	for i := range 30 {
+		if err := lsm.Put(keys.NewIntKey(uint32(100+i)), []byte("old_"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Put failed at %d: %v", i, err)
+		}
+	}
+	flushed()
+	snap := lsm.NewSnapshot()
+	defer snap.Release()
+
+	expect(105, "old_5")
+	expect(105, "old_5")
+	if stats := lsm.RowCacheStats(); stats.Hits != 1 || stats.Usage == 0 {
+		t.Errorf("Expected the second read to hit the row cache, got %+v", stats)
+	}
+
+	// the cached rows get shadowed by the memtable, then by newer tables.
+	lsm.Put(keys.NewIntKey(105), []byte("new_5"))
+	lsm.Delete(keys.NewIntKey(106))
+	batch := NewWriteBatch()
+	batch.Put(keys.NewIntKey(107), []byte("new_7"))
+	batch.Delete(keys.NewIntKey(105))
+	if err := lsm.Write(batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	for range 2 {
+		expect(105, "")
+		expect(106, "")
+		expect(107, "new_7")
+		expect(108, "old_8")
+		flushed()
+	}
+
+	// compaction merges every table into new ones, cached rows of the
+	// old ones are never looked at again.
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	for range 2 {
+		expect(105, "")
+		expect(106, "")
+		expect(107, "new_7")
+		expect(108, "old_8")
+	}
+
+	// the snapshot is older than the newest versions, it bypasses rows.
+	if found, got, err := snap.Get(keys.NewIntKey(107)); err != nil || !found || string(got) != "old_7" {
+		t.Errorf("Expected the snapshot to read old_7, got %s, %v", got, err)
+	}
+
+	lsm.SetRowCache(nil)
+	expect(107, "new_7")
+	if stats := lsm.RowCacheStats(); stats != (cache.Stats{}) {
+		t.Errorf("Expected no stats with the row cache off, got %+v", stats)
+	}
+}
+
+func TestRowCacheSizeCap(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 100, 2, 0.01, nil)
+	rows := cache.New(4<<10, cache.LRU)
+	lsm.SetRowCache(rows)
+
+	putRound(t, lsm, "value", 300)
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	for i := range 200 {
+		if found, _, err := lsm.Get(keys.NewIntKey(uint32(i))); err != nil || !found {
+			t.Fatalf("Expected key %d, got %v", i, err)
+		}
+	}
+
+	stats := rows.Stats()
+	if stats.Usage > 4<<10 || stats.Evictions == 0 {
+		t.Errorf("Expected the row cache to stay within 4 KiB by evicting rows, got %+v", stats)
+	}
+}
@@ -0,0 +1,64 @@
+package lsmtree
+
+import (
+	"slices"
+
+	"main/interfaces"
+)
+
+// Snapshot is a read-only view of the tree as of the write that came
+// right before it. Compaction keeps the versions a snapshot can see
+// until it is released.
+type Snapshot struct {
+	lsm      *LSM
+	seq      uint64
+	released bool
+}
+
+func (l *LSM) NewSnapshot() *Snapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := &Snapshot{lsm: l, seq: l.seq}
+	l.snapshots = append(l.snapshots, s)
+	return s
+}
+
+// Sequence is the number of the last write the snapshot sees.
+func (s *Snapshot) Sequence() uint64 {
+	return s.seq
+}
+
+func (s *Snapshot) Get(key interfaces.Comparable) (bool, []byte, error) {
+	s.lsm.mu.RLock()
+	return s.lsm.getAt(key, s.seq)
+}
+
+// NewIterator returns an unpositioned iterator over the snapshot.
+func (s *Snapshot) NewIterator() (Iterator, error) {
+	s.lsm.mu.RLock()
+	return s.lsm.newIterator(s.seq, nil)
+}
+
+// Release lets compaction drop the versions only this snapshot needed,
+// the snapshot must not be used afterwards.
+func (s *Snapshot) Release() {
+	l := s.lsm
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	if i := slices.Index(l.snapshots, s); i >= 0 {
+		l.snapshots = slices.Delete(l.snapshots, i, i+1)
+	}
+}
+
+// smallestSnapshot is the oldest sequence number any reader can still
+// ask for, the caller must hold l.mu.
+func (l *LSM) smallestSnapshot() uint64 {
+	if len(l.snapshots) > 0 {
+		return l.snapshots[0].seq
+	}
+	return l.seq
+}
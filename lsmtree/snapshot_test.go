@@ -0,0 +1,182 @@
+package lsmtree
+
+import (
+	"main/keys"
+	"strconv"
+	"testing"
+)
+
+func putRound(t *testing.T, lsm *LSM, round string, n int) {
+	for i := range n {
+		if err := lsm.Put(keys.NewIntKey(uint32(i)), []byte(round+"_"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Put failed at %d: %v", i, err)
+		}
+	}
+}
+
+// countVersions counts the versions of key left in the tables.
+func countVersions(t *testing.T, lsm *LSM, key uint32) int {
+	lsm.mu.RLock()
+	tables := lsm.refTables()
+	lsm.mu.RUnlock()
+	defer unrefTables(tables)
+
+	count := 0
+	for _, table := range tables {
+		entries, err := table.entries()
+		if err != nil {
+			t.Fatalf("entries failed: %v", err)
+		}
+		for _, entry := range entries {
+			if userKey(entry.Key).Compare(keys.NewIntKey(key)) == 0 {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func TestSnapshotSurvivesFlushAndCompaction(t *testing.T) {
+	useTempDataDir(t)
+	// every flush gets merged into L1 right away.
+	strategy := NewLeveledStrategy()
+	strategy.L0CompactionTrigger = 1
+	lsm := newTestLSM(t, 10, 2, 0.01, strategy)
+	n := 40
+
+	putRound(t, lsm, "old", n)
+	snap := lsm.NewSnapshot()
+	putRound(t, lsm, "new", n)
+	lsm.Delete(keys.NewIntKey(7))
+
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	for i := range n {
+		found, got, err := snap.Get(keys.NewIntKey(uint32(i)))
+		want := "old_" + strconv.Itoa(i)
+		if err != nil || !found || string(got) != want {
+			t.Errorf("Expected snapshot to read '%s' for key %d, got '%s'", want, i, string(got))
+		}
+
+		found, got, err = lsm.Get(keys.NewIntKey(uint32(i)))
+		if err != nil {
+			t.Fatalf("Get failed for key %d: %v", i, err)
+		}
+		if i == 7 {
+			if found && got != nil {
+				t.Errorf("Expected key 7 to be deleted, got '%s'", string(got))
+			}
+			continue
+		}
+		if want := "new_" + strconv.Itoa(i); !found || string(got) != want {
+			t.Errorf("Expected '%s' for key %d, got '%s'", want, i, string(got))
+		}
+	}
+
+	if versions := countVersions(t, lsm, 3); versions != 2 {
+		t.Errorf("Expected the snapshot to pin both versions of key 3, got %d", versions)
+	}
+
+	// once released, the next compaction only keeps the newest version.
+	snap.Release()
+	putRound(t, lsm, "newer", n)
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if versions := countVersions(t, lsm, 3); versions != 1 {
+		t.Errorf("Expected a single version of key 3 after release, got %d", versions)
+	}
+}
+
+func TestSnapshotIterator(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 7, 2, 0.01, nil)
+	n := 30
+
+	putRound(t, lsm, "old", n)
+	lsm.Delete(keys.NewIntKey(5))
+	snap := lsm.NewSnapshot()
+	defer snap.Release()
+
+	putRound(t, lsm, "new", n)
+	lsm.Delete(keys.NewIntKey(10))
+	lsm.Put(keys.NewIntKey(1000), []byte("later"))
+
+	it, err := snap.NewIterator()
+	if err != nil {
+		t.Fatalf("NewIterator failed: %v", err)
+	}
+	defer it.Close()
+
+	var forward []uint32
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key := it.Key().GetValue().(uint32)
+		if want := "old_" + strconv.Itoa(int(key)); string(it.Value()) != want {
+			t.Errorf("Expected '%s' for key %d, got '%s'", want, key, it.Value())
+		}
+		forward = append(forward, key)
+	}
+	if len(forward) != n-1 {
+		t.Fatalf("Expected %d keys in the snapshot, got %d", n-1, len(forward))
+	}
+	for _, key := range forward {
+		if key == 5 {
+			t.Errorf("Key 5 was deleted before the snapshot")
+		}
+	}
+
+	i := len(forward) - 1
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		if key := it.Key().GetValue().(uint32); key != forward[i] {
+			t.Errorf("Expected key %d going backward, got %d", forward[i], key)
+		}
+		if want := "old_" + strconv.Itoa(int(forward[i])); string(it.Value()) != want {
+			t.Errorf("Expected '%s' going backward, got '%s'", want, it.Value())
+		}
+		i--
+	}
+	if i != -1 {
+		t.Errorf("Expected to walk back over all keys, %d left", i+1)
+	}
+
+	// the snapshot still sees key 10, the tree doesn't.
+	if found, got, _ := snap.Get(keys.NewIntKey(10)); !found || string(got) != "old_10" {
+		t.Errorf("Expected the snapshot to read old_10, got '%s'", string(got))
+	}
+	if found, got, _ := lsm.Get(keys.NewIntKey(10)); found && got != nil {
+		t.Errorf("Expected key 10 to be deleted, got '%s'", string(got))
+	}
+}
+
+func TestSequenceNumbersSurviveRestart(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 10, 2, 0.01, nil)
+	putRound(t, lsm, "old", 35)
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	seq := lsm.NewSnapshot().Sequence()
+	crash(lsm)
+
+	reopened := newTestLSM(t, 10, 2, 0.01, nil)
+	if got := reopened.NewSnapshot().Sequence(); got != seq {
+		t.Errorf("Expected sequence %d after restart, got %d", seq, got)
+	}
+
+	// new writes have to shadow everything written before the restart.
+	putRound(t, reopened, "new", 35)
+	for i := range 35 {
+		found, got, err := reopened.Get(keys.NewIntKey(uint32(i)))
+		if want := "new_" + strconv.Itoa(i); err != nil || !found || string(got) != want {
+			t.Errorf("Expected '%s' for key %d, got '%s'", want, i, string(got))
+		}
+	}
+}
@@ -0,0 +1,744 @@
+package lsmtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sync/atomic"
+
+	"main/bloomfilter"
+	"main/cache"
+	"main/compression"
+	"main/interfaces"
+	"main/keys"
+	"main/memtable"
+	"main/util"
+)
+
+/*
+ * SSTable file layout (version 1):
+ *   [data block 0]
+ *   ...
+ *   [data block N]
+ *   [bloom block]   - BloomFilter.MarshalBinary output
+ *   [index block]   - see encodeBlockIndex
+ *   [range block]   - range tombstones, see rangedel.go
+ *   [72 bytes]      - footer:
+ *       [8 bytes] - Range block offset (uint64)
+ *       [8 bytes] - Range block length (uint64)
+ *       [8 bytes] - Bloom block offset (uint64)
+ *       [8 bytes] - Bloom block length (uint64)
+ *       [8 bytes] - Index block offset (uint64)
+ *       [8 bytes] - Index block length (uint64)
+ *       [8 bytes] - Largest sequence number (uint64)
+ *       [4 bytes] - Number of entries (uint32)
+ *       [4 bytes] - Format version (uint32)
+ *       [8 bytes] - Magic number
+ *
+ * Every block is followed by the CRC32C of its content, block lengths
+ * stored in the index and footer don't include those 4 bytes. Data
+ * blocks are a run of records (see record.go) cut once they grow past
+ * dataBlockSize, so a lookup reads and verifies a single block.
+ *
+ * Data blocks start with a one byte header naming the codec of the rest
+ * of the block (see the compression package), the checksum covers the
+ * stored bytes. A block that doesn't shrink is stored with the "none"
+ * codec, so a single file can mix codecs.
+ *
+ * Data block records and block index keys are internal keys (see
+ * record.go). The key range of a table includes its range tombstones,
+ * a table may hold nothing else.
+ *
+ * Version 0 is the flat MemTable.Dump output, without a footer or
+ * checksums. It is still readable but no longer written, its filter and
+ * index are rebuilt when it is opened.
+ */
+
+const (
+	dataBlockSize = 4096
+
+	tableFooterSize           = 72
+	tableFormatVersion        = 1
+	tableMagic         uint64 = 0x6c736d626c6f636b // "lsmblock"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptionError reports a table whose content doesn't match what was
+// written, Block names the part of the file that failed to verify.
+type CorruptionError struct {
+	File   string
+	Block  string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupted sstable %s: %s at offset %d: %s", e.File, e.Block, e.Offset, e.Reason)
+}
+
+type blockHandle struct {
+	offset uint64
+	length uint32
+}
+
+func (h blockHandle) encode() []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint64(buf[0:8], h.offset)
+	binary.BigEndian.PutUint32(buf[8:12], h.length)
+	return buf
+}
+
+func decodeBlockHandle(buf []byte) blockHandle {
+	return blockHandle{
+		offset: binary.BigEndian.Uint64(buf[0:8]),
+		length: binary.BigEndian.Uint32(buf[8:12]),
+	}
+}
+
+func writeBlock(buf *bytes.Buffer, content []byte) blockHandle {
+	handle := blockHandle{offset: uint64(buf.Len()), length: uint32(len(content))}
+	buf.Write(content)
+	binary.Write(buf, binary.BigEndian, crc32.Checksum(content, castagnoli))
+	return handle
+}
+
+/*
+ * Index block format:
+ * [4 bytes] - Number of data blocks (uint32)
+ * For each data block:
+ *   [N bytes]  - First key of the block (keys.ParseKey format)
+ *   [12 bytes] - Block offset (uint64) and length (uint32)
+ * [N bytes] - Largest key of the table, only if there are blocks
+ */
+func encodeBlockIndex(index memtable.MemTableImplementation, maxKey interfaces.Comparable) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	entries := index.ToKVs()
+	if err := binary.Write(buf, binary.BigEndian, uint32(len(entries))); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		keyBytes, err := entry.Key.ToBytes()
+		if err != nil {
+			return nil, fmt.Errorf("error serializing index key: %w", err)
+		}
+		buf.Write(keyBytes)
+		buf.Write(entry.Value)
+	}
+
+	if len(entries) > 0 {
+		keyBytes, err := maxKey.ToBytes()
+		if err != nil {
+			return nil, fmt.Errorf("error serializing max key: %w", err)
+		}
+		buf.Write(keyBytes)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeIndexBlock reads the block index, the key range returned holds
+// user keys.
+func decodeIndexBlock(data []byte) (*memtable.AVLTree, interfaces.Comparable, interfaces.Comparable, error) {
+	rd := bytes.NewReader(data)
+	count, err := util.ParseInt32(rd)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error parsing index size: %w", err)
+	}
+
+	index := memtable.NewAVLTree()
+	var minKey, maxKey interfaces.Comparable
+	for i := uint32(0); i < count; i++ {
+		key, err := parseInternalKey(rd)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		value := make([]byte, 12)
+		if _, err := io.ReadFull(rd, value); err != nil {
+			return nil, nil, nil, fmt.Errorf("error parsing index value: %w", err)
+		}
+		index.Put(key, value)
+		if minKey == nil {
+			minKey = userKey(key)
+		}
+	}
+
+	if count > 0 {
+		maxKey, err = keys.ParseKey(rd)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return index, minKey, maxKey, nil
+}
+
+// buildTable encodes sorted entries and the range tombstones in dels in
+// the current format, compressing data blocks with compressor and
+// adding every key to bloom. The returned table still needs a file
+// location.
+func buildTable(entries []*memtable.Entry, dels rangeFragments, bloom *bloomfilter.BloomFilter, compressor compression.Compressor) (*bytes.Buffer, *SSTable, error) {
+	buf := new(bytes.Buffer)
+	index := memtable.NewAVLTree()
+	block := new(bytes.Buffer)
+	var firstKey interfaces.Comparable
+
+	finishBlock := func() error {
+		if block.Len() == 0 {
+			return nil
+		}
+		content, err := compressBlock(compressor, block.Bytes())
+		if err != nil {
+			return err
+		}
+		handle := writeBlock(buf, content)
+		index.Put(firstKey, handle.encode())
+		block.Reset()
+		return nil
+	}
+
+	var minSeq, maxSeq uint64 = math.MaxUint64, 0
+	for _, entry := range entries {
+		if block.Len() == 0 {
+			firstKey = entry.Key
+		}
+		seq := entry.Key.(*internalKey).seq
+		minSeq, maxSeq = min(minSeq, seq), max(maxSeq, seq)
+		if err := writeRecord(block, entry.Key, entry.Kind, entry.Value); err != nil {
+			return nil, nil, err
+		}
+		if err := bloom.Insert(userKey(entry.Key)); err != nil {
+			return nil, nil, err
+		}
+		if block.Len() >= dataBlockSize {
+			if err := finishBlock(); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if err := finishBlock(); err != nil {
+		return nil, nil, err
+	}
+	for _, tombstone := range dels.tombstones() {
+		minSeq, maxSeq = min(minSeq, tombstone.seq), max(maxSeq, tombstone.seq)
+	}
+
+	table := &SSTable{
+		dataLength:  buf.Len(),
+		sparseIndex: index,
+		bloomfilter: bloom,
+		version:     tableFormatVersion,
+		minSeq:      min(minSeq, maxSeq),
+		maxSeq:      maxSeq,
+		rangeDels:   dels,
+	}
+	table.setKeyRange(entries)
+	table.extendKeyRange()
+
+	bloomBytes, err := bloom.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	indexBytes, err := encodeBlockIndex(index, table.maxKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	rangeBytes, err := encodeRangeFragments(dels)
+	if err != nil {
+		return nil, nil, err
+	}
+	bloomHandle := writeBlock(buf, bloomBytes)
+	indexHandle := writeBlock(buf, indexBytes)
+	rangeHandle := writeBlock(buf, rangeBytes)
+	table.filterHandle, table.indexHandle = bloomHandle, indexHandle
+
+	footer := make([]byte, tableFooterSize)
+	binary.BigEndian.PutUint64(footer[0:8], rangeHandle.offset)
+	binary.BigEndian.PutUint64(footer[8:16], uint64(rangeHandle.length))
+	binary.BigEndian.PutUint64(footer[16:24], bloomHandle.offset)
+	binary.BigEndian.PutUint64(footer[24:32], uint64(bloomHandle.length))
+	binary.BigEndian.PutUint64(footer[32:40], indexHandle.offset)
+	binary.BigEndian.PutUint64(footer[40:48], uint64(indexHandle.length))
+	binary.BigEndian.PutUint64(footer[48:56], maxSeq)
+	binary.BigEndian.PutUint32(footer[56:60], uint32(len(entries)))
+	binary.BigEndian.PutUint32(footer[60:64], tableFormatVersion)
+	binary.BigEndian.PutUint64(footer[64:72], tableMagic)
+	buf.Write(footer)
+
+	return buf, table, nil
+}
+
+// compressBlock prefixes the stored form of a data block with the ID
+// of the codec that produced it.
+func compressBlock(compressor compression.Compressor, raw []byte) ([]byte, error) {
+	compressed, err := compressor.Compress(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error compressing block with %s: %w", compressor.Name(), err)
+	}
+
+	id := compressor.ID()
+	if len(compressed) >= len(raw) {
+		id, compressed = compression.NoneID, raw
+	}
+	content := make([]byte, 0, len(compressed)+1)
+	content = append(content, id)
+	return append(content, compressed...), nil
+}
+
+// readBlock reads a block and verifies its checksum. A block of a
+// mapped table is a slice of the mapping.
+func readBlock(f io.ReaderAt, path string, name string, handle blockHandle) ([]byte, error) {
+	var data []byte
+	var err error
+	if h, ok := f.(*tableHandle); ok && h.mapped() {
+		data, err = h.slice(int64(handle.offset), int(handle.length)+4)
+	} else {
+		data = make([]byte, int(handle.length)+4)
+		_, err = f.ReadAt(data, int64(handle.offset))
+	}
+	if err != nil {
+		if err == io.EOF {
+			return nil, &CorruptionError{File: path, Block: name, Offset: int64(handle.offset), Reason: "block runs past the end of the file"}
+		}
+		return nil, err
+	}
+
+	content := data[:handle.length]
+	want := binary.BigEndian.Uint32(data[handle.length:])
+	if crc32.Checksum(content, castagnoli) != want {
+		return nil, &CorruptionError{File: path, Block: name, Offset: int64(handle.offset), Reason: "checksum mismatch"}
+	}
+	return content, nil
+}
+
+// openSSTable reads only the footer, bloom block and index block of a
+// table, the data blocks stay on disk.
+func (l *LSM) openSSTable(path string, level int) (*SSTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, 8)
+	if info.Size() >= 8 {
+		if _, err := f.ReadAt(magic, info.Size()-8); err != nil {
+			return nil, err
+		}
+	}
+
+	var table *SSTable
+	switch binary.BigEndian.Uint64(magic) {
+	case tableMagic:
+		table, err = openBlockSSTable(f, info.Size(), level)
+	default:
+		table, err = l.openLegacySSTable(f, level)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.setupTable(table)
+	return table, nil
+}
+
+func openBlockSSTable(f *os.File, size int64, level int) (*SSTable, error) {
+	path := f.Name()
+	footerOffset := size - tableFooterSize
+	if footerOffset < 0 {
+		return nil, &CorruptionError{File: path, Block: "footer", Offset: 0, Reason: "file too short"}
+	}
+	footer := make([]byte, tableFooterSize)
+	if _, err := f.ReadAt(footer, footerOffset); err != nil {
+		return nil, err
+	}
+	version := binary.BigEndian.Uint32(footer[60:64])
+	if version != tableFormatVersion {
+		return nil, fmt.Errorf("sstable %s has unsupported format version %d", path, version)
+	}
+
+	rangeHandle := blockHandle{offset: binary.BigEndian.Uint64(footer[0:8]), length: uint32(binary.BigEndian.Uint64(footer[8:16]))}
+	bloomHandle := blockHandle{offset: binary.BigEndian.Uint64(footer[16:24]), length: uint32(binary.BigEndian.Uint64(footer[24:32]))}
+	indexHandle := blockHandle{offset: binary.BigEndian.Uint64(footer[32:40]), length: uint32(binary.BigEndian.Uint64(footer[40:48]))}
+	maxSeq := binary.BigEndian.Uint64(footer[48:56])
+	if bloomHandle.offset+uint64(bloomHandle.length)+4 > indexHandle.offset ||
+		indexHandle.offset+uint64(indexHandle.length)+4 > rangeHandle.offset ||
+		rangeHandle.offset+uint64(rangeHandle.length)+4 > uint64(footerOffset) {
+		return nil, &CorruptionError{File: path, Block: "footer", Offset: footerOffset, Reason: "block handles out of range"}
+	}
+
+	bloomBytes, err := readBlock(f, path, "bloom block", bloomHandle)
+	if err != nil {
+		return nil, err
+	}
+	bloomFilter := new(bloomfilter.BloomFilter)
+	if err := bloomFilter.UnmarshalBinary(bloomBytes); err != nil {
+		return nil, &CorruptionError{File: path, Block: "bloom block", Offset: int64(bloomHandle.offset), Reason: err.Error()}
+	}
+
+	indexBytes, err := readBlock(f, path, "index block", indexHandle)
+	if err != nil {
+		return nil, err
+	}
+	blockIndex, minKey, maxKey, err := decodeIndexBlock(indexBytes)
+	if err != nil {
+		return nil, &CorruptionError{File: path, Block: "index block", Offset: int64(indexHandle.offset), Reason: err.Error()}
+	}
+
+	rangeBytes, err := readBlock(f, path, "range block", rangeHandle)
+	if err != nil {
+		return nil, err
+	}
+	dels, err := decodeRangeFragments(rangeBytes)
+	if err != nil {
+		return nil, &CorruptionError{File: path, Block: "range block", Offset: int64(rangeHandle.offset), Reason: err.Error()}
+	}
+
+	table := &SSTable{
+		dataLocation: path,
+		dataLength:   int(bloomHandle.offset),
+		sparseIndex:  blockIndex,
+		bloomfilter:  bloomFilter,
+		level:        level,
+		minKey:       minKey,
+		maxKey:       maxKey,
+		version:      version,
+		maxSeq:       maxSeq,
+		rangeDels:    dels,
+		filterHandle: bloomHandle,
+		indexHandle:  indexHandle,
+	}
+	table.extendKeyRange()
+	table.refs.Store(1)
+	return table, nil
+}
+
+// openLegacySSTable rebuilds the filter and index of a version 0 table
+// written without them by reading the whole data section.
+func (l *LSM) openLegacySSTable(f *os.File, level int) (*SSTable, error) {
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(f); err != nil {
+		return nil, err
+	}
+	dataLength := buf.Len()
+
+	// merged tables can be a lot bigger than a memtable, size the
+	// filter from the entry count in the header.
+	tableLength, err := util.ParseInt32(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	sparseIndex := memtable.NewAVLTree()
+	bloomFilter := bloomfilter.NewBloomFilter(max(tableLength, 1), l.falsePositiveRate)
+	mem := memtable.NewMemTable(memtable.NewAVLTree())
+
+	if err := mem.Load(buf, bloomFilter, sparseIndex, int32(l.sparsityFactor)); err != nil {
+		return nil, err
+	}
+
+	table := &SSTable{
+		dataLocation: f.Name(),
+		dataLength:   dataLength,
+		sparseIndex:  sparseIndex,
+		bloomfilter:  bloomFilter,
+		level:        level,
+	}
+	table.setKeyRange(mem.Entries())
+	table.refs.Store(1)
+	return table, nil
+}
+
+// tables get an ID that is unique within the process, the caches key
+// their entries by it.
+var nextTableID atomic.Uint64
+
+// setupTable hands a new or just opened table what it takes from the
+// LSM.
+func (l *LSM) setupTable(t *SSTable) {
+	t.id = nextTableID.Add(1)
+	t.logger = l.logger
+	t.files = l.tableCache
+	t.attachCache(l.blockCache)
+}
+
+// attachCache hands the filter and index blocks of the table over to
+// the block cache, they are pinned there until the table is dropped and
+// lookups read them back from it. Version 0 tables have no blocks to
+// pin, they keep theirs.
+func (t *SSTable) attachCache(c *cache.Cache) {
+	if c == nil {
+		return
+	}
+	t.blockCache = c
+	if t.filterHandle.length > 0 {
+		c.InsertPinned(cache.Key{ID: t.id, Offset: t.filterHandle.offset}, t.bloomfilter, int64(t.filterHandle.length))
+		t.bloomfilter = nil
+	}
+	if t.indexHandle.length > 0 {
+		c.InsertPinned(cache.Key{ID: t.id, Offset: t.indexHandle.offset}, t.sparseIndex, int64(t.indexHandle.length))
+		t.sparseIndex = nil
+	}
+}
+
+// detachCache unpins the filter and index blocks, data blocks of the
+// table age out of the cache on their own.
+func (t *SSTable) detachCache() {
+	if t.blockCache == nil {
+		return
+	}
+	for _, handle := range []blockHandle{t.filterHandle, t.indexHandle} {
+		t.blockCache.Erase(cache.Key{ID: t.id, Offset: handle.offset})
+	}
+}
+
+// filter returns the bloom filter of the table.
+func (t *SSTable) filter() (bloomfilter.BloomFilterImplementation, error) {
+	if t.bloomfilter != nil {
+		return t.bloomfilter, nil
+	}
+	if value, ok := t.blockCache.GetPinned(cache.Key{ID: t.id, Offset: t.filterHandle.offset}); ok {
+		return value.(bloomfilter.BloomFilterImplementation), nil
+	}
+	// only a reader that outlived Close gets here, the block is read
+	// again for it but not pinned.
+	data, err := t.readMetaBlock("bloom block", t.filterHandle)
+	if err != nil {
+		return nil, err
+	}
+	bloomFilter := new(bloomfilter.BloomFilter)
+	if err := bloomFilter.UnmarshalBinary(data); err != nil {
+		return nil, &CorruptionError{File: t.dataLocation, Block: "bloom block", Offset: int64(t.filterHandle.offset), Reason: err.Error()}
+	}
+	return bloomFilter, nil
+}
+
+// index returns the sparse index of the table, the first key and the
+// handle of every data block for block based tables.
+func (t *SSTable) index() (memtable.MemTableImplementation, error) {
+	if t.sparseIndex != nil {
+		return t.sparseIndex, nil
+	}
+	if value, ok := t.blockCache.GetPinned(cache.Key{ID: t.id, Offset: t.indexHandle.offset}); ok {
+		return value.(memtable.MemTableImplementation), nil
+	}
+	data, err := t.readMetaBlock("index block", t.indexHandle)
+	if err != nil {
+		return nil, err
+	}
+	blockIndex, _, _, err := decodeIndexBlock(data)
+	if err != nil {
+		return nil, &CorruptionError{File: t.dataLocation, Block: "index block", Offset: int64(t.indexHandle.offset), Reason: err.Error()}
+	}
+	return blockIndex, nil
+}
+
+// readMetaBlock reads the filter or the index block from the file.
+func (t *SSTable) readMetaBlock(name string, handle blockHandle) ([]byte, error) {
+	h, err := t.files.acquire(t)
+	if err != nil {
+		return nil, err
+	}
+	defer t.files.release(h)
+	data, err := readBlock(h, t.dataLocation, name, handle)
+	if err != nil {
+		return nil, err
+	}
+	// mapped blocks go away with the handle.
+	return bytes.Clone(data), nil
+}
+
+// tableReader reads data blocks through the block cache, a handle of
+// the table file is only taken once a block isn't cached. Blocks are
+// valid until Close.
+type tableReader struct {
+	table *SSTable
+	h     *tableHandle
+}
+
+func (r *tableReader) dataBlock(handle blockHandle) ([]byte, error) {
+	t := r.table
+	key := cache.Key{ID: t.id, Offset: handle.offset}
+	if t.blockCache != nil {
+		if block, ok := t.blockCache.Get(key); ok {
+			return block.([]byte), nil
+		}
+	}
+
+	if r.h == nil {
+		h, err := t.files.acquire(t)
+		if err != nil {
+			return nil, err
+		}
+		r.h = h
+	}
+	block, stored, err := t.readDataBlock(r.h, handle)
+	if err != nil {
+		return nil, err
+	}
+	// a block stored uncompressed in a mapped table is a slice of the
+	// mapping, it goes away with the handle. The page cache keeps it.
+	if t.blockCache != nil && !(stored && r.h.mapped()) {
+		t.blockCache.Insert(key, block, int64(len(block)))
+	}
+	return block, nil
+}
+
+func (r *tableReader) Close() {
+	if r.h != nil {
+		r.table.files.release(r.h)
+	}
+}
+
+// readDataBlock returns the decompressed records of a data block,
+// stored tells whether they are the bytes read from f as they are.
+func (t *SSTable) readDataBlock(f io.ReaderAt, handle blockHandle) (block []byte, stored bool, err error) {
+	name := fmt.Sprintf("data block at %d", handle.offset)
+	content, err := readBlock(f, t.dataLocation, name, handle)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(content) == 0 {
+		return nil, false, &CorruptionError{File: t.dataLocation, Block: name, Offset: int64(handle.offset), Reason: "missing block header"}
+	}
+	compressor, err := compression.Lookup(content[0])
+	if err != nil {
+		return nil, false, &CorruptionError{File: t.dataLocation, Block: name, Offset: int64(handle.offset), Reason: err.Error()}
+	}
+	block, err = compressor.Decompress(content[1:])
+	if err != nil {
+		return nil, false, &CorruptionError{File: t.dataLocation, Block: name, Offset: int64(handle.offset), Reason: fmt.Sprintf("error decompressing %s block: %v", compressor.Name(), err)}
+	}
+	return block, compressor.ID() == compression.NoneID, nil
+}
+
+// readRecord reads a data block record.
+func (t *SSTable) readRecord(rd *bytes.Reader) (*memtable.Entry, error) {
+	return readRecordWith(rd, parseInternalKey)
+}
+
+// blocksFor returns the blocks that can hold the first record >= key,
+// in order.
+func (t *SSTable) blocksFor(index memtable.MemTableImplementation, key *internalKey) []blockHandle {
+	var handles []blockHandle
+	if handleBytes := index.Floor(key); handleBytes != nil {
+		handles = append(handles, decodeBlockHandle(handleBytes))
+	}
+	if handleBytes := index.Ceil(key); handleBytes != nil {
+		if handle := decodeBlockHandle(handleBytes); len(handles) == 0 || handles[0] != handle {
+			handles = append(handles, handle)
+		}
+	}
+	return handles
+}
+
+// findInBlock looks up the newest version of key.user visible at
+// key.seq, nil if the table has none.
+func (t *SSTable) findInBlock(key *internalKey) (*memtable.Entry, error) {
+	var found *memtable.Entry
+	err := t.versions(key, func(entry *memtable.Entry) bool {
+		found = entry
+		return false
+	})
+	return found, err
+}
+
+// versions calls fn with the versions of key.user visible at key.seq,
+// newest first, until fn returns false. The first of them is the first
+// record >= key, which is either in the block starting at or before key
+// or the first record of the next one. Older versions may go on into
+// the blocks after that.
+func (t *SSTable) versions(key *internalKey, fn func(*memtable.Entry) bool) error {
+	index, err := t.index()
+	if err != nil {
+		return err
+	}
+	handles := t.blocksFor(index, key)
+	if len(handles) == 0 {
+		return nil
+	}
+
+	r := &tableReader{table: t}
+	defer r.Close()
+
+	for len(handles) > 0 {
+		handle := handles[0]
+		handles = handles[1:]
+		block, err := r.dataBlock(handle)
+		if err != nil {
+			return err
+		}
+
+		var last *internalKey
+		rd := bytes.NewReader(block)
+		for rd.Len() > 0 {
+			entry, err := t.readRecord(rd)
+			if err != nil {
+				return &CorruptionError{File: t.dataLocation, Block: fmt.Sprintf("data block at %d", handle.offset), Offset: int64(handle.offset), Reason: err.Error()}
+			}
+
+			if entry.Key.Compare(key) < 0 {
+				continue
+			}
+			if userKey(entry.Key).Compare(key.user) != 0 || !fn(entry) {
+				return nil
+			}
+			last = entry.Key.(*internalKey)
+		}
+
+		// the block ended on a version of the key, the next one starts
+		// right after it.
+		if last != nil {
+			if last.seq == 0 {
+				return nil
+			}
+			handleBytes := index.Ceil(newInternalKey(last.user, last.seq-1))
+			if handleBytes == nil {
+				return nil
+			}
+			handles = []blockHandle{decodeBlockHandle(handleBytes)}
+		}
+	}
+	return nil
+}
+
+// blockEntries decodes every data block of a block based table. Scans
+// and compactions read whole tables, they bypass the block cache so
+// they don't push the blocks of point lookups out of it.
+func (t *SSTable) blockEntries() ([]*memtable.Entry, error) {
+	h, err := t.files.acquire(t)
+	if err != nil {
+		return nil, err
+	}
+	defer t.files.release(h)
+
+	index, err := t.index()
+	if err != nil {
+		return nil, err
+	}
+	var entries []*memtable.Entry
+	for _, indexEntry := range index.ToKVs() {
+		handle := decodeBlockHandle(indexEntry.Value)
+		block, _, err := t.readDataBlock(h, handle)
+		if err != nil {
+			return nil, err
+		}
+
+		rd := bytes.NewReader(block)
+		for rd.Len() > 0 {
+			entry, err := t.readRecord(rd)
+			if err != nil {
+				return nil, &CorruptionError{File: t.dataLocation, Block: fmt.Sprintf("data block at %d", handle.offset), Offset: int64(handle.offset), Reason: err.Error()}
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,425 @@
+package lsmtree
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"main/bloomfilter"
+	"main/cache"
+	"main/compression"
+	"main/keys"
+	"main/memtable"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func fillMemTable(n int) *memtable.MemTable {
+	mem := memtable.NewMemTable(memtable.NewAVLTree())
+	for i := range n {
+		mem.Put(ikey(uint32(i*2), uint64(i+1)), []byte("val_"+strconv.Itoa(i*2)))
+	}
+	return mem
+}
+
+// fillLegacyMemTable holds plain user keys, the way version 0 tables
+// were dumped.
+func fillLegacyMemTable(n int) *memtable.MemTable {
+	mem := memtable.NewMemTable(memtable.NewAVLTree())
+	for i := range n {
+		mem.Put(keys.NewIntKey(uint32(i*2)), []byte("val_"+strconv.Itoa(i*2)))
+	}
+	return mem
+}
+
+func TestOpenSSTableReadsPersistedMeta(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 100, 3, 0.01, nil)
+
+	// enough entries to need several data blocks.
+	written, err := lsm.writeSSTable(fillMemTable(1000), 2)
+	if err != nil {
+		t.Fatalf("writeSSTable failed: %v", err)
+	}
+
+	opened, err := lsm.openSSTable(written.dataLocation, 2)
+	if err != nil {
+		t.Fatalf("openSSTable failed: %v", err)
+	}
+
+	if opened.dataLength != written.dataLength {
+		t.Errorf("Expected data length %d, got %d", written.dataLength, opened.dataLength)
+	}
+	if opened.minKey.Compare(keys.NewIntKey(0)) != 0 || opened.maxKey.Compare(keys.NewIntKey(1998)) != 0 {
+		t.Errorf("Expected key range [0, 1998], got [%v, %v]", opened.minKey.GetValue(), opened.maxKey.GetValue())
+	}
+
+	wantBloom, _ := tableFilter(t, written).(*bloomfilter.BloomFilter).MarshalBinary()
+	gotBloom, _ := tableFilter(t, opened).(*bloomfilter.BloomFilter).MarshalBinary()
+	if !bytes.Equal(wantBloom, gotBloom) {
+		t.Errorf("Bloom filter read back differs from the one written")
+	}
+
+	wantIndex, gotIndex := tableIndex(t, written), tableIndex(t, opened)
+	if len(wantIndex) < 2 {
+		t.Errorf("Expected the table to span several blocks, got %d", len(wantIndex))
+	}
+	if len(wantIndex) != len(gotIndex) {
+		t.Fatalf("Expected %d index entries, got %d", len(wantIndex), len(gotIndex))
+	}
+	for i := range wantIndex {
+		if wantIndex[i].Key.Compare(gotIndex[i].Key) != 0 || !bytes.Equal(wantIndex[i].Value, gotIndex[i].Value) {
+			t.Errorf("Index entry %d differs", i)
+		}
+	}
+
+	for i := range 2000 {
+		found, got, err := opened.Find(keys.NewIntKey(uint32(i)))
+		if err != nil {
+			t.Fatalf("Find failed for key %d: %v", i, err)
+		}
+		if i%2 == 1 {
+			if found {
+				t.Errorf("Key %d was never written", i)
+			}
+			continue
+		}
+		if !found || string(got) != "val_"+strconv.Itoa(i) {
+			t.Errorf("Expected value 'val_%d' for key '%d', got '%s'", i, i, string(got))
+		}
+	}
+
+	entries, err := opened.entries()
+	if err != nil {
+		t.Fatalf("entries failed: %v", err)
+	}
+	if len(entries) != 1000 {
+		t.Errorf("Expected 1000 entries read back, got %d", len(entries))
+	}
+}
+
+func TestOpenLegacySSTable(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 100, 3, 0.01, nil)
+
+	// a table from before the footer existed is just the dump.
+	buf := new(bytes.Buffer)
+	if err := fillLegacyMemTable(40).Dump(buf, nil, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "sstable_1")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := lsm.openSSTable(path, 0)
+	if err != nil {
+		t.Fatalf("openSSTable failed: %v", err)
+	}
+	if table.dataLength != buf.Len() {
+		t.Errorf("Expected data length %d, got %d", buf.Len(), table.dataLength)
+	}
+	for i := 0; i < 80; i += 2 {
+		found, got, err := table.Find(keys.NewIntKey(uint32(i)))
+		if err != nil {
+			t.Fatalf("Find failed for key %d: %v", i, err)
+		}
+		if !found || string(got) != "val_"+strconv.Itoa(i) {
+			t.Errorf("Expected value 'val_%d' for key '%d', got '%s'", i, i, string(got))
+		}
+	}
+}
+
+func flipByte(t *testing.T, path string, offset int64) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tableFilter and tableIndex read the filter and index of a table the
+// way lookups do, from the block cache when they are pinned there.
+func tableFilter(t *testing.T, table *SSTable) bloomfilter.BloomFilterImplementation {
+	t.Helper()
+	filter, err := table.filter()
+	if err != nil {
+		t.Fatalf("reading the filter of %s failed: %v", table.dataLocation, err)
+	}
+	return filter
+}
+
+func tableIndex(t *testing.T, table *SSTable) []*memtable.Entry {
+	t.Helper()
+	index, err := table.index()
+	if err != nil {
+		t.Fatalf("reading the index of %s failed: %v", table.dataLocation, err)
+	}
+	return index.ToKVs()
+}
+
+func TestTableFileNamesAreUnique(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 100, 3, 0.01, nil)
+
+	// a file left under the next number is skipped, not truncated.
+	lsm.lastFileNumber.Store(math.MaxUint64 / 2)
+	taken := filepath.Join(lsm.dataPath, fmt.Sprintf("sstable_%d", uint64(math.MaxUint64/2+1)))
+	if err := os.WriteFile(taken, []byte("taken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	names := make([]string, 8)
+	for i := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			table, err := lsm.writeSSTable(fillMemTable(10), 0)
+			if err != nil {
+				t.Errorf("writeSSTable failed: %v", err)
+				return
+			}
+			names[i] = table.dataLocation
+		}()
+	}
+	wg.Wait()
+
+	slices.Sort(names)
+	if len(slices.Compact(names)) != 8 || slices.Contains(names, taken) {
+		t.Errorf("Expected 8 new file names, got %v", names)
+	}
+	if data, err := os.ReadFile(taken); err != nil || string(data) != "taken" {
+		t.Errorf("Expected the existing file to stay, got %q, %v", data, err)
+	}
+}
+
+func TestCorruptedBlocksAreReported(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 100, 3, 0.01, nil)
+
+	table, err := lsm.writeSSTable(fillMemTable(1000), 0)
+	if err != nil {
+		t.Fatalf("writeSSTable failed: %v", err)
+	}
+
+	// a bit flip in the second data block only breaks lookups hitting it.
+	second := decodeBlockHandle(tableIndex(t, table)[1].Value)
+	flipByte(t, table.dataLocation, int64(second.offset)+10)
+
+	firstKey := userKey(tableIndex(t, table)[1].Key)
+	_, _, err = table.Find(firstKey)
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) {
+		t.Fatalf("Expected a CorruptionError, got %v", err)
+	}
+	if corruption.File != table.dataLocation || corruption.Offset != int64(second.offset) {
+		t.Errorf("Expected the error to name %s at %d, got %v", table.dataLocation, second.offset, corruption)
+	}
+
+	if found, _, err := table.Find(keys.NewIntKey(0)); err != nil || !found {
+		t.Errorf("Expected keys of intact blocks to stay readable, got %v", err)
+	}
+
+	if _, err := table.entries(); !errors.As(err, &corruption) {
+		t.Errorf("Expected reading the whole table to fail with a CorruptionError, got %v", err)
+	}
+
+	flipByte(t, table.dataLocation, int64(table.indexHandle.offset)+2)
+	_, err = lsm.openSSTable(table.dataLocation, 0)
+	if !errors.As(err, &corruption) || corruption.Block != "index block" {
+		t.Errorf("Expected a corrupted index block, got %v", err)
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	blockCache := cache.New(1<<20, cache.Clock)
+	lsm, err := Open(t.TempDir(), WithThreshold(999), WithBlockCache(blockCache), WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for i := range 1000 {
+		if err := lsm.Put(keys.NewIntKey(uint32(i)), []byte("val_"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Put failed at %d: %v", i, err)
+		}
+	}
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	table := lsm.SStables[0]
+	if stats := lsm.BlockCacheStats(); stats.PinnedUsage != int64(table.filterHandle.length+table.indexHandle.length) {
+		t.Errorf("Expected the filter and index blocks to be pinned, got %+v", stats)
+	}
+	if table.bloomfilter != nil || table.sparseIndex != nil {
+		t.Errorf("Expected the table to read its filter and index from the cache")
+	}
+
+	for range 2 {
+		if found, got, err := lsm.Get(keys.NewIntKey(5)); err != nil || !found || string(got) != "val_5" {
+			t.Fatalf("Expected val_5, got %s, %v", got, err)
+		}
+	}
+	if stats := lsm.BlockCacheStats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Expected the second read to hit the cache, got %+v", stats)
+	}
+
+	// a cached block is never read again, damage on disk goes unnoticed.
+	first := decodeBlockHandle(tableIndex(t, table)[0].Value)
+	flipByte(t, table.dataLocation, int64(first.offset)+10)
+	if found, got, err := lsm.Get(keys.NewIntKey(5)); err != nil || !found || string(got) != "val_5" {
+		t.Errorf("Expected the cached block to serve key 5, got %s, %v", got, err)
+	}
+
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if stats := blockCache.Stats(); stats.PinnedUsage != 0 {
+		t.Errorf("Expected Close to unpin the blocks of its tables, got %+v", stats)
+	}
+
+	// a reader that outlives Close reads them from the file again.
+	if found, got, err := table.Find(keys.NewIntKey(7)); err != nil || !found || string(got) != "val_7" {
+		t.Errorf("Expected val_7 after Close, got %s, %v", got, err)
+	}
+}
+
+func TestMixedCompressionTablesStayReadable(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 100, 3, 0.01, nil)
+
+	codecs := []compression.Compressor{compression.Flate{Level: 6}, compression.Zlib{Level: 6}, compression.Gzip{Level: 6}, compression.None{}}
+	for i, codec := range codecs {
+		lsm.SetCompressor(codec)
+		for j := range 500 {
+			key := i*500 + j
+			if err := lsm.Put(keys.NewIntKey(uint32(key)), []byte(strings.Repeat("val_"+strconv.Itoa(key), 10))); err != nil {
+				t.Fatalf("Put failed at %d: %v", key, err)
+			}
+		}
+		if err := lsm.waitForFlush(); err != nil {
+			t.Fatalf("flush with %s failed: %v", codec.Name(), err)
+		}
+	}
+	crash(lsm)
+
+	reopened := newTestLSM(t, 100, 3, 0.01, nil)
+	for key := range 2000 {
+		found, got, err := reopened.Get(keys.NewIntKey(uint32(key)))
+		if err != nil || !found || string(got) != strings.Repeat("val_"+strconv.Itoa(key), 10) {
+			t.Fatalf("Expected key %d to be readable, got %v, %v", key, found, err)
+		}
+	}
+}
+
+func TestIncompressibleBlocksAreStoredRaw(t *testing.T) {
+	useTempDataDir(t)
+	lsm := newTestLSM(t, 100, 3, 0.01, nil)
+	lsm.SetCompressor(compression.Flate{Level: 6})
+
+	// compressible values and random ones end up in different blocks.
+	mem := memtable.NewMemTable(memtable.NewAVLTree())
+	values := map[uint32][]byte{}
+	for i := range 400 {
+		val := bytes.Repeat([]byte{'a'}, 100)
+		if i >= 200 {
+			val = make([]byte, 1000)
+			rand.Read(val)
+		}
+		values[uint32(i)] = val
+		mem.Put(ikey(uint32(i), uint64(i+1)), val)
+	}
+	table, err := lsm.writeSSTable(mem, 0)
+	if err != nil {
+		t.Fatalf("writeSSTable failed: %v", err)
+	}
+
+	data, err := os.ReadFile(table.dataLocation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codecs := map[byte]int{}
+	for _, entry := range tableIndex(t, table) {
+		codecs[data[decodeBlockHandle(entry.Value).offset]]++
+	}
+	if codecs[compression.FlateID] == 0 || codecs[compression.NoneID] == 0 {
+		t.Errorf("Expected both flate and raw blocks in the table, got %v", codecs)
+	}
+
+	for key, want := range values {
+		found, got, err := table.Find(keys.NewIntKey(key))
+		if err != nil || !found || !bytes.Equal(got, want) {
+			t.Errorf("Expected key %d to be readable, got %v, %v", key, found, err)
+		}
+	}
+}
+
+func TestUpgradeTables(t *testing.T) {
+	useTempDataDir(t)
+
+	// a version 0 table with a delete, left by a store from before the
+	// manifest.
+	mem := fillLegacyMemTable(40)
+	mem.Delete(keys.NewIntKey(4))
+	buf := new(bytes.Buffer)
+	if err := mem.Dump(buf, nil, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("data", "sstable_1"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(lsm *LSM) {
+		t.Helper()
+		for i := 0; i < 80; i += 2 {
+			found, got, err := lsm.Get(keys.NewIntKey(uint32(i)))
+			if err != nil {
+				t.Fatalf("Get failed for key %d: %v", i, err)
+			}
+			if i == 4 {
+				if found && got != nil {
+					t.Errorf("Expected key 4 to be deleted, got '%s'", got)
+				}
+				continue
+			}
+			if !found || string(got) != "val_"+strconv.Itoa(i) {
+				t.Errorf("Expected value 'val_%d' for key '%d', got '%s'", i, i, string(got))
+			}
+		}
+	}
+
+	lsm := newTestLSM(t, 100, 3, 0.01, nil)
+	check(lsm)
+	if err := lsm.UpgradeTables(); err != nil {
+		t.Fatalf("UpgradeTables failed: %v", err)
+	}
+
+	if len(lsm.SStables) != 1 || lsm.SStables[0].version != tableFormatVersion {
+		t.Fatalf("Expected a single table in version %d", tableFormatVersion)
+	}
+	entries, err := lsm.SStables[0].entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletes := 0
+	for _, entry := range entries {
+		if entry.Kind == memtable.KindDeletion {
+			deletes++
+		}
+	}
+	if deletes != 1 {
+		t.Errorf("Expected the delete to be kept as a deletion entry, found %d", deletes)
+	}
+	check(lsm)
+
+	crash(lsm)
+	check(newTestLSM(t, 100, 3, 0.01, nil))
+}
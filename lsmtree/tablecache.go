@@ -0,0 +1,203 @@
+package lsmtree
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+/*
+ * The table cache keeps up to capacity table files open so lookups
+ * don't pay for an open and a close each. Handles are reference
+ * counted: the cache holds one reference while a handle is in it and
+ * every reader holds one while using it, the file is closed when the
+ * last one is gone. Handles that don't fit are closed least recently
+ * used first.
+ *
+ * With mmap on, a table is mapped into memory instead and blocks are
+ * served as slices of the mapping, nothing is copied or read with a
+ * syscall. Such a block is only valid while the handle is held.
+ */
+
+const defaultMaxOpenFiles = 500
+
+type tableCache struct {
+	mu       sync.Mutex
+	capacity int
+	mmap     bool
+	handles  map[uint64]*list.Element
+	// least recently used at the back.
+	lru *list.List
+}
+
+type tableHandle struct {
+	id   uint64
+	f    *os.File
+	data []byte
+	// guarded by tableCache.mu.
+	refs int
+}
+
+func newTableCache(capacity int, mmap bool) *tableCache {
+	return &tableCache{capacity: capacity, mmap: mmap, handles: make(map[uint64]*list.Element), lru: list.New()}
+}
+
+// acquire returns an open handle for t, it must be given back with
+// release. A nil cache opens a handle for this caller only.
+func (c *tableCache) acquire(t *SSTable) (*tableHandle, error) {
+	if c == nil {
+		return openTableHandle(t, false)
+	}
+
+	c.mu.Lock()
+	if e, ok := c.handles[t.id]; ok {
+		c.lru.MoveToFront(e)
+		h := e.Value.(*tableHandle)
+		h.refs++
+		c.mu.Unlock()
+		return h, nil
+	}
+	c.mu.Unlock()
+
+	// opened without the lock, another reader may race us to it.
+	h, err := openTableHandle(t, c.mmap)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.handles[t.id]; ok {
+		h.close()
+		h = e.Value.(*tableHandle)
+		c.lru.MoveToFront(e)
+		h.refs++
+		return h, nil
+	}
+	h.refs = 2
+	c.handles[t.id] = c.lru.PushFront(h)
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+	return h, nil
+}
+
+func (c *tableCache) release(h *tableHandle) {
+	if c == nil {
+		h.close()
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h.refs--
+	if h.refs == 0 {
+		h.close()
+	}
+}
+
+// evict drops the handle of a table that is going away.
+func (c *tableCache) evict(id uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.handles[id]; ok {
+		c.remove(e)
+	}
+}
+
+// closeAll drops every handle, the ones in use get closed by their
+// last reader.
+func (c *tableCache) closeAll() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove takes a handle out of the cache, the caller holds c.mu.
+func (c *tableCache) remove(e *list.Element) {
+	h := c.lru.Remove(e).(*tableHandle)
+	delete(c.handles, h.id)
+	h.refs--
+	if h.refs == 0 {
+		h.close()
+	}
+}
+
+func (c *tableCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// openTableHandle opens the file of t, mapping it if asked to and the
+// platform can. A file that can't be mapped is read the usual way.
+func openTableHandle(t *SSTable, mmap bool) (*tableHandle, error) {
+	f, err := os.Open(t.dataLocation)
+	if err != nil {
+		return nil, err
+	}
+	h := &tableHandle{id: t.id, f: f, refs: 1}
+	if !mmap {
+		return h, nil
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	data, err := mmapFile(f, info.Size())
+	if err != nil {
+		return h, nil
+	}
+	// the mapping outlives the descriptor.
+	h.f, h.data = nil, data
+	f.Close()
+	return h, nil
+}
+
+func (h *tableHandle) mapped() bool {
+	return h.data != nil
+}
+
+func (h *tableHandle) ReadAt(p []byte, off int64) (int, error) {
+	if !h.mapped() {
+		return h.f.ReadAt(p, off)
+	}
+	if off >= int64(len(h.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// slice returns n bytes at off from the mapping, it must be mapped.
+func (h *tableHandle) slice(off int64, n int) ([]byte, error) {
+	if off+int64(n) > int64(len(h.data)) {
+		return nil, io.EOF
+	}
+	return h.data[off : off+int64(n) : off+int64(n)], nil
+}
+
+func (h *tableHandle) close() error {
+	if h.mapped() {
+		data := h.data
+		h.data = nil
+		return munmapFile(data)
+	}
+	return h.f.Close()
+}
+
+var errMmapUnsupported = errors.New("mmap is not supported on this platform")
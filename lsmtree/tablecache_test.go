@@ -0,0 +1,128 @@
+package lsmtree
+
+import (
+	"errors"
+	"main/cache"
+	"main/compression"
+	"main/keys"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// openUncompacted opens a store whose flushed tables stay as they are.
+func openUncompacted(t *testing.T, opts ...Option) *LSM {
+	strategy := NewLeveledStrategy()
+	strategy.L0CompactionTrigger = 100
+	opts = append([]Option{WithThreshold(10), WithCompactionStrategy(strategy), WithLogger(&logRecorder{})}, opts...)
+	lsm, err := Open(t.TempDir(), opts...)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { lsm.Close() })
+
+	putRound(t, lsm, "val", 55)
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	return lsm
+}
+
+func checkRound(t *testing.T, lsm *LSM, round string, n int) {
+	t.Helper()
+	for i := range n {
+		want := round + "_" + strconv.Itoa(i)
+		if found, got, err := lsm.Get(keys.NewIntKey(uint32(i))); err != nil || !found || string(got) != want {
+			t.Fatalf("Expected %s for key %d, got %s, %v", want, i, got, err)
+		}
+	}
+}
+
+func TestTableCacheBoundsOpenFiles(t *testing.T) {
+	lsm := openUncompacted(t, WithMaxOpenFiles(2), WithBlockCache(nil))
+	if len(lsm.SStables) != 5 {
+		t.Fatalf("Expected 5 tables, got %d", len(lsm.SStables))
+	}
+
+	for range 2 {
+		checkRound(t, lsm, "val", 50)
+		if n := lsm.tableCache.len(); n != 2 {
+			t.Errorf("Expected 2 open tables, got %d", n)
+		}
+	}
+
+	if err := lsm.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if n := lsm.tableCache.len(); n != 0 {
+		t.Errorf("Expected Close to close every table, got %d open", n)
+	}
+}
+
+func TestTableHandleOutlivesEviction(t *testing.T) {
+	lsm := openUncompacted(t)
+	table := lsm.SStables[0]
+
+	h, err := lsm.tableCache.acquire(table)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	lsm.tableCache.evict(table.id)
+	if n := lsm.tableCache.len(); n != 0 {
+		t.Errorf("Expected the handle to be evicted, got %d open", n)
+	}
+
+	// the reader still holding it can go on.
+	buf := make([]byte, 16)
+	if _, err := h.ReadAt(buf, 0); err != nil {
+		t.Errorf("Expected an evicted handle to stay readable, got %v", err)
+	}
+	lsm.tableCache.release(h)
+	if h.f != nil {
+		if _, err := h.f.ReadAt(buf, 0); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("Expected the last release to close the file, got %v", err)
+		}
+	}
+
+	// the next reader opens it again.
+	checkRound(t, lsm, "val", 50)
+}
+
+func TestMmapReads(t *testing.T) {
+	for _, codec := range []compression.Compressor{compression.None{}, compression.Flate{Level: 6}} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			blocks := cache.New(1<<20, cache.LRU)
+			lsm := openUncompacted(t, WithMmapReads(true), WithBlockCache(blocks), WithCompressor(codec))
+			checkRound(t, lsm, "val", 50)
+
+			entries, err := lsm.Scan(nil, nil)
+			if err != nil {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			if len(entries) != 55 {
+				t.Errorf("Expected 55 entries, got %d", len(entries))
+			}
+
+			h, err := lsm.tableCache.acquire(lsm.SStables[0])
+			if err != nil {
+				t.Fatalf("acquire failed: %v", err)
+			}
+			defer lsm.tableCache.release(h)
+			if h.mapped() != (runtime.GOOS == "linux") {
+				t.Errorf("Expected tables to be mapped on linux only, got %v on %s", h.mapped(), runtime.GOOS)
+			}
+
+			// uncompressed blocks are read from the mapping, only the
+			// decompressed ones are worth caching.
+			stats := blocks.Stats()
+			cached := stats.Usage - stats.PinnedUsage
+			if h.mapped() && codec.ID() == compression.NoneID && cached != 0 {
+				t.Errorf("Expected mapped blocks to skip the block cache, got %d bytes cached", cached)
+			}
+			if codec.ID() != compression.NoneID && cached == 0 {
+				t.Errorf("Expected decompressed blocks to be cached")
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package lsmtree
+
+import (
+	"encoding/binary"
+	"time"
+
+	"main/interfaces"
+	"main/memtable"
+)
+
+/*
+ * A value written with a TTL is an entry of KindExpiringValue, its
+ * value is prefixed with the expiry time:
+ *   [8 bytes] - Expiry time (unix nanoseconds, int64)
+ *   [N bytes] - Value data
+ *
+ * Reads turn an expired entry into a deletion, so it hides the older
+ * versions of the key the same way a delete would, and strip the prefix
+ * off live ones. Flushes and compactions write expired entries out as
+ * tombstones, which go away like any other.
+ */
+
+const expiryPrefixSize = 8
+
+// now is the clock expiry times are checked against.
+var now = time.Now
+
+// PutWithTTL queues key=val, the key reads as missing once ttl has
+// passed. val is copied so the caller may reuse it.
+func (b *WriteBatch) PutWithTTL(key interfaces.Comparable, val []byte, ttl time.Duration) {
+	value := make([]byte, expiryPrefixSize, expiryPrefixSize+len(val))
+	binary.BigEndian.PutUint64(value, uint64(now().Add(ttl).UnixNano()))
+	b.ops = append(b.ops, batchOp{key: key, kind: memtable.KindExpiringValue, value: append(value, val...)})
+}
+
+// PutWithTTL sets key to val until ttl has passed, a ttl <= 0 expires
+// right away.
+func (l *LSM) PutWithTTL(key interfaces.Comparable, val []byte, ttl time.Duration) error {
+	batch := NewWriteBatch()
+	batch.PutWithTTL(key, val, ttl)
+	return l.Write(batch)
+}
+
+func expired(value []byte, at time.Time) bool {
+	return len(value) < expiryPrefixSize || int64(binary.BigEndian.Uint64(value)) <= at.UnixNano()
+}
+
+// liveEntry is what an entry reads as at the given time: expiring
+// values become plain values or, once expired, deletions.
+func liveEntry(kind memtable.EntryKind, value []byte, at time.Time) (memtable.EntryKind, []byte) {
+	if kind != memtable.KindExpiringValue {
+		return kind, value
+	}
+	if expired(value, at) {
+		return memtable.KindDeletion, nil
+	}
+	return memtable.KindValue, value[expiryPrefixSize:]
+}
+
+// entryAt is liveEntry for a whole entry, it returns entry itself when
+// nothing changes.
+func entryAt(entry *memtable.Entry, at time.Time) *memtable.Entry {
+	if entry == nil || entry.Kind != memtable.KindExpiringValue {
+		return entry
+	}
+	kind, value := liveEntry(entry.Kind, entry.Value, at)
+	return &memtable.Entry{Key: entry.Key, Kind: kind, Value: value}
+}
+
+// expireEntry turns entry into a tombstone if it has expired by at, for
+// flushes and compactions that keep the expiry time of the others.
+func expireEntry(entry *memtable.Entry, at time.Time) *memtable.Entry {
+	if entry.Kind == memtable.KindExpiringValue && expired(entry.Value, at) {
+		return &memtable.Entry{Key: entry.Key, Kind: memtable.KindDeletion}
+	}
+	return entry
+}
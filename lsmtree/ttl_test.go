@@ -0,0 +1,129 @@
+package lsmtree
+
+import (
+	"main/cache"
+	"main/interfaces"
+	"main/keys"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock replaces the clock expiry times are checked against until
+// the test ends.
+func fakeClock(t *testing.T) *atomic.Int64 {
+	var clock atomic.Int64
+	clock.Store(time.Unix(1000, 0).UnixNano())
+	now = func() time.Time { return time.Unix(0, clock.Load()) }
+	t.Cleanup(func() { now = time.Now })
+	return &clock
+}
+
+// flushAll flushes the memtable too and runs the compactions it leads to.
+func flushAll(t *testing.T, lsm *LSM) {
+	t.Helper()
+	lsm.mu.Lock()
+	err := lsm.switchMemtable()
+	lsm.mu.Unlock()
+	if err != nil {
+		t.Fatalf("switchMemtable failed: %v", err)
+	}
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if err := lsm.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	clock := fakeClock(t)
+	// every flush gets merged into L1 right away.
+	strategy := NewLeveledStrategy()
+	strategy.L0CompactionTrigger = 1
+	lsm, err := Open(t.TempDir(), WithCompactionStrategy(strategy), WithMergeOperator(UInt64AddOperator{}),
+		WithRowCache(cache.New(1<<20, cache.LRU)), WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer lsm.Close()
+
+	key := func(i uint32) interfaces.Comparable { return keys.NewIntKey(i) }
+	// key 3 has an older value the expired one must keep hidden, key 5
+	// has a merge operand on top.
+	lsm.Put(key(1), []byte("kept"))
+	lsm.Put(key(3), []byte("old"))
+	lsm.PutWithTTL(key(2), []byte("short"), 10*time.Second)
+	lsm.PutWithTTL(key(3), []byte("short"), 10*time.Second)
+	lsm.PutWithTTL(key(4), []byte("long"), time.Hour)
+	lsm.PutWithTTL(key(5), u64(10), 10*time.Second)
+	lsm.Merge(key(5), u64(1))
+
+	check := func(want map[uint32]string) {
+		t.Helper()
+		var batch []interfaces.Comparable
+		for i := range uint32(6) {
+			batch = append(batch, key(i))
+		}
+		results, err := lsm.MultiGet(batch)
+		if err != nil {
+			t.Fatalf("MultiGet failed: %v", err)
+		}
+		for i := range uint32(6) {
+			value, ok := want[i]
+			found, got, err := lsm.Get(key(i))
+			if err != nil || (found && got != nil) != ok || string(got) != value {
+				t.Errorf("Expected %v, %q for key %d, got %v, %q, %v", ok, value, i, found, got, err)
+			}
+			if results[i].Found != ok || string(results[i].Value) != value {
+				t.Errorf("Expected MultiGet to return %v, %q for key %d, got %+v", ok, value, i, results[i])
+			}
+		}
+
+		entries, err := lsm.Scan(nil, nil)
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if len(entries) != len(want) {
+			t.Errorf("Expected %d live keys, got %d", len(want), len(entries))
+		}
+		for _, entry := range entries {
+			if value := want[entry.Key.GetValue().(uint32)]; string(entry.Value) != value {
+				t.Errorf("Expected %q for key %v while scanning, got %q", value, entry.Key.GetValue(), entry.Value)
+			}
+		}
+	}
+
+	live := map[uint32]string{1: "kept", 2: "short", 3: "short", 4: "long", 5: string(u64(11))}
+	check(live)
+	flushAll(t, lsm)
+	check(live)
+	// the operand stays on top of the value, merged they would outlive it.
+	if versions := countVersions(t, lsm, 5); versions != 2 {
+		t.Errorf("Expected 2 versions of key 5, got %d", versions)
+	}
+
+	// rows cached so far are checked again.
+	clock.Add(int64(11 * time.Second))
+	expired := map[uint32]string{1: "kept", 4: "long", 5: string(u64(1))}
+	check(expired)
+
+	// a table around the others, compaction picks them all up.
+	lsm.Put(key(0), []byte("new"))
+	lsm.Put(key(6), []byte("new"))
+	expired[0], expired[6] = "new", "new"
+	flushAll(t, lsm)
+	check(expired)
+	for _, i := range []uint32{2, 3} {
+		if versions := countVersions(t, lsm, i); versions != 0 {
+			t.Errorf("Expected compaction to drop key %d, got %d versions", i, versions)
+		}
+	}
+	if versions := countVersions(t, lsm, 5); versions != 1 {
+		t.Errorf("Expected the operand of key 5 to be merged, got %d versions", versions)
+	}
+
+	clock.Add(int64(time.Hour))
+	delete(expired, 4)
+	check(expired)
+}
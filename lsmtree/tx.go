@@ -0,0 +1,327 @@
+package lsmtree
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"time"
+
+	"main/interfaces"
+	"main/memtable"
+)
+
+/*
+ * Optimistic transactions read from a snapshot taken when they begin
+ * and keep their writes to themselves until Commit. The writes go into
+ * a memtable of their own, reads through the transaction look there
+ * first and iterators merge them in as the newest versions.
+ *
+ * Every key an optimistic transaction reads from the tree joins the
+ * read set. Commit takes the write lock, checks that no key of the read
+ * set got a version newer than the snapshot and writes the buffered
+ * operations as one batch, so no other write can come in between. Keys
+ * other writers add to a range the transaction iterated over aren't
+ * noticed.
+ *
+ * Pessimistic transactions lock keys instead, see locks.go: a shared
+ * lock for Get, an exclusive one for GetForUpdate, Put and Delete. They
+ * read the latest version, which no other transaction can change while
+ * the lock is held, and keep every lock until Commit or Rollback.
+ * Writes outside of transactions don't take locks. Iterators read as of
+ * their creation without locking anything.
+ */
+
+var (
+	// ErrConflict is returned by Commit when a key the transaction read
+	// was written after it began, the transaction is rolled back.
+	ErrConflict = errors.New("transaction conflict")
+	// ErrTxDone is returned by operations on a committed or rolled back
+	// transaction.
+	ErrTxDone = errors.New("transaction has already been committed or rolled back")
+)
+
+// TxOptions configures a transaction, see BeginTxWith.
+type TxOptions struct {
+	// Pessimistic transactions lock the keys they use instead of
+	// checking for conflicts on commit.
+	Pessimistic bool
+	// LockTimeout bounds the wait for each lock of a pessimistic
+	// transaction, 0 means a second.
+	LockTimeout time.Duration
+}
+
+// Tx is a transaction, see BeginTx. It is not safe for concurrent use.
+type Tx struct {
+	lsm *LSM
+	// buffered writes, under sequence number 0.
+	writes *memtable.MemTable
+	done   bool
+
+	// optimistic transactions only.
+	snap *Snapshot
+	// keys read from the tree, by their encoding.
+	reads map[string]interfaces.Comparable
+
+	// pessimistic transactions only.
+	id          uint64
+	lockTimeout time.Duration
+	// the mode each key is held in, by its encoding.
+	locked map[string]lockMode
+}
+
+// BeginTx starts an optimistic transaction reading the tree as of now.
+func (l *LSM) BeginTx() (*Tx, error) {
+	return l.BeginTxWith(TxOptions{})
+}
+
+// BeginTxWith starts a transaction configured by opts.
+func (l *LSM) BeginTxWith(opts TxOptions) (*Tx, error) {
+	l.mu.RLock()
+	closed := l.closed
+	l.mu.RUnlock()
+	if closed {
+		return nil, ErrClosed
+	}
+
+	tx := &Tx{lsm: l, writes: newMemTable()}
+	if !opts.Pessimistic {
+		tx.snap = l.NewSnapshot()
+		tx.reads = map[string]interfaces.Comparable{}
+		return tx, nil
+	}
+	tx.id = l.locks.lastTx.Add(1)
+	tx.lockTimeout = opts.LockTimeout
+	if tx.lockTimeout <= 0 {
+		tx.lockTimeout = defaultLockTimeout
+	}
+	tx.locked = map[string]lockMode{}
+	return tx, nil
+}
+
+// Get reads key with the writes of the transaction applied. Optimistic
+// transactions read as of their start, pessimistic ones take a shared
+// lock on key.
+func (tx *Tx) Get(key interfaces.Comparable) (bool, []byte, error) {
+	return tx.get(key, lockShared)
+}
+
+// GetForUpdate is Get with an exclusive lock, so a pessimistic
+// transaction can write key later on without waiting. For optimistic
+// transactions it is the same as Get.
+func (tx *Tx) GetForUpdate(key interfaces.Comparable) (bool, []byte, error) {
+	return tx.get(key, lockExclusive)
+}
+
+func (tx *Tx) get(key interfaces.Comparable, mode lockMode) (bool, []byte, error) {
+	if tx.done {
+		return false, nil, ErrTxDone
+	}
+	keyBytes, err := key.ToBytes()
+	if err != nil {
+		return false, nil, err
+	}
+	if tx.snap == nil {
+		if err := tx.lock(keyBytes, mode); err != nil {
+			return false, nil, err
+		}
+	}
+	if entry := memGet(tx.writes, key, math.MaxUint64); entry != nil {
+		return entry.Kind == memtable.KindValue, entry.Value, nil
+	}
+	if tx.snap == nil {
+		return tx.lsm.Get(key)
+	}
+	tx.reads[string(keyBytes)] = key
+	return tx.snap.Get(key)
+}
+
+// Put buffers key=val until Commit, val is copied so the caller may
+// reuse it.
+func (tx *Tx) Put(key interfaces.Comparable, val []byte) error {
+	return tx.write(key, memtable.KindValue, bytes.Clone(val))
+}
+
+// Delete buffers a deletion of key until Commit.
+func (tx *Tx) Delete(key interfaces.Comparable) error {
+	return tx.write(key, memtable.KindDeletion, nil)
+}
+
+func (tx *Tx) write(key interfaces.Comparable, kind memtable.EntryKind, val []byte) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.snap == nil {
+		keyBytes, err := key.ToBytes()
+		if err != nil {
+			return err
+		}
+		if err := tx.lock(keyBytes, lockExclusive); err != nil {
+			return err
+		}
+	}
+	tx.writes.Add(newInternalKey(key, 0), kind, val)
+	return nil
+}
+
+// lock takes key in mode unless the transaction holds it already.
+func (tx *Tx) lock(key []byte, mode lockMode) error {
+	if tx.locked[string(key)] >= mode {
+		return nil
+	}
+	if err := tx.lsm.locks.lock(tx.id, string(key), mode, tx.lockTimeout); err != nil {
+		return err
+	}
+	tx.locked[string(key)] = mode
+	return nil
+}
+
+// Iterator returns an unpositioned iterator over the tree as the
+// transaction sees it, with the writes buffered so far. The keys an
+// optimistic transaction iterates over join its read set.
+func (tx *Tx) Iterator() (Iterator, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	l := tx.lsm
+	l.mu.RLock()
+	seq := l.seq
+	if tx.snap != nil {
+		seq = tx.snap.seq
+	}
+	// the writes win over every version the iterator can see.
+	writes := newMemTable()
+	for _, entry := range tx.writes.Entries() {
+		writes.Add(newInternalKey(userKey(entry.Key), seq), entry.Kind, entry.Value)
+	}
+	it, err := l.newIterator(seq, writes)
+	if err != nil {
+		return nil, err
+	}
+	if tx.snap == nil {
+		return it, nil
+	}
+	return &txIterator{Iterator: it, tx: tx}, nil
+}
+
+// Commit writes the buffered operations atomically. An optimistic
+// transaction fails with ErrConflict if a key it read has been written
+// since it began. The transaction is over either way.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	defer tx.Rollback()
+
+	batch := NewWriteBatch()
+	for _, entry := range tx.writes.Entries() {
+		if entry.Kind == memtable.KindDeletion {
+			batch.Delete(userKey(entry.Key))
+		} else {
+			batch.Put(userKey(entry.Key), entry.Value)
+		}
+	}
+	if tx.snap == nil {
+		return tx.lsm.writeChecked(batch, nil)
+	}
+
+	l := tx.lsm
+	return l.writeChecked(batch, func() error {
+		for _, key := range tx.reads {
+			modified, err := l.modifiedSince(key, tx.snap.seq)
+			if err != nil {
+				return err
+			}
+			if modified {
+				return ErrConflict
+			}
+		}
+		return nil
+	})
+}
+
+// Rollback drops the buffered operations and releases the locks.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if tx.snap != nil {
+		tx.snap.Release()
+		return nil
+	}
+	keys := make([]string, 0, len(tx.locked))
+	for key := range tx.locked {
+		keys = append(keys, key)
+	}
+	tx.lsm.locks.unlock(tx.id, keys)
+	return nil
+}
+
+// modifiedSince tells whether key has a version newer than seq, range
+// deletions included. The caller must hold l.mu, the snapshot of the
+// transaction keeps every such version around.
+func (l *LSM) modifiedSince(key interfaces.Comparable, seq uint64) (bool, error) {
+	mems := l.memtables()
+	if rangeCover(key, math.MaxUint64, mems, l.SStables) > seq {
+		return true, nil
+	}
+	for _, mem := range mems {
+		if entry := memGet(mem, key, math.MaxUint64); entry != nil {
+			return entrySeq(entry) > seq, nil
+		}
+	}
+	for i := len(l.SStables) - 1; i >= 0; i-- {
+		table := l.SStables[i]
+		if table.maxSeq <= seq || !table.mayContain(key) {
+			continue
+		}
+		entry, err := table.find(key, math.MaxUint64)
+		if err != nil {
+			return false, err
+		}
+		if entry != nil {
+			return entrySeq(entry) > seq, nil
+		}
+	}
+	return false, nil
+}
+
+// txIterator adds the keys it stops at to the read set of tx.
+type txIterator struct {
+	Iterator
+	tx *Tx
+}
+
+func (it *txIterator) track() {
+	if !it.Valid() {
+		return
+	}
+	if keyBytes, err := it.Key().ToBytes(); err == nil {
+		it.tx.reads[string(keyBytes)] = it.Key()
+	}
+}
+
+func (it *txIterator) Seek(key interfaces.Comparable) {
+	it.Iterator.Seek(key)
+	it.track()
+}
+
+func (it *txIterator) SeekToFirst() {
+	it.Iterator.SeekToFirst()
+	it.track()
+}
+
+func (it *txIterator) SeekToLast() {
+	it.Iterator.SeekToLast()
+	it.track()
+}
+
+func (it *txIterator) Next() {
+	it.Iterator.Next()
+	it.track()
+}
+
+func (it *txIterator) Prev() {
+	it.Iterator.Prev()
+	it.track()
+}
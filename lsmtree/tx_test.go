@@ -0,0 +1,196 @@
+package lsmtree
+
+import (
+	"errors"
+	"main/interfaces"
+	"main/keys"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestTxReadsItsWrites(t *testing.T) {
+	lsm, err := Open(t.TempDir(), WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer lsm.Close()
+
+	key := func(i uint32) interfaces.Comparable { return keys.NewIntKey(i) }
+	for i := range uint32(4) {
+		lsm.Put(key(i), []byte("old"))
+	}
+
+	tx, err := lsm.BeginTx()
+	if err != nil {
+		t.Fatalf("BeginTx failed: %v", err)
+	}
+	tx.Put(key(1), []byte("new"))
+	tx.Delete(key(2))
+	tx.Put(key(5), []byte("new"))
+	// written after the transaction began, it doesn't see that.
+	lsm.Put(key(3), []byte("later"))
+
+	want := map[uint32]string{0: "old", 1: "new", 3: "old", 5: "new"}
+	for i := range uint32(6) {
+		value, ok := want[i]
+		found, got, err := tx.Get(key(i))
+		if err != nil || found != ok || string(got) != value {
+			t.Errorf("Expected %v, %q for key %d, got %v, %q, %v", ok, value, i, found, got, err)
+		}
+	}
+	if _, got, _ := lsm.Get(key(1)); string(got) != "old" {
+		t.Errorf("Expected the write to stay in the transaction, got %q", got)
+	}
+
+	it, err := tx.Iterator()
+	if err != nil {
+		t.Fatalf("Iterator failed: %v", err)
+	}
+	var forward, backward []uint32
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if value := want[it.Key().GetValue().(uint32)]; string(it.Value()) != value {
+			t.Errorf("Expected %q for key %v while iterating, got %q", value, it.Key().GetValue(), it.Value())
+		}
+		forward = append(forward, it.Key().GetValue().(uint32))
+	}
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		backward = append(backward, it.Key().GetValue().(uint32))
+	}
+	it.Close()
+	slices.Reverse(backward)
+	if !slices.Equal(forward, []uint32{0, 1, 3, 5}) || !slices.Equal(forward, backward) {
+		t.Errorf("Expected to iterate over 0, 1, 3, 5 both ways, got %v and %v", forward, backward)
+	}
+
+	// key 3 was read, by Get and by the iterator.
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Expected ErrConflict, got %v", err)
+	}
+	if found, _, _ := lsm.Get(key(5)); found {
+		t.Errorf("Expected nothing of a conflicting transaction to be written")
+	}
+	if err := tx.Put(key(6), nil); !errors.Is(err, ErrTxDone) {
+		t.Errorf("Expected ErrTxDone, got %v", err)
+	}
+
+	tx, _ = lsm.BeginTx()
+	tx.Put(key(1), []byte("new"))
+	tx.Delete(key(2))
+	lsm.Put(key(3), []byte("blind"))
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if _, got, _ := lsm.Get(key(1)); string(got) != "new" {
+		t.Errorf("Expected the commit to write key 1, got %q", got)
+	}
+	if found, got, _ := lsm.Get(key(2)); found && got != nil {
+		t.Errorf("Expected the commit to delete key 2, got %q", got)
+	}
+	if err := tx.Rollback(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("Expected ErrTxDone, got %v", err)
+	}
+}
+
+func TestTxConflicts(t *testing.T) {
+	// every flush gets merged into L1 right away.
+	strategy := NewLeveledStrategy()
+	strategy.L0CompactionTrigger = 1
+	lsm, err := Open(t.TempDir(), WithCompactionStrategy(strategy), WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer lsm.Close()
+
+	key := func(i uint32) interfaces.Comparable { return keys.NewIntKey(i) }
+	for i := range uint32(10) {
+		lsm.Put(key(i), []byte("old"))
+	}
+
+	tests := []struct {
+		name  string
+		write func()
+		flush bool
+	}{
+		{"put", func() { lsm.Put(key(5), []byte("new")) }, false},
+		{"delete", func() { lsm.Delete(key(5)) }, false},
+		{"flushed put", func() { lsm.Put(key(5), []byte("new")) }, true},
+		{"range deletion", func() { lsm.DeleteRange(key(4), key(6)) }, false},
+		{"flushed range deletion", func() { lsm.DeleteRange(key(4), key(6)) }, true},
+	}
+	for _, tt := range tests {
+		tx, err := lsm.BeginTx()
+		if err != nil {
+			t.Fatalf("BeginTx failed: %v", err)
+		}
+		tx.Get(key(5))
+		tx.Put(key(20), []byte(tt.name))
+		tt.write()
+		if tt.flush {
+			flushAll(t, lsm)
+		}
+		if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+			t.Errorf("%s: Expected ErrConflict, got %v", tt.name, err)
+		}
+		lsm.Put(key(5), []byte("old"))
+	}
+
+	// writes to keys it didn't read don't get in the way.
+	tx, _ := lsm.BeginTx()
+	tx.Get(key(5))
+	lsm.Put(key(6), []byte("new"))
+	lsm.DeleteRange(key(7), key(9))
+	flushAll(t, lsm)
+	if err := tx.Commit(); err != nil {
+		t.Errorf("Expected the commit to go through, got %v", err)
+	}
+}
+
+func TestTxConcurrentIncrements(t *testing.T) {
+	// small memtables, commits stall on flushes now and then.
+	lsm, err := Open(t.TempDir(), WithThreshold(20), WithLogger(&logRecorder{}))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer lsm.Close()
+
+	counter := keys.NewIntKey(0)
+	lsm.Put(counter, []byte("0"))
+	increment := func() error {
+		for {
+			tx, err := lsm.BeginTx()
+			if err != nil {
+				return err
+			}
+			_, value, err := tx.Get(counter)
+			if err != nil {
+				return err
+			}
+			n, _ := strconv.Atoi(string(value))
+			tx.Put(counter, []byte(strconv.Itoa(n+1)))
+			if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+				return err
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 25 {
+				if err := increment(); err != nil {
+					t.Errorf("increment failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, value, _ := lsm.Get(counter); string(value) != "100" {
+		t.Errorf("Expected 100 increments, got %s", value)
+	}
+}
@@ -0,0 +1,101 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"main/wal"
+)
+
+func (l *LSM) walSegments() ([]string, error) {
+	entries, err := os.ReadDir(l.dataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []string
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), "wal_") {
+			continue
+		}
+		segments = append(segments, filepath.Join(l.dataPath, e.Name()))
+	}
+
+	// segment names carry a creation timestamp of the same width,
+	// so lexical order is creation order.
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// replayWAL rebuilds the memtable from the segments left behind by a
+// previous run and opens a fresh segment for new writes.
+func (l *LSM) replayWAL() error {
+	segments, err := l.walSegments()
+	if err != nil {
+		return err
+	}
+
+	for i, segment := range segments {
+		err := wal.Replay(segment, func(payload []byte) error {
+			batch, seq, err := decodeWriteBatch(payload)
+			if err != nil {
+				return fmt.Errorf("error replaying %s: %w", segment, err)
+			}
+			l.applyBatch(batch, seq)
+			return nil
+		})
+		// only the segment that was written last can end mid-append,
+		// older ones were synced and closed.
+		if errors.Is(err, wal.ErrTornTail) && i == len(segments)-1 {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(segments) > 0 {
+		l.logger.Printf("Replayed %d WAL segments, memtable holds %d entries", len(segments), l.memtable.Size())
+	}
+	l.replayedSegments = segments
+
+	return l.openWAL()
+}
+
+func (l *LSM) openWAL() error {
+	fileName := filepath.Join(l.dataPath, fmt.Sprintf("wal_%d.log", time.Now().UnixNano()))
+	w, err := wal.Create(fileName, l.syncPolicy)
+	if err != nil {
+		return err
+	}
+	l.wal = w
+	return nil
+}
+
+// rotateWAL starts a new segment for a new memtable and returns the
+// segments that back the one being retired.
+func (l *LSM) rotateWAL() ([]string, error) {
+	retired := append(l.replayedSegments, l.wal.Path())
+	if err := l.wal.Close(); err != nil {
+		return nil, err
+	}
+	if err := l.openWAL(); err != nil {
+		return nil, err
+	}
+	l.replayedSegments = nil
+	return retired, nil
+}
+
+func removeSegments(segments []string) error {
+	for _, segment := range segments {
+		if err := os.Remove(segment); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package lsmtree
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// WriteBufferManager caps the memory taken by the memtables of every
+// LSM sharing it, including the ones waiting for the flusher. Once they
+// take more than the budget the LSM with the largest active memtable is
+// made to flush it early.
+type WriteBufferManager struct {
+	budget int64
+	used   atomic.Int64
+	// the part of used that is already on its way to disk.
+	immutable atomic.Int64
+
+	mu      sync.Mutex
+	members []*LSM
+	// one write at a time picks a memtable to flush, the others go on.
+	picking sync.Mutex
+}
+
+func NewWriteBufferManager(budget int64) *WriteBufferManager {
+	return &WriteBufferManager{budget: budget}
+}
+
+// MemoryUsage is the number of bytes held by the memtables of all
+// members, including the ones waiting to be flushed.
+func (m *WriteBufferManager) MemoryUsage() int64 {
+	return m.used.Load()
+}
+
+func (m *WriteBufferManager) Budget() int64 {
+	return m.budget
+}
+
+func (m *WriteBufferManager) register(l *LSM) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.members = append(m.members, l)
+}
+
+func (m *WriteBufferManager) unregister(l *LSM) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := slices.Index(m.members, l); i >= 0 {
+		m.members = slices.Delete(m.members, i, i+1)
+	}
+}
+
+// add accounts for memtables of a member, immutable ones separately.
+func (m *WriteBufferManager) add(used, immutable int64) {
+	m.used.Add(used)
+	m.immutable.Add(immutable)
+}
+
+// shouldFlush tells to switch out a memtable once the members are over
+// budget and active memtables take more than half of it. While most of
+// the usage is immutable memtables already waiting for their flush,
+// switching out another one frees nothing sooner.
+func (m *WriteBufferManager) shouldFlush() bool {
+	used := m.used.Load()
+	return used > m.budget && used-m.immutable.Load() > m.budget/2
+}
+
+// maybeFlush switches out the largest memtable if the members are over
+// budget. It must be called without holding the lock of any member.
+func (m *WriteBufferManager) maybeFlush() {
+	if !m.shouldFlush() || !m.picking.TryLock() {
+		return
+	}
+	defer m.picking.Unlock()
+
+	m.mu.Lock()
+	members := slices.Clone(m.members)
+	m.mu.Unlock()
+
+	var victim *LSM
+	var largest int64
+	for _, l := range members {
+		l.mu.RLock()
+		size := l.memtable.ApproximateMemoryUsage()
+		l.mu.RUnlock()
+		if size > largest {
+			victim, largest = l, size
+		}
+	}
+	if victim == nil {
+		return
+	}
+	if err := victim.flushMemtable(); err != nil && !errors.Is(err, ErrClosed) {
+		victim.logger.Printf("Error flushing memtable: %v", err)
+	}
+}
+
+// SetWriteBufferSize sets how many bytes the memtable may take before
+// it gets flushed, 0 only flushes on the entry count.
+func (l *LSM) SetWriteBufferSize(size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.writeBufferSize = size
+}
+
+// SetWriteBufferManager makes the memtables of the LSM count against
+// the budget of m. An LSM can only belong to a single manager.
+func (l *LSM) SetWriteBufferManager(m *WriteBufferManager) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	used, immutable := l.memoryUsage()
+	if l.writeBuffer != nil {
+		l.writeBuffer.add(-used, -immutable)
+		l.writeBuffer.unregister(l)
+	}
+	l.writeBuffer = m
+	if m != nil {
+		m.register(l)
+		m.add(used, immutable)
+	}
+}
+
+// memoryUsage returns what all memtables take and what the immutable
+// ones take, the caller must hold l.mu.
+func (l *LSM) memoryUsage() (int64, int64) {
+	var immutable int64
+	for _, imm := range l.immutables {
+		immutable += imm.mem.ApproximateMemoryUsage()
+	}
+	return l.memtable.ApproximateMemoryUsage() + immutable, immutable
+}
+
+// flushMemtable hands the memtable to the flusher before it is full,
+// unless the flusher is already behind.
+func (l *LSM) flushMemtable() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if l.memtable.Size() == 0 || len(l.immutables) >= maxImmutableMemtables {
+		return nil
+	}
+	return l.switchMemtable()
+}
@@ -0,0 +1,100 @@
+package lsmtree
+
+import (
+	"bytes"
+	"main/keys"
+	"testing"
+)
+
+func TestWriteBufferSizeTriggersFlush(t *testing.T) {
+	useTempDataDir(t)
+	// no entry count limit, only bytes matter.
+	lsm := newTestLSM(t, 0, 2, 0.01, nil)
+	lsm.SetWriteBufferSize(64 << 10)
+
+	// a few hundred entries, each well under 100 bytes.
+	for i := range 500 {
+		if err := lsm.Put(keys.NewIntKey(uint32(i)), []byte{1}); err != nil {
+			t.Fatalf("Put failed at %d: %v", i, err)
+		}
+	}
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if len(lsm.SStables) != 0 {
+		t.Errorf("Expected small values to stay in the memtable, got %d tables", len(lsm.SStables))
+	}
+
+	big := bytes.Repeat([]byte{'x'}, 8<<10)
+	for i := range 20 {
+		if err := lsm.Put(keys.NewIntKey(uint32(10000+i)), big); err != nil {
+			t.Fatalf("Put failed at %d: %v", i, err)
+		}
+	}
+	if err := lsm.waitForFlush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if len(lsm.SStables) == 0 {
+		t.Errorf("Expected large values to fill the write buffer")
+	}
+	// the memtable is switched before the write that finds it full, so
+	// it can go past the write buffer size by one write.
+	if usage := lsm.memtable.ApproximateMemoryUsage(); usage >= 64<<10+int64(2*len(big)) {
+		t.Errorf("Expected the memtable to stay around the write buffer size, got %d bytes", usage)
+	}
+	for i := range 20 {
+		if found, got, err := lsm.Get(keys.NewIntKey(uint32(10000 + i))); err != nil || !found || !bytes.Equal(got, big) {
+			t.Errorf("Expected key %d to be readable, got %v, %v", 10000+i, found, err)
+		}
+	}
+}
+
+func TestWriteBufferManagerFlushesLargest(t *testing.T) {
+	manager := NewWriteBufferManager(64 << 10)
+	open := func() *LSM {
+		useTempDataDir(t)
+		lsm := newTestLSM(t, 0, 2, 0.01, nil)
+		lsm.SetWriteBufferSize(0)
+		lsm.SetWriteBufferManager(manager)
+		return lsm
+	}
+	first, second := open(), open()
+
+	value := bytes.Repeat([]byte{'x'}, 1000)
+	for i := range 40 {
+		if err := first.Put(keys.NewIntKey(uint32(i)), value); err != nil {
+			t.Fatalf("Put failed at %d: %v", i, err)
+		}
+	}
+	if len(first.immutables) != 0 || manager.MemoryUsage() > manager.Budget() {
+		t.Fatalf("Expected the first store to stay under budget, got %d bytes", manager.MemoryUsage())
+	}
+
+	// the second store pushes the total over budget, the first one
+	// holds more and has to give way.
+	for i := range 25 {
+		if err := second.Put(keys.NewIntKey(uint32(i)), value); err != nil {
+			t.Fatalf("Put failed at %d: %v", i, err)
+		}
+	}
+	for _, lsm := range []*LSM{first, second} {
+		if err := lsm.waitForFlush(); err != nil {
+			t.Fatalf("flush failed: %v", err)
+		}
+	}
+	if len(first.SStables) != 1 || len(second.SStables) != 0 {
+		t.Errorf("Expected only the first store to flush, got %d and %d tables", len(first.SStables), len(second.SStables))
+	}
+	if manager.MemoryUsage() > manager.Budget() {
+		t.Errorf("Expected usage to drop below budget, got %d bytes", manager.MemoryUsage())
+	}
+	if manager.MemoryUsage() != second.memtable.ApproximateMemoryUsage() {
+		t.Errorf("Expected only the second memtable to count, got %d and %d", manager.MemoryUsage(), second.memtable.ApproximateMemoryUsage())
+	}
+
+	crash(first)
+	crash(second)
+	if manager.MemoryUsage() != 0 {
+		t.Errorf("Expected stopped stores to release their memory, got %d bytes", manager.MemoryUsage())
+	}
+}
@@ -1,11 +1,23 @@
 package main
 
 import (
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"main/cache"
+	"main/compression"
 	"main/interfaces"
 	"main/keys"
 	"main/lsmtree"
+	"main/wal"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -23,7 +35,18 @@ func main() {
 
 	r := gin.Default()
 
-    lsm := lsmtree.NewLSMTree(threshold, sparsityFactor, falsePositiveRate)
+	lsm, err := lsmtree.Open("data",
+		lsmtree.WithThreshold(threshold),
+		lsmtree.WithSparsityFactor(sparsityFactor),
+		lsmtree.WithFalsePositiveRate(falsePositiveRate),
+		lsmtree.WithSyncPolicy(wal.SyncPolicy{Mode: wal.SyncPeriodic, Interval: 100 * time.Millisecond}),
+		lsmtree.WithCompressor(compression.Flate{Level: flate.DefaultCompression}),
+		lsmtree.WithRowCache(cache.New(4<<20, cache.LRU)),
+		lsmtree.WithMergeOperator(lsmtree.StringAppendOperator{Delimiter: ","}),
+	)
+	if err != nil {
+		panic(err)
+	}
 
 	// Define a simple GET endpoint
 	r.GET("/ping", func(c *gin.Context) {
@@ -33,6 +56,97 @@ func main() {
 		})
 	})
 
+	r.GET("/admin/stats", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"block_cache": lsm.BlockCacheStats(),
+			"row_cache":   lsm.RowCacheStats(),
+		})
+	})
+
+	// the fixed routes go before /:key, they take precedence over keys
+	// of the same name.
+
+	// Apply several puts, deletes and merges atomically, the body is a
+	// list like [{"op": "put", "key": "a", "value": "1"}, {"op": "delete", "key": "b"}].
+	// A merge appends its value to the key, after a comma.
+	r.POST("/_batch", func(c *gin.Context) {
+		var ops []batchOperation
+		if err := c.ShouldBindJSON(&ops); err != nil {
+			c.String(http.StatusBadRequest, "invalid batch: "+err.Error())
+			return
+		}
+
+		batch := lsmtree.NewWriteBatch()
+		for _, op := range ops {
+			switch op.Op {
+			case "put":
+				batch.Put(parseKey(op.Key), []byte(op.Value))
+			case "delete":
+				batch.Delete(parseKey(op.Key))
+			case "merge":
+				batch.Merge(parseKey(op.Key), []byte(op.Value))
+			default:
+				c.String(http.StatusBadRequest, "unknown batch operation: "+op.Op)
+				return
+			}
+		}
+
+		if err := lsm.Write(batch); err != nil {
+			c.String(http.StatusInternalServerError, "something went wrong writing the batch")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"applied": batch.Count(),
+		})
+	})
+
+	// Look up several keys at once, the body is a list of keys like
+	// ["a", "b"]. Results come back in the same order.
+	r.POST("/_mget", func(c *gin.Context) {
+		var keyNames []string
+		if err := c.ShouldBindJSON(&keyNames); err != nil {
+			c.String(http.StatusBadRequest, "invalid key list: "+err.Error())
+			return
+		}
+
+		parsed := make([]interfaces.Comparable, len(keyNames))
+		for i, key := range keyNames {
+			parsed[i] = parseKey(key)
+		}
+		results, err := lsm.MultiGet(parsed)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "something went wrong reading the keys")
+			return
+		}
+
+		response := make([]mgetResult, len(keyNames))
+		for i, result := range results {
+			response[i] = mgetResult{Key: keyNames[i], Found: result.Found}
+			if result.Found {
+				value := string(result.Value)
+				response[i].Value = &value
+			}
+		}
+		c.JSON(http.StatusOK, response)
+	})
+
+	// Delete every key from start up to, but not including, end.
+	r.DELETE("/_range", func(c *gin.Context) {
+		start, end := c.Query("start"), c.Query("end")
+		err := lsm.DeleteRange(parseKey(start), parseKey(end))
+		if errors.Is(err, lsmtree.ErrInvalidRange) {
+			c.String(http.StatusBadRequest, "start must be before end")
+			return
+		}
+		if err != nil {
+			c.String(http.StatusInternalServerError, "something went wrong deleting the range")
+			return
+		}
+
+		c.String(http.StatusOK, "Keys from "+start+" to "+end+" are deleted\n")
+	})
+
 	r.GET("/:key", func(c *gin.Context) {
 		key := c.Params.ByName("key")
 
@@ -61,7 +175,18 @@ func main() {
 
 		parsed_key := parseKey(key)
 
-		err = lsm.Put(parsed_key, body)
+		// the key expires after the ttl in the X-TTL header or the ttl
+		// query parameter, if there is one.
+		ttl, err := parseTTL(c.GetHeader("X-TTL"), c.Query("ttl"))
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid ttl: "+err.Error())
+			return
+		}
+		if ttl > 0 {
+			err = lsm.PutWithTTL(parsed_key, body, ttl)
+		} else {
+			err = lsm.Put(parsed_key, body)
+		}
 		if err != nil {
 			c.String(http.StatusInternalServerError, "something went wrong putting the key")
 			return
@@ -74,16 +199,72 @@ func main() {
 		key := c.Params.ByName("key")
 
 		parsed_key := parseKey(key)
-		lsm.Delete(parsed_key)
+		if err := lsm.Delete(parsed_key); err != nil {
+			c.String(http.StatusInternalServerError, "something went wrong deleting the key")
+			return
+		}
 
 		c.String(http.StatusOK, "Key: "+key+" is deleted\n")
 	})
 
 	// Start server on port 8080 (default)
 	// Server will listen on 0.0.0.0:8080 (localhost:8080 on Windows)
-	r.Run()
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	// on shutdown let running requests finish, then flush the memtable
+	// and unlock the data directory.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic(err)
+		}
+	}()
+	<-ctx.Done()
+	stop()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		println("Error shutting down server:", err.Error())
+	}
+	if err := lsm.Close(); err != nil {
+		println("Error closing LSM Tree:", err.Error())
+	}
+}
+
+type batchOperation struct {
+	Op    string `json:"op" binding:"required"`
+	Key   string `json:"key" binding:"required"`
+	Value string `json:"value"`
+}
+
+type mgetResult struct {
+	Key   string  `json:"key"`
+	Found bool    `json:"found"`
+	Value *string `json:"value,omitempty"`
 }
 
+// parseTTL reads the first ttl that is set, in seconds or as a duration
+// like "90s" or "1h30m". It returns 0 when neither is set.
+func parseTTL(values ...string) (time.Duration, error) {
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		ttl, err := time.ParseDuration(value)
+		if seconds, convErr := strconv.Atoi(value); convErr == nil {
+			ttl, err = time.Duration(seconds)*time.Second, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if ttl <= 0 {
+			return 0, fmt.Errorf("ttl must be positive, got %s", value)
+		}
+		return ttl, nil
+	}
+	return 0, nil
+}
 
 func parseKey(key string) interfaces.Comparable {
 	var parsed_key interfaces.Comparable = keys.NewStringKey(key)
@@ -4,30 +4,34 @@ package memtable
  * This is a sorted in-memory data structure, When it gets
  * bigger than some threshold, it write it out to disk.
  *
- *  TODO: concurrency ... crowd goes: BOOOOO
+ * Not safe for concurrent use, the LSM serializes writers and only
+ * lets readers in while no write is in progress.
  */
 
 import (
-	"bytes"
+	"sort"
+
 	"main/interfaces"
 )
 
 type Node struct {
 	key    interfaces.Comparable
 	data   []byte
+	kind   EntryKind
 	left   *Node
 	right  *Node
 	height int
 }
 
 func (n *Node) getKV() *Entry {
-	return &Entry{n.key, n.data}
+	return &Entry{n.key, n.data, n.kind}
 }
 
-func NewNode(key interfaces.Comparable, data []byte) *Node {
+func NewNode(key interfaces.Comparable, kind EntryKind, data []byte) *Node {
 	return &Node{
 		key:    key,
 		data:   data,
+		kind:   kind,
 		height: 1,
 	}
 }
@@ -55,7 +59,7 @@ func (t *AVLTree) Get(key interfaces.Comparable) (bool, []byte) {
 	for curr != nil {
 		compareResult := curr.key.Compare(key)
 		if compareResult == 0 {
-			if curr.data != nil && bytes.Equal(curr.data, []byte{0x7f}) {
+			if curr.kind == KindDeletion {
 				return true, nil
 			}
 			return true, curr.data
@@ -69,18 +73,22 @@ func (t *AVLTree) Get(key interfaces.Comparable) (bool, []byte) {
 }
 
 func (t *AVLTree) Put(key interfaces.Comparable, val []byte) {
+	t.Add(key, KindValue, val)
+}
+
+func (t *AVLTree) Delete(key interfaces.Comparable) {
+	t.head = insert(t.head, key, KindDeletion, nil, nil)
+}
+
+func (t *AVLTree) Add(key interfaces.Comparable, kind EntryKind, val []byte) {
 	// updated := new(bool)
 	updated := false
-	t.head = insert(t.head, key, val, &updated)
+	t.head = insert(t.head, key, kind, val, &updated)
 	if !updated {
 		t.size++
 	}
 }
 
-func (t *AVLTree) Delete(key interfaces.Comparable) {
-	t.head = insert(t.head, key, []byte{0x7f}, nil)
-}
-
 func (t *AVLTree) Floor(key interfaces.Comparable) []byte {
     curr := t.head
     var candidate *Node
@@ -88,14 +96,14 @@ func (t *AVLTree) Floor(key interfaces.Comparable) []byte {
     for curr != nil {
         compareResult := curr.key.Compare(key)
         if compareResult == 0 {
-            if curr.data != nil && bytes.Equal(curr.data, []byte{0x7f}) {
+            if curr.kind == KindDeletion {
                 return nil
             }
             return curr.data
         } else if compareResult == 1 {
             curr = curr.left
         } else {
-            if curr.data != nil && !bytes.Equal(curr.data, []byte{0x7f}) {
+            if curr.kind != KindDeletion {
                 candidate = curr
             }
             curr = curr.right
@@ -115,12 +123,12 @@ func (t *AVLTree) Ceil(key interfaces.Comparable) []byte {
     for curr != nil {
         compareResult := curr.key.Compare(key)
         if compareResult == 0 {
-            if curr.data != nil && bytes.Equal(curr.data, []byte{0x7f}) {
+            if curr.kind == KindDeletion {
                 return nil
             }
             return curr.data
         } else if compareResult == 1 {
-            if curr.data != nil && !bytes.Equal(curr.data, []byte{0x7f}) {
+            if curr.kind != KindDeletion {
                 candidate = curr
             }
             curr = curr.left
@@ -135,6 +143,30 @@ func (t *AVLTree) Ceil(key interfaces.Comparable) []byte {
     return nil
 }
 
+// Seek returns the first entry with a key >= key. Unlike Ceil it
+// doesn't skip deleted entries.
+func (t *AVLTree) Seek(key interfaces.Comparable) *Entry {
+	curr := t.head
+	var candidate *Node
+
+	for curr != nil {
+		compareResult := curr.key.Compare(key)
+		if compareResult == 0 {
+			return curr.getKV()
+		} else if compareResult == 1 {
+			candidate = curr
+			curr = curr.left
+		} else {
+			curr = curr.right
+		}
+	}
+
+	if candidate != nil {
+		return candidate.getKV()
+	}
+	return nil
+}
+
 func (t *AVLTree) Dump(log bool) []*Node {
 	var arr []*Node
 	inOrderTraversal(t.head, &arr)
@@ -165,6 +197,39 @@ func (t *AVLTree) ToKVs() []*Entry {
 	return result
 }
 
+// NewIterator walks a copy of the entries taken right away, the tree
+// can't be read while it is being written.
+func (t *AVLTree) NewIterator() Iterator {
+	return &entryIterator{entries: t.ToKVs(), pos: -1}
+}
+
+type entryIterator struct {
+	entries []*Entry
+	pos     int
+}
+
+func (it *entryIterator) Seek(key interfaces.Comparable) {
+	it.pos = sort.Search(len(it.entries), func(i int) bool {
+		return it.entries[i].Key.Compare(key) >= 0
+	})
+}
+
+func (it *entryIterator) SeekToFirst() { it.pos = 0 }
+
+func (it *entryIterator) SeekToLast() { it.pos = len(it.entries) - 1 }
+
+func (it *entryIterator) Next() { it.pos++ }
+
+func (it *entryIterator) Prev() { it.pos-- }
+
+func (it *entryIterator) Valid() bool { return it.pos >= 0 && it.pos < len(it.entries) }
+
+func (it *entryIterator) Key() interfaces.Comparable { return it.entries[it.pos].Key }
+
+func (it *entryIterator) Value() []byte { return it.entries[it.pos].Value }
+
+func (it *entryIterator) Kind() EntryKind { return it.entries[it.pos].Kind }
+
 func inOrderTraversal(node *Node, result *[]*Node) {
 	if node == nil {
 		return
@@ -213,15 +278,16 @@ func rightRotation(node *Node) *Node {
 	return b
 }
 
-func insert(node *Node, key interfaces.Comparable, data []byte, updated *bool) *Node {
+func insert(node *Node, key interfaces.Comparable, kind EntryKind, data []byte, updated *bool) *Node {
 	if node == nil {
-		return NewNode(key, data)
+		return NewNode(key, kind, data)
 	} else if node.key.Compare(key) == -1 {
-		node.right = insert(node.right, key, data, updated)
+		node.right = insert(node.right, key, kind, data, updated)
 	} else if node.key.Compare(key) == 1 {
-		node.left = insert(node.left, key, data, updated)
+		node.left = insert(node.left, key, kind, data, updated)
 	} else {
 		node.data = data
+		node.kind = kind
 		if updated != nil {
 			*updated = true
 		}
@@ -115,3 +115,22 @@ func TestComplexTree(t *testing.T) {
 		t.Errorf("Tree should have 0 elements after clearning it")
 	}
 }
+
+func TestSeek(t *testing.T) {
+	avlTree := NewAVLTree()
+	for _, key := range []uint32{10, 20, 30, 40} {
+		avlTree.Put(keys.NewIntKey(key), []byte{byte(key)})
+	}
+	avlTree.Delete(keys.NewIntKey(30))
+
+	cases := map[uint32]uint32{0: 10, 10: 10, 11: 20, 25: 30, 40: 40}
+	for seek, want := range cases {
+		entry := avlTree.Seek(keys.NewIntKey(seek))
+		if entry == nil || entry.Key.GetValue() != want {
+			t.Errorf("Expected Seek(%d) to land on %d, got %v", seek, want, entry)
+		}
+	}
+	if entry := avlTree.Seek(keys.NewIntKey(41)); entry != nil {
+		t.Errorf("Expected Seek past the last key to return nil, got %v", entry.Key.GetValue())
+	}
+}
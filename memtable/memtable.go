@@ -9,15 +9,63 @@ import (
 	"main/interfaces"
 	"main/keys"
 	"main/util"
+	"sync/atomic"
 )
 
 type MemTable struct {
 	tree MemTableImplementation
+	// approximate bytes taken by the entries, see entrySize.
+	memoryUsage atomic.Int64
+	// replaced on every write so readers can hold on to the slice.
+	rangeDeletions atomic.Pointer[[]RangeDeletion]
 }
 
+// bookkeeping an implementation keeps per entry besides the key and the
+// value, roughly a skip list node.
+const entryOverhead = 64
+
+// entrySize estimates the memory an entry takes. Overwritten values are
+// still counted, so it only grows until the table is dropped.
+func entrySize(key interfaces.Comparable, val []byte) int64 {
+	keyBytes, _ := key.ToBytes()
+	return int64(len(keyBytes) + len(val) + entryOverhead)
+}
+
+// EntryKind tells what an entry does to its key. New kinds go at the
+// end, the values end up on disk.
+type EntryKind uint8
+
+const (
+	// KindValue sets the key to the entry value.
+	KindValue EntryKind = iota
+	// KindDeletion removes the key, the entry has no value.
+	KindDeletion
+	// KindMerge holds an operand the merge operator of the tree
+	// combines with the older versions of the key.
+	KindMerge
+	// KindExpiringValue sets the key until the expiry time stored in
+	// front of the value.
+	KindExpiringValue
+	// KindRangeDeletion removes every key from the entry key up to the
+	// end key held in the value. Tables keep these apart from the other
+	// entries, see AddRangeDeletion.
+	KindRangeDeletion
+)
+
+// RangeDeletion removes the keys >= Start and < End.
+type RangeDeletion struct {
+	Start interfaces.Comparable
+	End   interfaces.Comparable
+}
+
+// legacyTombstone marked deleted keys in the dump format before entries
+// had a kind, Dump still writes it and Load reads it back as a deletion.
+var legacyTombstone = []byte{0x7f}
+
 type Entry struct {
 	Key   interfaces.Comparable
 	Value []byte
+	Kind  EntryKind
 }
 
 func NewMemTable(impl MemTableImplementation) *MemTable {
@@ -28,11 +76,29 @@ type MemTableImplementation interface {
 	Get(key interfaces.Comparable) (bool, []byte)
 	Put(key interfaces.Comparable, val []byte)
 	Delete(key interfaces.Comparable)
+	Add(key interfaces.Comparable, kind EntryKind, val []byte)
 	Floor(key interfaces.Comparable) []byte
 	Ceil(key interfaces.Comparable) []byte
+	Seek(key interfaces.Comparable) *Entry
 	Clear()
 	Size() uint32
 	ToKVs() []*Entry
+	NewIterator() Iterator
+}
+
+// Iterator walks the entries of a table in key order, deleted entries
+// included. It starts out unpositioned.
+type Iterator interface {
+	// Seek moves to the first key >= key.
+	Seek(key interfaces.Comparable)
+	SeekToFirst()
+	SeekToLast()
+	Next()
+	Prev()
+	Valid() bool
+	Key() interfaces.Comparable
+	Value() []byte
+	Kind() EntryKind
 }
 
 func (t *MemTable) Get(key interfaces.Comparable) (bool, []byte) {
@@ -40,18 +106,72 @@ func (t *MemTable) Get(key interfaces.Comparable) (bool, []byte) {
 }
 
 func (t *MemTable) Put(key interfaces.Comparable, val []byte) {
-	t.tree.Put(key, val)
+	t.Add(key, KindValue, val)
 }
 
 func (t *MemTable) Delete(key interfaces.Comparable) {
-	t.tree.Delete(key)
+	t.Add(key, KindDeletion, nil)
+}
+
+// Add inserts or replaces the entry for key.
+func (t *MemTable) Add(key interfaces.Comparable, kind EntryKind, val []byte) {
+	t.tree.Add(key, kind, val)
+	t.memoryUsage.Add(entrySize(key, val))
+}
+
+// AddRangeDeletion records a deletion of the keys from start up to end.
+// Range deletions aren't entries, they only show up in RangeDeletions.
+func (t *MemTable) AddRangeDeletion(start, end interfaces.Comparable) {
+	var dels []RangeDeletion
+	if old := t.rangeDeletions.Load(); old != nil {
+		dels = append(dels, *old...)
+	}
+	dels = append(dels, RangeDeletion{Start: start, End: end})
+	t.rangeDeletions.Store(&dels)
+	endBytes, _ := end.ToBytes()
+	t.memoryUsage.Add(entrySize(start, endBytes))
+}
+
+// RangeDeletions returns the range deletions in the order they were
+// added, it is safe to call while the table is being written.
+func (t *MemTable) RangeDeletions() []RangeDeletion {
+	if dels := t.rangeDeletions.Load(); dels != nil {
+		return *dels
+	}
+	return nil
+}
+
+// ApproximateMemoryUsage is the number of bytes the entries take, it is
+// safe to call while the table is being written.
+func (t *MemTable) ApproximateMemoryUsage() int64 {
+	return t.memoryUsage.Load()
+}
+
+// Seek returns the first entry with a key >= key, or nil.
+func (t *MemTable) Seek(key interfaces.Comparable) *Entry {
+	return t.tree.Seek(key)
+}
+
+// NewIterator returns an unpositioned iterator over the table.
+func (t *MemTable) NewIterator() Iterator {
+	return t.tree.NewIterator()
 }
 
+// Entries returns the table content in key order.
+func (t *MemTable) Entries() []*Entry {
+	if t.tree == nil {
+		return nil
+	}
+	return t.tree.ToKVs()
+}
+
+// Size counts the entries and the range deletions.
 func (t *MemTable) Size() uint32 {
+	size := uint32(len(t.RangeDeletions()))
 	if t.tree == nil {
-		return 0
+		return size
 	}
-	return t.tree.Size()
+	return size + t.tree.Size()
 }
 
 func (t *MemTable) Dump(file io.Writer,
@@ -66,13 +186,16 @@ func (t *MemTable) Dump(file io.Writer,
 		     *   [4 bytes] - Key value (uint32)
 		     *   [4 bytes] - Value length (int32)
 		     *   [N bytes] - Value data
+			 *
+			 *  deleted keys are written with the single byte 0x7f as
+			 *  their value, so a real 0x7f value reads back as a delete.
 			 *
 			 *  the caller should close the file.
 	*/
 
 	buf := new(bytes.Buffer)
 
-	if err := binary.Write(buf, binary.BigEndian, t.Size()); err != nil {
+	if err := binary.Write(buf, binary.BigEndian, t.tree.Size()); err != nil {
 		return fmt.Errorf("error serializing table size: %w", err)
 	}
 
@@ -103,14 +226,19 @@ func (t *MemTable) Dump(file io.Writer,
 			return fmt.Errorf("error writing key: %w", err)
 		}
 
+		value := entry.Value
+		if entry.Kind == KindDeletion {
+			value = legacyTombstone
+		}
+
 		// Write value length
-		valueLen := int32(len(entry.Value))
+		valueLen := int32(len(value))
 		if err := binary.Write(buf, binary.BigEndian, valueLen); err != nil {
 			return fmt.Errorf("error serializing value length: %w", err)
 		}
 
 		// Write value data
-		if _, err := buf.Write(entry.Value); err != nil {
+		if _, err := buf.Write(value); err != nil {
 			return fmt.Errorf("error writing value: %w", err)
 		}
 	}
@@ -141,7 +269,7 @@ func (t *MemTable) Load(buf io.Reader,
 
     rd := &offsetReader{r: buf}
 
-	tableLength, err := util.ParseInt32(rd.r)
+	tableLength, err := util.ParseInt32(rd)
 	if err != nil {
 		return fmt.Errorf("error parsing table size: %w", err)
 	}
@@ -150,18 +278,18 @@ func (t *MemTable) Load(buf io.Reader,
 	startOfCurrKey := 0
 	for i := uint32(0); i < tableLength; i++ {
 		startOfCurrKey = rd.offset
-		key, err := keys.ParseKey(rd.r)
+		key, err := keys.ParseKey(rd)
 		if err != nil {
 			return err
 		}
 
-		valueLength, err := util.ParseInt32(rd.r)
+		valueLength, err := util.ParseInt32(rd)
 		if err != nil {
 			return fmt.Errorf("error parsing value length: %w", err)
 		}
 
 		valueBytes := make([]byte, valueLength)
-		if n, err := buf.Read(valueBytes); err != nil || n != int(valueLength) {
+		if n, err := io.ReadFull(rd, valueBytes); err != nil || n != int(valueLength) {
 			return fmt.Errorf("error parsing value data: %w", err)
 		}
 
@@ -176,7 +304,11 @@ func (t *MemTable) Load(buf io.Reader,
 		}
 		j++
 
-		t.Put(key, valueBytes)
+		if bytes.Equal(valueBytes, legacyTombstone) {
+			t.Delete(key)
+		} else {
+			t.Put(key, valueBytes)
+		}
 	}
 
 	return nil
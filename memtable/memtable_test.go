@@ -135,3 +135,53 @@ func TestMemTableLoad(t *testing.T) {
 		t.Errorf("Expected %s, got %s", val2, result)
 	}
 }
+
+func TestEntryKinds(t *testing.T) {
+	memtable := NewMemTable(NewAVLTree())
+
+	// the byte deletes used to be marked with is an ordinary value now.
+	memtable.Put(keys.NewIntKey(1), []byte{0x7f})
+	memtable.Delete(keys.NewIntKey(2))
+	memtable.Add(keys.NewIntKey(3), KindValue, []byte("value3"))
+
+	found, result := memtable.Get(keys.NewIntKey(1))
+	if !found || !bytes.Equal(result, []byte{0x7f}) {
+		t.Errorf("Expected 7f, got %x", result)
+	}
+	if found, result := memtable.Get(keys.NewIntKey(2)); !found || result != nil {
+		t.Errorf("Expected key 2 to be deleted, got %v, %s", found, result)
+	}
+	if memtable.Size() != 3 {
+		t.Errorf("Expected size 3, got %d", memtable.Size())
+	}
+
+	wantKinds := []EntryKind{KindValue, KindDeletion, KindValue}
+	for i, entry := range memtable.Entries() {
+		if entry.Kind != wantKinds[i] {
+			t.Errorf("Entry %d: expected kind %d, got %d", i, wantKinds[i], entry.Kind)
+		}
+	}
+	if entry := memtable.Seek(keys.NewIntKey(2)); entry == nil || entry.Kind != KindDeletion {
+		t.Errorf("Expected Seek to return the deletion of key 2, got %v", entry)
+	}
+}
+
+func TestApproximateMemoryUsage(t *testing.T) {
+	memtable := NewMemTable(NewSkipList())
+	if memtable.ApproximateMemoryUsage() != 0 {
+		t.Errorf("Expected an empty table to take no memory")
+	}
+
+	memtable.Put(keys.NewIntKey(1), make([]byte, 1000))
+	small := memtable.ApproximateMemoryUsage()
+	memtable.Put(keys.NewIntKey(2), make([]byte, 100000))
+	if small < 1000 || memtable.ApproximateMemoryUsage()-small < 100000 {
+		t.Errorf("Expected usage to follow value sizes, got %d then %d", small, memtable.ApproximateMemoryUsage())
+	}
+
+	before := memtable.ApproximateMemoryUsage()
+	memtable.Delete(keys.NewIntKey(3))
+	if memtable.ApproximateMemoryUsage() <= before {
+		t.Errorf("Expected deletes to take memory as well")
+	}
+}
@@ -0,0 +1,317 @@
+package memtable
+
+/*
+ * SkipList is a sorted linked list with express lanes: every node is on
+ * level 0 and each level above holds about 1 in skipListBranching of the
+ * nodes of the level below. A search starts on the highest level and
+ * drops a level whenever the next node would overshoot.
+ *
+ * Writers must be serialized by the caller, but any number of readers
+ * can run alongside the writer without locking. Links are atomic
+ * pointers and a node is complete before it gets linked in, from the
+ * bottom level up. Nodes are never unlinked (deletes are entries of
+ * KindDeletion), so readers never follow a pointer to a removed node.
+ *
+ * Nodes keep the sort bytes of keys.Sortable keys, a search takes those
+ * of its key once and compares them with bytes.Compare on the way down.
+ * Keys without them, or of another type, go through Compare.
+ */
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"sync/atomic"
+
+	"main/interfaces"
+	"main/keys"
+)
+
+const (
+	skipListMaxHeight = 12
+	skipListBranching = 4
+)
+
+// sortKey is a key with its sort bytes, see keys.Sortable.
+type sortKey struct {
+	key       interfaces.Comparable
+	keyType   uint8
+	sortBytes []byte
+}
+
+func newSortKey(key interfaces.Comparable) sortKey {
+	k := sortKey{key: key}
+	if sortable, ok := key.(keys.Sortable); ok {
+		k.keyType, k.sortBytes = sortable.KeyType(), sortable.SortBytes()
+	}
+	return k
+}
+
+// compare is a.key.Compare(b.key).
+func (a *sortKey) compare(b *sortKey) int8 {
+	if a.sortBytes != nil && b.sortBytes != nil && a.keyType == b.keyType {
+		return int8(bytes.Compare(a.sortBytes, b.sortBytes))
+	}
+	return a.key.Compare(b.key)
+}
+
+type skipNode struct {
+	sortKey
+	// replaced as a whole when the key is written again.
+	value atomic.Pointer[skipValue]
+	next  []atomic.Pointer[skipNode]
+}
+
+type skipValue struct {
+	data []byte
+	kind EntryKind
+}
+
+func newSkipNode(key sortKey, height int) *skipNode {
+	return &skipNode{sortKey: key, next: make([]atomic.Pointer[skipNode], height)}
+}
+
+func (n *skipNode) getKV() *Entry {
+	v := n.value.Load()
+	return &Entry{n.key, v.data, v.kind}
+}
+
+type SkipList struct {
+	head   *skipNode
+	height atomic.Int32
+	size   atomic.Uint32
+}
+
+func NewSkipList() *SkipList {
+	s := &SkipList{}
+	s.Clear()
+	return s
+}
+
+func randomHeight() int {
+	height := 1
+	for height < skipListMaxHeight && rand.IntN(skipListBranching) == 0 {
+		height++
+	}
+	return height
+}
+
+// findGreaterOrEqual returns the first node with a key >= key or nil.
+// If prev is given it gets the last node before that one on every level.
+func (s *SkipList) findGreaterOrEqual(key *sortKey, prev []*skipNode) *skipNode {
+	x := s.head
+	level := int(s.height.Load()) - 1
+	// the node that stopped the search on the level above, often the
+	// next one on this level as well.
+	var stop *skipNode
+	for {
+		next := x.next[level].Load()
+		if next != nil && next != stop && next.compare(key) < 0 {
+			x = next
+			continue
+		}
+		stop = next
+		if prev != nil {
+			prev[level] = x
+		}
+		if level == 0 {
+			return next
+		}
+		level--
+	}
+}
+
+// findLessThan returns the last node with a key < key, or the head if
+// there is none.
+func (s *SkipList) findLessThan(key *sortKey) *skipNode {
+	x := s.head
+	level := int(s.height.Load()) - 1
+	for {
+		next := x.next[level].Load()
+		if next != nil && next.compare(key) < 0 {
+			x = next
+			continue
+		}
+		if level == 0 {
+			return x
+		}
+		level--
+	}
+}
+
+// findLast returns the last node, or the head if the list is empty.
+func (s *SkipList) findLast() *skipNode {
+	x := s.head
+	level := int(s.height.Load()) - 1
+	for {
+		if next := x.next[level].Load(); next != nil {
+			x = next
+			continue
+		}
+		if level == 0 {
+			return x
+		}
+		level--
+	}
+}
+
+func (s *SkipList) Size() uint32 {
+	return s.size.Load()
+}
+
+// Clear empties the list, unlike writes it must not run alongside readers.
+func (s *SkipList) Clear() {
+	s.head = newSkipNode(sortKey{}, skipListMaxHeight)
+	s.height.Store(1)
+	s.size.Store(0)
+}
+
+func (s *SkipList) Get(key interfaces.Comparable) (bool, []byte) {
+	k := newSortKey(key)
+	x := s.findGreaterOrEqual(&k, nil)
+	if x == nil || x.compare(&k) != 0 {
+		return false, nil
+	}
+	v := x.value.Load()
+	if v.kind == KindDeletion {
+		return true, nil
+	}
+	return true, v.data
+}
+
+func (s *SkipList) Put(key interfaces.Comparable, val []byte) {
+	s.Add(key, KindValue, val)
+}
+
+func (s *SkipList) Delete(key interfaces.Comparable) {
+	s.Add(key, KindDeletion, nil)
+}
+
+func (s *SkipList) Add(key interfaces.Comparable, kind EntryKind, val []byte) {
+	prev := make([]*skipNode, skipListMaxHeight)
+	k := newSortKey(key)
+	x := s.findGreaterOrEqual(&k, prev)
+	if x != nil && x.compare(&k) == 0 {
+		x.value.Store(&skipValue{data: val, kind: kind})
+		return
+	}
+
+	height := randomHeight()
+	if current := int(s.height.Load()); height > current {
+		for i := current; i < height; i++ {
+			prev[i] = s.head
+		}
+		// readers that see the new height before the node is linked in
+		// just find nothing on the new levels and drop down.
+		s.height.Store(int32(height))
+	}
+
+	x = newSkipNode(k, height)
+	x.value.Store(&skipValue{data: val, kind: kind})
+	for i := range height {
+		x.next[i].Store(prev[i].next[i].Load())
+		prev[i].next[i].Store(x)
+	}
+	s.size.Add(1)
+}
+
+// Floor returns the value of the largest live key <= key. Like the AVL
+// tree it returns nil if key itself is deleted.
+func (s *SkipList) Floor(key interfaces.Comparable) []byte {
+	k := newSortKey(key)
+	x := s.findGreaterOrEqual(&k, nil)
+	if x != nil && x.compare(&k) == 0 {
+		return liveData(x)
+	}
+	for x = s.findLessThan(&k); x != s.head; x = s.findLessThan(&x.sortKey) {
+		if v := x.value.Load(); v.kind != KindDeletion {
+			return v.data
+		}
+	}
+	return nil
+}
+
+// Ceil returns the value of the smallest live key >= key. Like the AVL
+// tree it returns nil if key itself is deleted.
+func (s *SkipList) Ceil(key interfaces.Comparable) []byte {
+	k := newSortKey(key)
+	x := s.findGreaterOrEqual(&k, nil)
+	if x != nil && x.compare(&k) == 0 {
+		return liveData(x)
+	}
+	for ; x != nil; x = x.next[0].Load() {
+		if v := x.value.Load(); v.kind != KindDeletion {
+			return v.data
+		}
+	}
+	return nil
+}
+
+func liveData(n *skipNode) []byte {
+	if v := n.value.Load(); v.kind != KindDeletion {
+		return v.data
+	}
+	return nil
+}
+
+// Seek returns the first entry with a key >= key. Unlike Ceil it
+// doesn't skip deleted entries.
+func (s *SkipList) Seek(key interfaces.Comparable) *Entry {
+	k := newSortKey(key)
+	if x := s.findGreaterOrEqual(&k, nil); x != nil {
+		return x.getKV()
+	}
+	return nil
+}
+
+func (s *SkipList) ToKVs() []*Entry {
+	result := make([]*Entry, 0, s.Size())
+	for x := s.head.next[0].Load(); x != nil; x = x.next[0].Load() {
+		result = append(result, x.getKV())
+	}
+	return result
+}
+
+// NewIterator walks the live list, entries added while it runs show up
+// once it gets to them.
+func (s *SkipList) NewIterator() Iterator {
+	return &skipListIterator{list: s}
+}
+
+type skipListIterator struct {
+	list *SkipList
+	node *skipNode
+	// loaded once per position so Value and Kind agree.
+	value *skipValue
+}
+
+func (it *skipListIterator) setNode(n *skipNode) {
+	if n == it.list.head {
+		n = nil
+	}
+	it.node, it.value = n, nil
+	if n != nil {
+		it.value = n.value.Load()
+	}
+}
+
+func (it *skipListIterator) Seek(key interfaces.Comparable) {
+	k := newSortKey(key)
+	it.setNode(it.list.findGreaterOrEqual(&k, nil))
+}
+
+func (it *skipListIterator) SeekToFirst() { it.setNode(it.list.head.next[0].Load()) }
+
+func (it *skipListIterator) SeekToLast() { it.setNode(it.list.findLast()) }
+
+func (it *skipListIterator) Next() { it.setNode(it.node.next[0].Load()) }
+
+// Prev searches again from the top, nodes only link forward.
+func (it *skipListIterator) Prev() { it.setNode(it.list.findLessThan(&it.node.sortKey)) }
+
+func (it *skipListIterator) Valid() bool { return it.node != nil }
+
+func (it *skipListIterator) Key() interfaces.Comparable { return it.node.key }
+
+func (it *skipListIterator) Value() []byte { return it.value.data }
+
+func (it *skipListIterator) Kind() EntryKind { return it.value.kind }
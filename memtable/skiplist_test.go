@@ -0,0 +1,295 @@
+package memtable
+
+import (
+	"bytes"
+	"fmt"
+	"main/interfaces"
+	"main/keys"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSkipList(t *testing.T) {
+	list := NewSkipList()
+	testKeys := rand.Perm(500)
+	for _, key := range testKeys {
+		list.Put(keys.NewIntKey(uint32(key*2)), []byte(strconv.Itoa(key*2)))
+	}
+	if list.Size() != 500 {
+		t.Errorf("Expected size 500, got %d", list.Size())
+	}
+
+	for i := range 1000 {
+		found, value := list.Get(keys.NewIntKey(uint32(i)))
+		if i%2 == 1 {
+			if found {
+				t.Errorf("Key %d should not be in the list", i)
+			}
+			continue
+		}
+		if !found || string(value) != strconv.Itoa(i) {
+			t.Errorf("Expected %d for key %d, got %s", i, i, value)
+		}
+	}
+
+	// overwrites and deletes keep the size, like the AVL tree.
+	list.Put(keys.NewIntKey(10), []byte("ten"))
+	list.Delete(keys.NewIntKey(20))
+	if found, value := list.Get(keys.NewIntKey(10)); !found || string(value) != "ten" {
+		t.Errorf("Expected the update of key 10, got %s", value)
+	}
+	if found, value := list.Get(keys.NewIntKey(20)); !found || value != nil {
+		t.Errorf("Expected key 20 to be deleted, got %s", value)
+	}
+	if list.Size() != 500 {
+		t.Errorf("Expected size to remain 500, got %d", list.Size())
+	}
+
+	entries := list.ToKVs()
+	if len(entries) != 500 {
+		t.Fatalf("Expected 500 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Key.Compare(keys.NewIntKey(uint32(i*2))) != 0 {
+			t.Fatalf("Entry %d out of order: %v", i, entry.Key.GetValue())
+		}
+	}
+
+	// Floor and Ceil skip deleted keys, the sparse index relies on them.
+	if value := list.Floor(keys.NewIntKey(21)); string(value) != "18" {
+		t.Errorf("Expected Floor(21) to be 18, got %s", value)
+	}
+	if value := list.Ceil(keys.NewIntKey(19)); string(value) != "22" {
+		t.Errorf("Expected Ceil(19) to be 22, got %s", value)
+	}
+	if value := list.Floor(keys.NewIntKey(20)); value != nil {
+		t.Errorf("Expected Floor of a deleted key to be nil, got %s", value)
+	}
+	if entry := list.Seek(keys.NewIntKey(19)); entry == nil || entry.Kind != KindDeletion {
+		t.Errorf("Expected Seek(19) to land on the deletion of 20, got %v", entry)
+	}
+
+	list.Clear()
+	if list.Size() != 0 || len(list.ToKVs()) != 0 {
+		t.Errorf("Expected an empty list after Clear")
+	}
+}
+
+func TestSkipListIterator(t *testing.T) {
+	list := NewSkipList()
+	for _, key := range []uint32{40, 10, 30, 20} {
+		list.Put(keys.NewIntKey(key), []byte{byte(key)})
+	}
+	list.Delete(keys.NewIntKey(30))
+
+	it := list.NewIterator()
+	if it.Valid() {
+		t.Errorf("Expected a new iterator to be unpositioned")
+	}
+
+	var forward []uint32
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		forward = append(forward, it.Key().GetValue().(uint32))
+	}
+	var backward []uint32
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		backward = append(backward, it.Key().GetValue().(uint32))
+	}
+	if len(forward) != 4 || len(backward) != 4 {
+		t.Fatalf("Expected 4 keys each way, got %v and %v", forward, backward)
+	}
+	for i := range forward {
+		if forward[i] != backward[3-i] {
+			t.Errorf("Expected backward to mirror forward, got %v and %v", forward, backward)
+			break
+		}
+	}
+
+	it.Seek(keys.NewIntKey(25))
+	if !it.Valid() || it.Key().GetValue() != uint32(30) || it.Kind() != KindDeletion {
+		t.Errorf("Expected Seek(25) to land on the deletion of 30")
+	}
+
+	// the iterator sees entries added behind its position.
+	it.Seek(keys.NewIntKey(40))
+	list.Put(keys.NewIntKey(50), []byte{50})
+	if it.Next(); !it.Valid() || it.Key().GetValue() != uint32(50) {
+		t.Errorf("Expected the iterator to reach key 50 written after it was positioned")
+	}
+}
+
+func TestSkipListBytesKeys(t *testing.T) {
+	list := NewSkipList()
+	inserted := [][]byte{{0xff}, {0, 1}, {}, {0}, []byte("a\x00b"), []byte("a")}
+	for _, key := range inserted {
+		list.Put(keys.NewBytesKey(key), key)
+	}
+
+	// plain byte order, shorter prefixes first.
+	want := [][]byte{{}, {0}, {0, 1}, []byte("a"), []byte("a\x00b"), {0xff}}
+	var got [][]byte
+	it := list.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		got = append(got, it.Key().(*keys.BytesKey).Bytes())
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d keys, got %q", len(want), got)
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("Expected %q at %d, got %q", want[i], i, got[i])
+		}
+	}
+
+	key := keys.NewBytesKey([]byte("a"))
+	if allocs := testing.AllocsPerRun(100, func() { list.Get(key) }); allocs != 0 {
+		t.Errorf("Expected lookups of byte keys not to allocate, got %v allocations", allocs)
+	}
+}
+
+func TestSkipListConcurrentReaders(t *testing.T) {
+	list := NewSkipList()
+	n := 2000
+
+	var done atomic.Bool
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !done.Load() {
+				// whatever is there must be complete and in order.
+				var last *Entry
+				it := list.NewIterator()
+				for it.SeekToFirst(); it.Valid(); it.Next() {
+					if last != nil && last.Key.Compare(it.Key()) >= 0 {
+						t.Errorf("Keys out of order: %v then %v", last.Key.GetValue(), it.Key().GetValue())
+						return
+					}
+					if !bytes.Equal(it.Value(), []byte(strconv.Itoa(int(it.Key().GetValue().(uint32))))) {
+						t.Errorf("Value of key %v doesn't match", it.Key().GetValue())
+						return
+					}
+					last = &Entry{Key: it.Key()}
+				}
+
+				key := uint32(rand.Intn(n))
+				if found, value := list.Get(keys.NewIntKey(key)); found && string(value) != strconv.Itoa(int(key)) {
+					t.Errorf("Expected %d for key %d, got %s", key, key, value)
+					return
+				}
+			}
+		}()
+	}
+
+	for _, key := range rand.Perm(n) {
+		list.Put(keys.NewIntKey(uint32(key)), []byte(strconv.Itoa(key)))
+	}
+	done.Store(true)
+	wg.Wait()
+
+	if list.Size() != uint32(n) {
+		t.Errorf("Expected size %d, got %d", n, list.Size())
+	}
+}
+
+// benchmarkMixed runs parallel readers and writers over impl, writePct
+// of the operations are writes. Writers are serialized with a mutex,
+// readers take its read side only when the implementation needs it.
+func benchmarkMixed(b *testing.B, impl MemTableImplementation, writePct int, lockReads bool) {
+	n := 100000
+	for i := range n {
+		impl.Put(keys.NewIntKey(uint32(i)), []byte("val_"+strconv.Itoa(i)))
+	}
+
+	var mu sync.RWMutex
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			key := keys.NewIntKey(uint32(rng.Intn(2 * n)))
+			if rng.Intn(100) < writePct {
+				mu.Lock()
+				impl.Put(key, []byte("new"))
+				mu.Unlock()
+				continue
+			}
+			if lockReads {
+				mu.RLock()
+			}
+			impl.Get(key)
+			if lockReads {
+				mu.RUnlock()
+			}
+		}
+	})
+}
+
+func BenchmarkMemTableMixed(b *testing.B) {
+	for _, writePct := range []int{5, 50} {
+		b.Run("avl/writes="+strconv.Itoa(writePct)+"%", func(b *testing.B) {
+			benchmarkMixed(b, NewAVLTree(), writePct, true)
+		})
+		b.Run("skiplist/writes="+strconv.Itoa(writePct)+"%", func(b *testing.B) {
+			benchmarkMixed(b, NewSkipList(), writePct, false)
+		})
+	}
+}
+
+// decodedKey hides the sort bytes of a key, the skip list compares it
+// with Compare.
+type decodedKey struct {
+	interfaces.Comparable
+}
+
+func (k decodedKey) Compare(other interfaces.Comparable) int8 {
+	return k.Comparable.Compare(other.(decodedKey).Comparable)
+}
+
+func TestSkipListSortBytes(t *testing.T) {
+	list, decoded := NewSkipList(), NewSkipList()
+	for _, key := range rand.Perm(500) {
+		value := []byte(strconv.Itoa(key))
+		list.Put(keys.NewStringKey(fmt.Sprintf("key\x00%d", key)), value)
+		decoded.Put(decodedKey{keys.NewStringKey(fmt.Sprintf("key\x00%d", key))}, value)
+	}
+	got, want := list.ToKVs(), decoded.ToKVs()
+	for i := range want {
+		if !bytes.Equal(got[i].Value, want[i].Value) {
+			t.Fatalf("Expected entry %d to be %s, got %s", i, want[i].Value, got[i].Value)
+		}
+	}
+
+	key := keys.NewStringKey("key\x0042")
+	if allocs := testing.AllocsPerRun(100, func() { list.Get(key) }); allocs != 0 {
+		t.Errorf("Expected Get not to allocate, got %v allocations", allocs)
+	}
+}
+
+func BenchmarkSkipListGet(b *testing.B) {
+	n := 100000
+	key := func(i int) interfaces.Comparable {
+		return keys.NewBytesKey([]byte(fmt.Sprintf("user:%08d:profile", i)))
+	}
+	for _, mode := range []string{"sort-bytes", "decoded"} {
+		b.Run(mode, func(b *testing.B) {
+			list := NewSkipList()
+			lookups := make([]interfaces.Comparable, n)
+			for i := range n {
+				lookups[i] = key(i)
+				if mode == "decoded" {
+					lookups[i] = decodedKey{lookups[i]}
+				}
+				list.Put(lookups[i], []byte("val"))
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := range b.N {
+				list.Get(lookups[i%n])
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package wal
+
+/*
+ * Append-only write-ahead log. Every record is framed as:
+ *   [4 bytes] - CRC32 (castagnoli) of type + payload
+ *   [4 bytes] - Payload length (uint32)
+ *   [1 byte]  - Record type
+ *   [N bytes] - Payload
+ *
+ * The log doesn't know anything about keys or values, the caller
+ * encodes whatever it needs into the payload.
+ */
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	headerSize = 9
+
+	// RecordFull is a record that holds a complete payload.
+	RecordFull uint8 = 0x01
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrTornTail is returned by Replay when the last record of the
+	// segment is incomplete or damaged, everything before it was
+	// replayed.
+	ErrTornTail = errors.New("wal segment ends in a torn record")
+	// ErrCorrupt is returned by Replay for a damaged record that isn't
+	// the last one of the segment.
+	ErrCorrupt = errors.New("wal segment is corrupted")
+)
+
+type SyncMode int
+
+const (
+	// SyncEveryWrite fsyncs the segment before Append returns.
+	SyncEveryWrite SyncMode = iota
+	// SyncPeriodic fsyncs the segment every SyncPolicy.Interval.
+	SyncPeriodic
+	// SyncNever leaves flushing to the OS.
+	SyncNever
+)
+
+type SyncPolicy struct {
+	Mode     SyncMode
+	Interval time.Duration
+}
+
+type Writer struct {
+	mu     sync.Mutex
+	f      *os.File
+	path   string
+	policy SyncPolicy
+	dirty  bool
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func Create(path string, policy SyncPolicy) (*Writer, error) {
+	if policy.Mode == SyncPeriodic && policy.Interval <= 0 {
+		return nil, fmt.Errorf("periodic sync needs a positive interval")
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{f: f, path: path}
+	w.startPolicy(policy)
+	return w, nil
+}
+
+// SetPolicy switches the sync policy of an open segment, anything
+// appended so far is synced first unless the new mode is SyncNever.
+func (w *Writer) SetPolicy(policy SyncPolicy) error {
+	if policy.Mode == SyncPeriodic && policy.Interval <= 0 {
+		return fmt.Errorf("periodic sync needs a positive interval")
+	}
+
+	w.stopSyncLoop()
+	if policy.Mode != SyncNever {
+		if err := w.Sync(); err != nil {
+			return err
+		}
+	}
+	w.startPolicy(policy)
+	return nil
+}
+
+func (w *Writer) startPolicy(policy SyncPolicy) {
+	w.mu.Lock()
+	w.policy = policy
+	w.mu.Unlock()
+
+	if policy.Mode == SyncPeriodic {
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncLoop(policy.Interval, w.stop, w.done)
+	}
+}
+
+func (w *Writer) stopSyncLoop() {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+		w.stop = nil
+		w.done = nil
+	}
+}
+
+func (w *Writer) Path() string {
+	return w.path
+}
+
+func (w *Writer) Append(payload []byte) error {
+	record := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(payload)))
+	record[8] = RecordFull
+	copy(record[headerSize:], payload)
+	binary.BigEndian.PutUint32(record[0:4], crc32.Checksum(record[8:], castagnoli))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return fmt.Errorf("append to closed wal segment %s", w.path)
+	}
+
+	if _, err := w.f.Write(record); err != nil {
+		return fmt.Errorf("error writing wal record: %w", err)
+	}
+	w.dirty = true
+
+	if w.policy.Mode == SyncEveryWrite {
+		return w.syncLocked()
+	}
+	return nil
+}
+
+func (w *Writer) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.syncLocked()
+}
+
+func (w *Writer) syncLocked() error {
+	if !w.dirty || w.closed {
+		return nil
+	}
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("error syncing wal segment: %w", err)
+	}
+	w.dirty = false
+	return nil
+}
+
+func (w *Writer) syncLoop(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// nothing to report the error to, the next tick or Close retries.
+			_ = w.Sync()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close syncs whatever is still buffered and closes the segment.
+func (w *Writer) Close() error {
+	w.stopSyncLoop()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	if w.policy.Mode != SyncNever {
+		if err := w.syncLocked(); err != nil {
+			return err
+		}
+	}
+	w.closed = true
+	return w.f.Close()
+}
+
+// Replay calls fn for every intact record of the segment in order.
+// A torn or corrupted last record is what a crash mid-append leaves
+// behind: replay stops there and returns ErrTornTail, which callers
+// ignore for the segment that was being written. A bad record with
+// more data after it returns ErrCorrupt.
+func Replay(path string, fn func(payload []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	rd := bufio.NewReader(f)
+	header := make([]byte, headerSize)
+	for offset := int64(0); ; {
+		if _, err := io.ReadFull(rd, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return ErrTornTail
+			}
+			return err
+		}
+
+		// a length past the end of the file can only be a torn header,
+		// checked before allocating for it.
+		length := binary.BigEndian.Uint32(header[4:8])
+		end := offset + headerSize + int64(length)
+		if end > info.Size() {
+			return ErrTornTail
+		}
+		body := make([]byte, 1+length)
+		body[0] = header[8]
+		if _, err := io.ReadFull(rd, body[1:]); err != nil {
+			return err
+		}
+
+		if crc32.Checksum(body, castagnoli) != binary.BigEndian.Uint32(header[0:4]) {
+			if end == info.Size() {
+				return ErrTornTail
+			}
+			return fmt.Errorf("%w: bad checksum at offset %d of %s", ErrCorrupt, offset, path)
+		}
+		if body[0] != RecordFull {
+			return fmt.Errorf("unknown wal record type: %d", body[0])
+		}
+
+		if err := fn(body[1:]); err != nil {
+			return err
+		}
+		offset = end
+	}
+}
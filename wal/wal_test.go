@@ -0,0 +1,142 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAppendAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal_1.log")
+	w, err := Create(path, SyncPolicy{Mode: SyncEveryWrite})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	var written [][]byte
+	for i := range 100 {
+		payload := fmt.Appendf(nil, "record-%d", i)
+		written = append(written, payload)
+		if err := w.Append(payload); err != nil {
+			t.Fatalf("Append failed at %d: %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	var replayed [][]byte
+	err = Replay(path, func(payload []byte) error {
+		replayed = append(replayed, payload)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	if len(replayed) != len(written) {
+		t.Fatalf("Expected %d records, got %d", len(written), len(replayed))
+	}
+	for i := range written {
+		if !bytes.Equal(written[i], replayed[i]) {
+			t.Errorf("Record %d: expected %s, got %s", i, written[i], replayed[i])
+		}
+	}
+}
+
+func TestReplayStopsAtTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal_1.log")
+	w, err := Create(path, SyncPolicy{Mode: SyncPeriodic, Interval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	for i := range 3 {
+		if err := w.Append(fmt.Appendf(nil, "record-%d", i)); err != nil {
+			t.Fatalf("Append failed at %d: %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// chop the last record in half, like a crash in the middle of a write.
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-4); err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	err = Replay(path, func(payload []byte) error {
+		count++
+		return nil
+	})
+	if !errors.Is(err, ErrTornTail) {
+		t.Fatalf("Expected ErrTornTail, got %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 intact records, got %d", count)
+	}
+}
+
+func TestReplayCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal_1.log")
+	w, err := Create(path, SyncPolicy{Mode: SyncEveryWrite})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	for i := range 3 {
+		if err := w.Append(fmt.Appendf(nil, "record-%d", i)); err != nil {
+			t.Fatalf("Append failed at %d: %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordSize := len(data) / 3
+
+	replay := func(data []byte) (int, error) {
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		err := Replay(path, func(payload []byte) error {
+			count++
+			return nil
+		})
+		return count, err
+	}
+
+	// a flipped payload byte in the middle record, the last one is
+	// still there behind it.
+	damaged := bytes.Clone(data)
+	damaged[recordSize+headerSize+2] ^= 0xff
+	if count, err := replay(damaged); !errors.Is(err, ErrCorrupt) || count != 1 {
+		t.Errorf("Expected ErrCorrupt after 1 record, got %v after %d", err, count)
+	}
+
+	// the same in the last record is a torn tail.
+	damaged = bytes.Clone(data)
+	damaged[2*recordSize+headerSize+2] ^= 0xff
+	if count, err := replay(damaged); !errors.Is(err, ErrTornTail) || count != 2 {
+		t.Errorf("Expected ErrTornTail after 2 records, got %v after %d", err, count)
+	}
+
+	// a length far past the end of the file isn't allocated for.
+	damaged = bytes.Clone(data)
+	binary.BigEndian.PutUint32(damaged[recordSize+4:], 0xffffffff)
+	if count, err := replay(damaged); !errors.Is(err, ErrTornTail) || count != 1 {
+		t.Errorf("Expected ErrTornTail after 1 record, got %v after %d", err, count)
+	}
+}